@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/agent"
+	"github.com/personalconnect/dragpass-keeper/internal/doctor"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+	"github.com/personalconnect/dragpass-keeper/internal/manifest"
+)
+
+// Command-line subcommands. Browsers launch the keeper with the caller origin instead.
+const (
+	cmdInstallManifest   = "install-manifest"
+	cmdUninstallManifest = "uninstall-manifest"
+	cmdDoctor            = "doctor"
+	cmdCall              = "call"
+	cmdRepl              = "repl"
+	cmdAgent             = "agent"
+)
+
+// runCommand runs the subcommand named by args[0].
+// handled is false when args name no subcommand, e.g. when a browser launched the keeper.
+func runCommand(args []string, in io.Reader, out io.Writer) (handled bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case cmdInstallManifest:
+		err = installManifest(args[1:], out)
+	case cmdUninstallManifest:
+		err = uninstallManifest(args[1:], out)
+	case cmdDoctor:
+		err = runDoctor(args[1:], out)
+	case cmdCall:
+		err = runCall(args[1:], in, out)
+	case cmdRepl:
+		err = runRepl(args[1:], in, out)
+	case cmdAgent:
+		err = runAgent(args[1:], out)
+	default:
+		return false, nil
+	}
+	// -h prints the usage and is not a failure
+	if errors.Is(err, flag.ErrHelp) {
+		err = nil
+	}
+	return true, err
+}
+
+// listFlag collects a repeatable or comma separated flag
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// targetFlags are the -scope and -browser flags shared by the manifest commands
+type targetFlags struct {
+	scope    string
+	browsers listFlag
+}
+
+func (t *targetFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.scope, "scope", string(manifest.ScopeUser), "install for the current `user` or every user (system)")
+	fs.Var(&t.browsers, "browser", "browsers to install for: chrome, chromium, brave, edge, vivaldi, opera, firefox (default all)")
+}
+
+func (t *targetFlags) parse() (manifest.Scope, []manifest.Browser, error) {
+	scope, err := manifest.ParseScope(t.scope)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(t.browsers) == 0 {
+		return scope, manifest.Browsers, nil
+	}
+	browsers := make([]manifest.Browser, 0, len(t.browsers))
+	for _, name := range t.browsers {
+		browser, err := manifest.ParseBrowser(name)
+		if err != nil {
+			return "", nil, err
+		}
+		browsers = append(browsers, browser)
+	}
+	return scope, browsers, nil
+}
+
+func installManifest(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdInstallManifest, flag.ContinueOnError)
+	fs.SetOutput(out)
+	var target targetFlags
+	target.register(fs)
+	binary := fs.String("path", "", "keeper binary the browser launches (default this binary)")
+	var origins, extensions listFlag
+	fs.Var(&origins, "origin", "allowed caller origin, chrome-extension://<id>/ (default the keeper's allow-list)")
+	fs.Var(&extensions, "extension", "allowed Firefox extension id (default the keeper's allow-list)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	scope, browsers, err := target.parse()
+	if err != nil {
+		return err
+	}
+
+	if *binary == "" {
+		if *binary, err = executablePath(); err != nil {
+			return err
+		}
+	}
+	policy, err := keystore.LoadOriginPolicy()
+	if err != nil {
+		return err
+	}
+	if len(origins) == 0 {
+		origins = policy.Origins()
+	}
+	if len(extensions) == 0 {
+		extensions = policy.FirefoxExtensions()
+	}
+	for _, origin := range origins {
+		if _, err := keystore.ParseOrigin([]string{origin}); err != nil {
+			return err
+		}
+	}
+
+	m, err := manifest.New(*binary, origins, extensions)
+	if err != nil {
+		return err
+	}
+	installed := map[string]bool{}
+	for _, browser := range browsers {
+		path, err := manifest.Path(browser, scope)
+		if errors.Is(err, manifest.ErrUnsupported) && len(browsers) > 1 {
+			fmt.Fprintf(out, "skipped %s: %v\n", browser, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Browsers sharing a manifest location (Opera reads Chrome's) get it once
+		if installed[path] {
+			fmt.Fprintf(out, "installed %s manifest for %s: %s\n", scope, browser, path)
+			continue
+		}
+		if path, err = manifest.Install(browser, scope, m); err != nil {
+			return err
+		}
+		installed[path] = true
+		fmt.Fprintf(out, "installed %s manifest for %s: %s\n", scope, browser, path)
+	}
+	return nil
+}
+
+func uninstallManifest(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdUninstallManifest, flag.ContinueOnError)
+	fs.SetOutput(out)
+	var target targetFlags
+	target.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	scope, browsers, err := target.parse()
+	if err != nil {
+		return err
+	}
+
+	for _, browser := range browsers {
+		path, removed, err := manifest.Uninstall(browser, scope)
+		if errors.Is(err, manifest.ErrUnsupported) && len(browsers) > 1 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if removed {
+			fmt.Fprintf(out, "removed %s manifest for %s: %s\n", scope, browser, path)
+		} else {
+			fmt.Fprintf(out, "no %s manifest for %s at %s\n", scope, browser, path)
+		}
+	}
+	return nil
+}
+
+// errProblemsFound makes doctor exit with a failure status
+var errProblemsFound = errors.New("doctor found problems")
+
+func runDoctor(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdDoctor, flag.ContinueOnError)
+	fs.SetOutput(out)
+	var browsers listFlag
+	fs.Var(&browsers, "browser", "browsers to check manifests for (default all)")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := doctor.Options{}
+	for _, name := range browsers {
+		browser, err := manifest.ParseBrowser(name)
+		if err != nil {
+			return err
+		}
+		opts.Browsers = append(opts.Browsers, browser)
+	}
+	if exe, err := executablePath(); err == nil {
+		opts.Executable = exe
+	}
+
+	report := doctor.Run(opts)
+	if *asJSON {
+		if err := report.WriteJSON(out); err != nil {
+			return err
+		}
+	} else {
+		report.WriteText(out)
+	}
+	if !report.OK {
+		return errProblemsFound
+	}
+	return nil
+}
+
+func runAgent(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdAgent, flag.ContinueOnError)
+	fs.SetOutput(out)
+	socket := fs.String("socket", agent.SocketPath(), "Unix socket to listen on")
+	idle := fs.Duration("idle-timeout", agent.DefaultIdleTimeout, "close unused keystores after this long without requests (0 keeps them open)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := keystore.LoadBinaryInfo(); err != nil {
+		log.Printf("Warning: Failed to calculate binary info: %v", err)
+	}
+	a, err := agent.New(*idle)
+	if err != nil {
+		return err
+	}
+	l, err := agent.Listen(*socket)
+	if err != nil {
+		return err
+	}
+
+	// Remove the socket on exit, so native hosts stop forwarding to it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		l.Close()
+	}()
+
+	fmt.Fprintf(out, "%s=%s; export %s\n", config.AgentSocketEnv, *socket, config.AgentSocketEnv)
+	log.Printf("DragPass keeper agent listening on %s", *socket)
+	return a.Serve(l)
+}
+
+// executablePath is the absolute path of this binary with symlinks resolved,
+// so the manifest keeps working when the link is moved
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve executable path: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return exe, nil
+}
@@ -9,4 +9,102 @@ const (
 	SessionCode                     = "session_code"
 	PendingDragPassKeeperPrivateKey = "pending_keeper_private_key"
 	PendingDragPassKeeperPublicKey  = "pending_keeper_public_key"
+
+	DragPassKeeperPublicKeyFingerprint        = "keeper_public_key_fingerprint"
+	PendingDragPassKeeperPublicKeyFingerprint = "pending_keeper_public_key_fingerprint"
+
+	// DragPassServerKeySet holds the trusted server keys by kid and the signed rotations
+	// that introduced them. DragPassServerPublicKey mirrors the active key.
+	DragPassServerKeySet = "server_key_set"
+
+	// ChallengeNonces holds the nonces of challenge tokens already accepted, until they expire
+	ChallengeNonces = "challenge_nonces"
+)
+
+// Items lists every item the keeper stores under Service.
+// Backends that cannot enumerate their contents use it to implement List.
+var Items = []string{
+	DeviceKey,
+	DragPassKeeperPrivateKey,
+	DragPassKeeperPublicKey,
+	DragPassServerPublicKey,
+	SessionCode,
+	PendingDragPassKeeperPrivateKey,
+	PendingDragPassKeeperPublicKey,
+	DragPassKeeperPublicKeyFingerprint,
+	PendingDragPassKeeperPublicKeyFingerprint,
+	DragPassServerKeySet,
+	ChallengeNonces,
+}
+
+// DoctorProbe is written, read back and deleted by the doctor command to test the storage backend
+const DoctorProbe = "doctor_probe"
+
+// Storage transaction bookkeeping.
+// Values are staged under StagedItemPrefix + item, and the journal is the commit marker.
+const (
+	TransactionJournal = "transaction_journal"
+	StagedItemPrefix   = "staged_"
+)
+
+// Storage backend selection
+const (
+	// StoreBackendEnv selects the storage backend. When unset the OS keyring is used,
+	// falling back to the file vault where no keyring service is reachable.
+	StoreBackendEnv     = "DRAGPASS_KEEPER_STORE"
+	StoreBackendKeyring = "keyring"
+	StoreBackendFile    = "file"
+
+	// VaultPassphraseEnv supplies the file vault passphrase.
+	// Without it the vault key is bound to the machine and user.
+	VaultPassphraseEnv = "DRAGPASS_KEEPER_VAULT_PASSPHRASE"
+	VaultDir           = "dragpass"
+	VaultFile          = "keeper.vault"
+)
+
+// Linux kernel keyring backend. Kernel keys do not survive a reboot,
+// so this backend is only used when selected explicitly.
+const (
+	StoreBackendKeyctl = "keyctl"
+
+	// KeyctlKeyringEnv selects the keyring holding the items: "user" (default) or "session"
+	KeyctlKeyringEnv = "DRAGPASS_KEEPER_KEYCTL_KEYRING"
+	// KeyctlTimeoutEnv sets an expiry (e.g. "12h") for every item.
+	// KeyctlTimeoutEnv + "_" + upper-cased item name overrides it per item,
+	// e.g. DRAGPASS_KEEPER_KEYCTL_TIMEOUT_SESSION_CODE=1h.
+	KeyctlTimeoutEnv = "DRAGPASS_KEEPER_KEYCTL_TIMEOUT"
+)
+
+// Challenge tokens
+const (
+	// ChallengeAudience is the "aud" claim a challenge token must carry
+	ChallengeAudience = "dragpass-keeper"
+
+	// StrictChallengesEnv, on unless set to false, rejects legacy challenge tokens that are
+	// not JWTs and so carry no expiry or nonce, and server signatures that name no purpose
+	StrictChallengesEnv = "DRAGPASS_KEEPER_STRICT_CHALLENGES"
+)
+
+// Caller origins
+const (
+	// ExtensionID is the extension allowed to launch the keeper by default.
+	// Keep it in sync with EXTENSION_ID in the Makefile and allowed_origins in setup.iss.
+	ExtensionID = "cmgjlocmnppfpknaipdfodjhbplnhimk"
+	// FirefoxExtensionID is the Firefox build of the extension allowed by default.
+	// Keep it in sync with browser_specific_settings.gecko.id in the extension manifest.
+	FirefoxExtensionID = "keeper@dragpass.app"
+
+	// AllowedOriginsEnv replaces the default allow-list with a comma separated list of Chrome
+	// or Firefox extension ids, each optionally followed by "=namespace", e.g. "abc...=dev,def...=beta".
+	// An extension with a namespace gets a keystore of its own.
+	AllowedOriginsEnv = "DRAGPASS_KEEPER_ALLOWED_ORIGINS"
+)
+
+// Keeper agent
+const (
+	// AgentSocketEnv overrides the Unix socket the agent listens on and native hosts forward to.
+	// By default it is agent.sock under $XDG_RUNTIME_DIR/dragpass-keeper, or a per-user directory in the temp dir.
+	AgentSocketEnv  = "DRAGPASS_KEEPER_AGENT_SOCK"
+	AgentSocketDir  = "dragpass-keeper"
+	AgentSocketFile = "agent.sock"
 )
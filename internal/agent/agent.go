@@ -0,0 +1,268 @@
+// Package agent runs one long-lived keeper per user behind a Unix socket, in the style of ssh-agent.
+// Browsers still launch a native host for every connection; with an agent running it only forwards
+// the extension's frames to the agent, which keeps its keystores open and prepared between connections.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+)
+
+// DefaultIdleTimeout is how long unused keystores are kept open after the last request
+const DefaultIdleTimeout = 15 * time.Minute
+
+// handshakeTimeout bounds the handshake, which includes opening the keystore on first use
+var handshakeTimeout = 10 * time.Second
+
+// handshake is the first frame a native host sends on a new connection:
+// the origin that launched it, which the agent checks against its own allow-list
+type handshake struct {
+	Origin      string `json:"origin,omitempty"`
+	ExtensionID string `json:"extension_id"`
+	Manifest    string `json:"manifest,omitempty"`
+}
+
+// Agent serves connections from native hosts with one keeper per keystore
+type Agent struct {
+	policy      keystore.OriginPolicy
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	keystores map[string]*openKeystore
+	idle      *time.Timer
+}
+
+// openKeystore is an open keystore, its keeper shared by every connection of the namespace
+type openKeystore struct {
+	// ready is closed once keeper or err is set
+	ready  chan struct{}
+	keeper *keystore.Keeper
+	err    error
+
+	sessions int
+}
+
+// New returns an agent serving the origins on the allow-list. Keystores no connection uses
+// are closed after idleTimeout without requests; zero keeps them until the agent exits.
+func New(idleTimeout time.Duration) (*Agent, error) {
+	policy, err := keystore.LoadOriginPolicy()
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{policy: policy, idleTimeout: idleTimeout, keystores: map[string]*openKeystore{}}
+	if idleTimeout > 0 {
+		a.idle = time.AfterFunc(idleTimeout, a.expire)
+	}
+	return a, nil
+}
+
+// Serve accepts connections on l until it is closed
+func (a *Agent) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		log.Printf("Agent refused connection: %v", err)
+		return
+	}
+	msgr := keystore.NewMessenger(conn, conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	origin, err := a.authorize(msgr)
+	if err != nil {
+		log.Printf("Agent refused connection: %v", err)
+		_ = msgr.SendResponse(keystore.BaseResponse{Error: err.Error()})
+		return
+	}
+
+	keeper, err := a.acquire(origin)
+	if err != nil {
+		log.Printf("Agent failed to open keystore %s: %v", origin.Service(), err)
+		_ = msgr.SendResponse(keystore.BaseResponse{Error: err.Error(), Code: keystore.ErrorCodeKeystoreUnavailable})
+		return
+	}
+	defer a.release(origin)
+
+	_ = conn.SetReadDeadline(time.Time{})
+	if err := msgr.SendResponse(keystore.BaseResponse{Success: true}); err != nil {
+		log.Printf("Agent failed to answer handshake: %v", err)
+		return
+	}
+	log.Printf("Agent serving %s (keystore %s)", origin, origin.Service())
+	keeper.ForOrigin(origin).Serve(msgr)
+}
+
+// authorize reads the handshake and checks its origin against the agent's allow-list
+func (a *Agent) authorize(msgr *keystore.Messenger) (keystore.Origin, error) {
+	msg, err := msgr.ReadMessage()
+	if err != nil {
+		return keystore.Origin{}, fmt.Errorf("failed to read handshake: %v", err)
+	}
+	var hs handshake
+	if err := json.Unmarshal(msg, &hs); err != nil {
+		return keystore.Origin{}, fmt.Errorf("invalid handshake: %v", err)
+	}
+	return a.policy.Authorize(keystore.Origin{URL: hs.Origin, ExtensionID: hs.ExtensionID, Manifest: hs.Manifest})
+}
+
+// acquire returns the keeper for the keystore of origin, opening the keystore on first use.
+// The keystore is opened without holding the agent lock, so a slow keyring only holds up
+// connections to the same keystore.
+func (a *Agent) acquire(origin keystore.Origin) (*keystore.Keeper, error) {
+	service := origin.Service()
+
+	a.mu.Lock()
+	ks, opened := a.keystores[service]
+	if !opened {
+		ks = &openKeystore{ready: make(chan struct{})}
+		a.keystores[service] = ks
+	}
+	// Counted before the keystore is ready, so expire leaves it alone
+	ks.sessions++
+	a.resetIdle()
+	a.mu.Unlock()
+
+	if !opened {
+		ks.keeper, ks.err = a.open(service)
+		close(ks.ready)
+	}
+	<-ks.ready
+	if ks.err != nil {
+		a.release(origin)
+		return nil, ks.err
+	}
+	return ks.keeper, nil
+}
+
+// open opens and prepares the keystore of service
+func (a *Agent) open(service string) (*keystore.Keeper, error) {
+	store, err := keystore.OpenStore(service)
+	if err != nil {
+		return nil, err
+	}
+	keeper := keystore.NewKeeper(store)
+	if err := keeper.Prepare(); err != nil {
+		return nil, err
+	}
+	keeper.Use(a.touch)
+	return keeper, nil
+}
+
+func (a *Agent) release(origin keystore.Origin) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	service := origin.Service()
+	ks := a.keystores[service]
+	ks.sessions--
+	// A keystore that failed to open is tried again by the next connection
+	if ks.sessions == 0 && ks.err != nil {
+		delete(a.keystores, service)
+	}
+	a.resetIdle()
+}
+
+// touch restarts the idle timer on every request
+func (a *Agent) touch(next keystore.ActionHandler) keystore.ActionHandler {
+	return func(k *keystore.Keeper, req keystore.BaseRequest) keystore.BaseResponse {
+		a.mu.Lock()
+		a.resetIdle()
+		a.mu.Unlock()
+		return next(k, req)
+	}
+}
+
+func (a *Agent) resetIdle() {
+	if a.idle != nil {
+		a.idle.Reset(a.idleTimeout)
+	}
+}
+
+// expire closes the keystores no connection uses once the agent went idle,
+// so they are unlocked again on the next connection
+func (a *Agent) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for service, ks := range a.keystores {
+		if ks.sessions == 0 {
+			delete(a.keystores, service)
+		}
+	}
+	log.Printf("Agent idle for %s, closed unused keystores", a.idleTimeout)
+}
+
+// Dial connects to the agent listening on path on behalf of origin.
+// The connection is ready to carry the extension's frames, see Proxy.
+// A socket or agent that may belong to another user is refused, so the caller serves the extension itself.
+func Dial(path string, origin keystore.Origin) (net.Conn, error) {
+	if err := checkSocket(path); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("refusing agent: %v", err)
+	}
+	// An agent that accepts but never answers must not hang the browser's keeper
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	msg, _ := json.Marshal(handshake{Origin: origin.URL, ExtensionID: origin.ExtensionID, Manifest: origin.Manifest})
+	raw, err := keystore.NewClient(conn, conn).Call(msg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("agent handshake failed: %v", err)
+	}
+	var resp keystore.BaseResponse
+	if err := json.Unmarshal(raw, &resp); err != nil || !resp.Success {
+		conn.Close()
+		return nil, fmt.Errorf("agent refused %s: %s", origin, resp.Error)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Proxy forwards frames from the extension on in to the agent, and the agent's frames to out,
+// until either side closes the connection
+func Proxy(conn net.Conn, in io.Reader, out io.Writer) error {
+	defer conn.Close()
+
+	go func() {
+		_, _ = io.Copy(conn, in)
+		// The agent finishes the requests in flight once the extension is gone
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(out, conn)
+	return err
+}
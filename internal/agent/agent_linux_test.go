@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+)
+
+const devExtensionID = "abcdefghijklmnopabcdefghijklmnop"
+
+var defaultOrigin = keystore.Origin{URL: "chrome-extension://" + config.ExtensionID + "/", ExtensionID: config.ExtensionID}
+
+// startAgent serves an agent on a socket in a temp dir, with keystores in the file vault
+func startAgent(t *testing.T, idleTimeout time.Duration) (*Agent, string) {
+	t.Helper()
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv(config.StoreBackendEnv, config.StoreBackendFile)
+	t.Setenv(config.VaultPassphraseEnv, "passphrase")
+	t.Setenv(config.AllowedOriginsEnv, "")
+
+	a, err := New(idleTimeout)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "agent", config.AgentSocketFile)
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go a.Serve(l)
+	return a, path
+}
+
+// connect proxies a connection to the agent the way a native host does,
+// returning a client in the extension's place
+func connect(t *testing.T, path string, origin keystore.Origin) (*keystore.Client, func()) {
+	t.Helper()
+	conn, err := Dial(path, origin)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = Proxy(conn, inR, outW)
+		outW.Close()
+	}()
+	return keystore.NewClient(outR, inW), func() {
+		inW.Close()
+		<-done
+	}
+}
+
+func call(t *testing.T, client *keystore.Client, msg string) keystore.BaseResponse {
+	t.Helper()
+	raw, err := client.Call([]byte(msg))
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	var resp keystore.BaseResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	return resp
+}
+
+func TestAgentSharesKeeperAcrossConnections(t *testing.T) {
+	_, path := startAgent(t, 0)
+
+	first, closeFirst := connect(t, path, defaultOrigin)
+	if resp := call(t, first, `{"id":1,"action":"savedevicekey","payload":{"key":"device-secret"}}`); !resp.Success {
+		t.Fatalf("savedevicekey failed: %+v", resp)
+	}
+	closeFirst()
+
+	second, closeSecond := connect(t, path, defaultOrigin)
+	defer closeSecond()
+	resp := call(t, second, `{"id":2,"action":"getdevicekey"}`)
+	if data, _ := resp.Data.(map[string]any); !resp.Success || data["key"] != "device-secret" {
+		t.Errorf("Expected the second connection to read the saved key, got: %+v", resp)
+	}
+	if string(resp.ID) != "2" {
+		t.Errorf("Expected the response to carry the request id, got %s", resp.ID)
+	}
+}
+
+func TestAgentSeesWritesFromOtherKeepers(t *testing.T) {
+	_, path := startAgent(t, 0)
+
+	client, closeClient := connect(t, path, defaultOrigin)
+	defer closeClient()
+	if resp := call(t, client, `{"action":"savedevicekey","payload":{"key":"device-secret"}}`); !resp.Success {
+		t.Fatalf("savedevicekey failed: %+v", resp)
+	}
+	call(t, client, `{"action":"getdevicekey"}`)
+
+	// A keeper launched without the agent writes to the same vault
+	store, err := keystore.OpenStore(config.Service)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	if err := store.Set(config.DeviceKey, "other-secret"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	resp := call(t, client, `{"action":"getdevicekey"}`)
+	if data, _ := resp.Data.(map[string]any); !resp.Success || data["key"] != "other-secret" {
+		t.Errorf("Expected the agent to read the new key, got: %+v", resp)
+	}
+}
+
+func TestDialTimesOutSilentAgent(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	// Accepts connections but never answers the handshake
+	path := filepath.Join(t.TempDir(), "agent", config.AgentSocketFile)
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	if _, err := Dial(path, defaultOrigin); err == nil || !strings.Contains(err.Error(), "handshake") {
+		t.Errorf("Expected the handshake to time out, got: %v", err)
+	}
+}
+
+func TestDialRefusesUnsafeSocket(t *testing.T) {
+	tests := []struct {
+		name   string
+		root   bool
+		tamper func(t *testing.T, path string)
+	}{
+		{name: "directory other users can reach", tamper: func(t *testing.T, path string) {
+			chmod(t, filepath.Dir(path), 0755)
+		}},
+		{name: "socket other users can reach", tamper: func(t *testing.T, path string) {
+			chmod(t, path, 0666)
+		}},
+		{name: "directory owned by another user", root: true, tamper: func(t *testing.T, path string) {
+			if err := os.Chown(filepath.Dir(path), 65534, 65534); err != nil {
+				t.Fatalf("Chown failed: %v", err)
+			}
+		}},
+		{name: "symlinked directory", tamper: func(t *testing.T, path string) {
+			dir := filepath.Dir(path)
+			if err := os.Rename(dir, dir+".real"); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			if err := os.Symlink(dir+".real", dir); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.root && os.Getuid() != 0 {
+				t.Skip("changing the owner needs root")
+			}
+			_, path := startAgent(t, 0)
+			tt.tamper(t, path)
+
+			if conn, err := Dial(path, defaultOrigin); err == nil || !strings.Contains(err.Error(), "unsafe") {
+				if conn != nil {
+					conn.Close()
+				}
+				t.Errorf("Expected the socket to be refused, got: %v", err)
+			}
+			if l, err := Listen(path); err == nil {
+				l.Close()
+				t.Errorf("Expected Listen to refuse the socket directory")
+			}
+		})
+	}
+}
+
+func chmod(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+}
+
+func TestAgentRefusesUnknownOrigin(t *testing.T) {
+	_, path := startAgent(t, 0)
+
+	_, err := Dial(path, keystore.Origin{URL: "chrome-extension://" + devExtensionID + "/", ExtensionID: devExtensionID})
+	if err == nil || !strings.Contains(err.Error(), "origin not allowed") {
+		t.Errorf("Expected an origin outside the allow-list to be refused, got: %v", err)
+	}
+}
+
+func TestAgentIdleTimeoutDropsKeystores(t *testing.T) {
+	a, path := startAgent(t, 50*time.Millisecond)
+
+	client, closeClient := connect(t, path, defaultOrigin)
+	call(t, client, `{"action":"ping"}`)
+	closeClient()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		open := len(a.keystores)
+		a.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the idle agent to close its keystores, %d still open", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent", config.AgentSocketFile)
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a socket only the user can use, got %v: %v", info.Mode(), err)
+	}
+	if _, err := Listen(path); err == nil {
+		t.Errorf("Expected a second agent on the same socket to be refused")
+	}
+
+	// A socket left behind by an agent that did not clean up is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = Listen(path); err != nil {
+		t.Fatalf("Expected a stale socket to be replaced, got: %v", err)
+	}
+	l.Close()
+
+	open := t.TempDir()
+	if err := os.Chmod(open, 0755); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if _, err := Listen(filepath.Join(open, config.AgentSocketFile)); err == nil {
+		t.Errorf("Expected a socket directory other users can reach to be refused")
+	}
+}
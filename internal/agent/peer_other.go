@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package agent
+
+import "errors"
+
+// peerUID is not available here; the socket permissions alone keep other users out
+func peerUID(fd uintptr) (int, error) {
+	return -1, errors.ErrUnsupported
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// SocketPath returns the agent socket: config.AgentSocketEnv when set, otherwise
+// agent.sock in a directory of the current user's under $XDG_RUNTIME_DIR or the temp dir
+func SocketPath() string {
+	if path := os.Getenv(config.AgentSocketEnv); path != "" {
+		return path
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, config.AgentSocketDir, config.AgentSocketFile)
+	}
+	dir := config.AgentSocketDir
+	if uid := os.Getuid(); uid >= 0 {
+		dir += "-" + strconv.Itoa(uid)
+	}
+	return filepath.Join(os.TempDir(), dir, config.AgentSocketFile)
+}
+
+// Listen creates the agent socket at path, readable and writable by the current user only.
+// A stale socket left by an agent that exited is replaced; a live one is an error.
+func Listen(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	// Other users must not be able to reach the socket or replace it
+	if err := checkPath(dir, os.ModeDir, 0700); err != nil {
+		return nil, fmt.Errorf("unsafe socket directory: %v", err)
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to check socket: %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %v", err)
+	}
+	return l, nil
+}
+
+// checkSocket refuses a socket another user could have planted or could reach:
+// the directory must be the current user's with mode 0700 and the socket the current user's with mode 0600.
+// A missing socket or directory is reported as fs.ErrNotExist.
+func checkSocket(path string) error {
+	if err := checkPath(filepath.Dir(path), os.ModeDir, 0700); err != nil {
+		return fmt.Errorf("unsafe socket directory: %w", err)
+	}
+	if err := checkPath(path, os.ModeSocket, 0600); err != nil {
+		return fmt.Errorf("unsafe socket: %w", err)
+	}
+	return nil
+}
+
+// checkPeer refuses a connection whose other end runs as another user
+func checkPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("not a Unix socket connection: %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	uid, uidErr := -1, error(nil)
+	if err := raw.Control(func(fd uintptr) { uid, uidErr = peerUID(fd) }); err != nil {
+		return err
+	}
+	switch {
+	case errors.Is(uidErr, errors.ErrUnsupported):
+		return nil
+	case uidErr != nil:
+		return fmt.Errorf("failed to read peer credentials: %v", uidErr)
+	case uid != os.Getuid():
+		return fmt.Errorf("peer runs as uid %d, not the current user", uid)
+	}
+	return nil
+}
+
+func typeName(typ os.FileMode) string {
+	switch typ {
+	case os.ModeDir:
+		return "directory"
+	case os.ModeSocket:
+		return "socket"
+	default:
+		return typ.String()
+	}
+}
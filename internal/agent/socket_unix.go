@@ -0,0 +1,32 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPath refuses path unless it is a file of type typ, not a symlink, owned by the
+// current user and with exactly the permissions perm
+func checkPath(path string, typ, perm os.FileMode) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != typ {
+		return fmt.Errorf("%s is not a %s (mode %v)", path, typeName(typ), info.Mode())
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to determine the owner of %s", path)
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not the current user", path, st.Uid)
+	}
+	if info.Mode().Perm() != perm {
+		return fmt.Errorf("%s has mode %v instead of %v", path, info.Mode().Perm(), perm)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkPath refuses symlinks. Ownership and modes are left to the ACLs of the user's
+// profile directories, which hold the socket on Windows.
+func checkPath(path string, typ, perm os.FileMode) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is not a %s (mode %v)", path, typeName(typ), info.Mode())
+	}
+	return nil
+}
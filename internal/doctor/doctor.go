@@ -0,0 +1,348 @@
+// Package doctor diagnoses why the extension cannot reach the keeper: manifests,
+// the storage backend, the stored items and the server key
+package doctor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+	"github.com/personalconnect/dragpass-keeper/internal/manifest"
+)
+
+// Status is the outcome of a single check
+type Status string
+
+const (
+	StatusOK Status = "ok"
+	// StatusWarn is worth a look but does not stop the extension from working
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+)
+
+// Check is one diagnosed aspect of the installation
+type Check struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+	// Fix tells the user how to resolve a warning or failure
+	Fix string `json:"fix,omitempty"`
+}
+
+// Report is the outcome of every check
+type Report struct {
+	Version    string  `json:"version"`
+	Executable string  `json:"executable"`
+	Checks     []Check `json:"checks"`
+	// OK is false when any check failed
+	OK bool `json:"ok"`
+}
+
+// Options selects what Run checks
+type Options struct {
+	// Executable is the keeper binary manifests should point at
+	Executable string
+	// Browsers to check manifests for; every browser when empty
+	Browsers []manifest.Browser
+}
+
+// Run performs every check. It only writes to the keystore to probe it.
+func Run(opts Options) Report {
+	report := Report{Version: keystore.Version, Executable: opts.Executable}
+
+	policy, err := keystore.LoadOriginPolicy()
+	if err != nil {
+		report.add(Check{
+			Name:   "allow-list",
+			Status: StatusFail,
+			Detail: err.Error(),
+			Fix:    fmt.Sprintf("correct or unset %s", config.AllowedOriginsEnv),
+		})
+		return report.finish()
+	}
+
+	report.checkManifests(opts, policy)
+	for _, namespace := range policy.Namespaces() {
+		report.checkKeystore(keystore.Origin{Namespace: namespace})
+	}
+	return report.finish()
+}
+
+func (r *Report) add(check Check) {
+	r.Checks = append(r.Checks, check)
+}
+
+func (r Report) finish() Report {
+	r.OK = !slices.ContainsFunc(r.Checks, func(c Check) bool { return c.Status == StatusFail })
+	return r
+}
+
+// checkManifests checks the manifest of every browser in both scopes.
+// A browser without a manifest may simply not be installed, but at least one manifest must work.
+func (r *Report) checkManifests(opts Options, policy keystore.OriginPolicy) {
+	browsers := opts.Browsers
+	if len(browsers) == 0 {
+		browsers = manifest.Browsers
+	}
+
+	working := false
+	checked := map[string]bool{}
+	for _, browser := range browsers {
+		found := false
+		for _, scope := range []manifest.Scope{manifest.ScopeUser, manifest.ScopeSystem} {
+			path, err := manifest.Find(browser, scope)
+			if errors.Is(err, manifest.ErrUnsupported) || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			name := fmt.Sprintf("manifest %s (%s)", browser, scope)
+			if err != nil {
+				r.add(Check{Name: name, Status: StatusFail, Detail: err.Error(), Fix: installFix(browser, scope)})
+				found = true
+				continue
+			}
+			// Browsers sharing a manifest location are checked once
+			if checked[path] {
+				found = true
+				continue
+			}
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			checked[path] = true
+			found = true
+
+			check := checkManifest(browser, scope, path, opts.Executable, policy)
+			check.Name = name
+			working = working || check.Status != StatusFail
+			r.add(check)
+		}
+		if !found {
+			r.add(Check{
+				Name:   fmt.Sprintf("manifest %s", browser),
+				Status: StatusWarn,
+				Detail: "not installed; ignore if you do not use " + string(browser),
+				Fix:    installFix(browser, manifest.ScopeUser),
+			})
+		}
+	}
+
+	if !working {
+		r.add(Check{
+			Name:   "manifests",
+			Status: StatusFail,
+			Detail: "no browser has a working manifest, so no extension can launch the keeper",
+			Fix:    "dragpass-keeper install-manifest",
+		})
+	}
+}
+
+func checkManifest(browser manifest.Browser, scope manifest.Scope, path, executable string, policy keystore.OriginPolicy) Check {
+	fix := installFix(browser, scope)
+	m, err := manifest.Read(browser, scope)
+	if err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Fix: fix}
+	}
+
+	switch {
+	case m.Name != manifest.Name:
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s names host %q instead of %q", path, m.Name, manifest.Name), Fix: fix}
+	case m.Type != "stdio":
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s has type %q instead of \"stdio\"", path, m.Type), Fix: fix}
+	case !filepath.IsAbs(m.Path):
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s points at relative path %q", path, m.Path), Fix: fix}
+	}
+
+	info, err := os.Stat(m.Path)
+	switch {
+	case err != nil:
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s points at %s: %v", path, m.Path, err), Fix: fix}
+	case info.IsDir() || (runtime.GOOS != "windows" && info.Mode().Perm()&0o111 == 0):
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s points at %s, which is not executable", path, m.Path), Fix: fix}
+	}
+
+	allowed, want := m.AllowedOrigins, policy.Origins()
+	if browser == manifest.Firefox {
+		allowed, want = m.AllowedExtensions, policy.FirefoxExtensions()
+	}
+	if !slices.ContainsFunc(want, func(caller string) bool { return slices.Contains(allowed, caller) }) {
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s allows %v, none of which the keeper serves (%v)", path, allowed, want), Fix: fix}
+	}
+
+	if executable != "" && !sameFile(m.Path, executable) {
+		return Check{
+			Status: StatusWarn,
+			Detail: fmt.Sprintf("%s points at %s, not this keeper (%s)", path, m.Path, executable),
+			Fix:    fix + " (if this keeper is the one to use)",
+		}
+	}
+	return Check{Status: StatusOK, Detail: path}
+}
+
+func installFix(browser manifest.Browser, scope manifest.Scope) string {
+	return fmt.Sprintf("dragpass-keeper install-manifest -browser %s -scope %s", browser, scope)
+}
+
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// checkKeystore checks the keystore an origin's namespace maps to
+func (r *Report) checkKeystore(origin keystore.Origin) {
+	suffix := ""
+	if origin.Namespace != "" {
+		suffix = fmt.Sprintf(" (namespace %s)", origin.Namespace)
+	}
+
+	store, err := keystore.OpenStore(origin.Service())
+	if err != nil {
+		r.add(Check{Name: "keystore" + suffix, Status: StatusFail, Detail: err.Error(), Fix: backendFix(err)})
+		return
+	}
+	backend := keystore.StoreBackend(store)
+	if err := keystore.ProbeStore(store); err != nil {
+		r.add(Check{Name: "keystore" + suffix, Status: StatusFail, Detail: fmt.Sprintf("%s backend: %v", backend, err), Fix: backendFix(err)})
+		return
+	}
+	detail := backend + " backend is readable and writable"
+	if backend == config.StoreBackendFile && os.Getenv(config.StoreBackendEnv) == "" {
+		detail += " (no Secret Service found, using the file vault)"
+	}
+	r.add(Check{Name: "keystore" + suffix, Status: StatusOK, Detail: detail})
+
+	keeper := keystore.NewKeeper(store)
+	r.checkState(store, keeper, suffix)
+	r.checkServerKey(keeper, suffix)
+}
+
+func backendFix(err error) string {
+	switch {
+	case errors.Is(err, keystore.ErrKeystoreUnavailable):
+		return fmt.Sprintf("unlock the OS keychain or keyring and retry, or set %s=%s to use the file vault", config.StoreBackendEnv, config.StoreBackendFile)
+	case strings.Contains(err.Error(), "unknown storage backend"):
+		return fmt.Sprintf("set %s to %s, %s or %s, or unset it", config.StoreBackendEnv, config.StoreBackendKeyring, config.StoreBackendFile, config.StoreBackendKeyctl)
+	default:
+		return fmt.Sprintf("check the storage backend, or select another with %s", config.StoreBackendEnv)
+	}
+}
+
+// checkState reports the stored items and the keypair consistency
+func (r *Report) checkState(store keystore.SecretStore, keeper *keystore.Keeper, suffix string) {
+	report, err := keeper.CheckState()
+	if err != nil {
+		r.add(Check{Name: "items" + suffix, Status: StatusFail, Detail: err.Error(), Fix: backendFix(err)})
+		return
+	}
+
+	items := "none"
+	if len(report.Items) > 0 {
+		items = strings.Join(report.Items, ", ")
+	}
+	itemsCheck := Check{Name: "items" + suffix, Status: StatusOK, Detail: fmt.Sprintf("state %s; stored: %s", report.State, items)}
+	// Keyring backends only list the known items, so the journal is looked up directly
+	_, err = store.Get(config.TransactionJournal)
+	switch {
+	case err == nil:
+		itemsCheck.Status = StatusWarn
+		itemsCheck.Detail += "; an interrupted write is pending"
+		itemsCheck.Fix = "start the keeper once (open the extension) to finish or roll back the write"
+	case !errors.Is(err, keystore.ErrNotFound):
+		r.add(Check{Name: "items" + suffix, Status: StatusFail, Detail: err.Error(), Fix: backendFix(err)})
+		return
+	}
+	r.add(itemsCheck)
+
+	keypair := Check{Name: "keypair" + suffix, Status: StatusOK, Detail: "keeper keypair is consistent"}
+	switch report.State {
+	case keystore.StateUnregistered:
+		keypair.Detail = "no keeper keypair yet; it is created at signup"
+	case keystore.StatePendingSignup:
+		keypair.Detail = "signup in progress"
+	case keystore.StatePendingSession:
+		keypair.Detail = "login in progress; waiting for the session code"
+	}
+	var issues, repairs []string
+	for _, issue := range report.Issues {
+		// Server key tampering is reported by the server key check
+		if issue.Code == keystore.IssueServerKeyTampered {
+			continue
+		}
+		issues = append(issues, issue.Code+": "+issue.Description)
+		if !issue.Automatic && !slices.Contains(repairs, issue.Repair) {
+			repairs = append(repairs, issue.Repair)
+		}
+	}
+	switch {
+	case len(repairs) > 0:
+		keypair.Status = StatusFail
+		keypair.Fix = fmt.Sprintf("run the %s repair (repairstate action)", strings.Join(repairs, " or "))
+	case len(issues) > 0:
+		keypair.Status = StatusWarn
+		keypair.Fix = "repaired automatically the next time the keeper starts"
+	}
+	if len(issues) > 0 {
+		keypair.Detail = strings.Join(issues, "; ")
+	}
+	r.add(keypair)
+}
+
+// checkServerKey checks the stored server keys lead back to the embedded one
+func (r *Report) checkServerKey(keeper *keystore.Keeper, suffix string) {
+	name := "server key" + suffix
+	info, err := keeper.ServerKeyInfo()
+	switch {
+	case errors.Is(err, keystore.ErrNotFound):
+		r.add(Check{Name: name, Status: StatusWarn, Detail: "no server key stored yet", Fix: "start the keeper once (open the extension) to store the embedded server key"})
+	case errors.Is(err, keystore.ErrServerKeyTampered):
+		r.add(Check{Name: name, Status: StatusFail, Detail: err.Error(), Fix: fmt.Sprintf("run the %s repair (repairstate action)", keystore.RepairRestoreServerKey)})
+	case err != nil:
+		r.add(Check{Name: name, Status: StatusFail, Detail: err.Error(), Fix: backendFix(err)})
+	case info.Embedded:
+		r.add(Check{Name: name, Status: StatusOK, Detail: "matches the server key built into the keeper"})
+	default:
+		r.add(Check{Name: name, Status: StatusOK, Detail: fmt.Sprintf("active key %s, reached from the built-in key through %d signed rotation(s)", info.Active, info.Rotations)})
+	}
+}
+
+// WriteText writes the report for people, one line per check followed by its fix
+func (r Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "dragpass-keeper %s doctor\n", r.Version)
+	if r.Executable != "" {
+		fmt.Fprintf(w, "binary: %s\n", r.Executable)
+	}
+	fmt.Fprintln(w)
+
+	problems := 0
+	for _, check := range r.Checks {
+		fmt.Fprintf(w, "%-6s %s: %s\n", "["+string(check.Status)+"]", check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(w, "       fix: %s\n", check.Fix)
+		}
+		if check.Status == StatusFail {
+			problems++
+		}
+	}
+
+	fmt.Fprintln(w)
+	if problems == 0 {
+		fmt.Fprintln(w, "no problems found")
+	} else {
+		fmt.Fprintf(w, "%d problem(s) found\n", problems)
+	}
+}
+
+// WriteJSON writes the report as indented JSON
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
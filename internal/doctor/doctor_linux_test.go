@@ -0,0 +1,105 @@
+package doctor
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+	"github.com/personalconnect/dragpass-keeper/internal/manifest"
+)
+
+func setupEnv(t *testing.T) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv(config.StoreBackendEnv, config.StoreBackendFile)
+	t.Setenv(config.VaultPassphraseEnv, "passphrase")
+	t.Setenv(config.AllowedOriginsEnv, "")
+
+	exe := filepath.Join(t.TempDir(), "dragpass-keeper")
+	if err := os.WriteFile(exe, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Failed to create executable: %v", err)
+	}
+	return exe
+}
+
+func TestRunWithoutManifests(t *testing.T) {
+	exe := setupEnv(t)
+
+	report := Run(Options{Executable: exe, Browsers: []manifest.Browser{manifest.Chrome}})
+	if report.OK {
+		t.Errorf("Expected the report to fail without a manifest: %+v", report.Checks)
+	}
+	if check := findCheck(t, report, "manifests"); check.Status != StatusFail || check.Fix == "" {
+		t.Errorf("Expected a failed manifests check with a fix, got: %+v", check)
+	}
+	if check := findCheck(t, report, "keystore"); check.Status != StatusOK {
+		t.Errorf("Expected the keystore probe to pass, got: %+v", check)
+	}
+}
+
+func TestRunHealthy(t *testing.T) {
+	exe := setupEnv(t)
+
+	m, err := manifest.New(exe, []string{"chrome-extension://" + config.ExtensionID + "/"}, nil)
+	if err != nil {
+		t.Fatalf("manifest.New failed: %v", err)
+	}
+	if _, err := manifest.Install(manifest.Chrome, manifest.ScopeUser, m); err != nil {
+		t.Fatalf("manifest.Install failed: %v", err)
+	}
+
+	opts := Options{Executable: exe, Browsers: []manifest.Browser{manifest.Chrome}}
+	if check := findCheck(t, Run(opts), "server key"); check.Status != StatusWarn {
+		t.Errorf("Expected a warning before the server key is stored, got: %+v", check)
+	}
+
+	store, err := keystore.OpenStore(config.Service)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	if err := keystore.NewKeeper(store).EnsureServerPublicKey(); err != nil {
+		t.Fatalf("EnsureServerPublicKey failed: %v", err)
+	}
+
+	report := Run(opts)
+	if !report.OK {
+		t.Errorf("Expected a healthy report, got: %+v", report.Checks)
+	}
+	for _, check := range report.Checks {
+		if check.Status != StatusOK {
+			t.Errorf("Expected %s to pass, got: %+v", check.Name, check)
+		}
+	}
+	if _, err := store.Get(config.DoctorProbe); err == nil {
+		t.Errorf("Expected the probe item to be removed")
+	}
+
+	var out bytes.Buffer
+	if err := report.WriteJSON(&out); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || !decoded.OK || len(decoded.Checks) != len(report.Checks) {
+		t.Errorf("Unexpected JSON report (%v): %s", err, out.String())
+	}
+}
+
+func TestRunManifestWrongOrigin(t *testing.T) {
+	exe := setupEnv(t)
+
+	m, _ := manifest.New(exe, []string{"chrome-extension://abcdefghijklmnopabcdefghijklmnop/"}, nil)
+	if _, err := manifest.Install(manifest.Chrome, manifest.ScopeUser, m); err != nil {
+		t.Fatalf("manifest.Install failed: %v", err)
+	}
+
+	report := Run(Options{Executable: exe, Browsers: []manifest.Browser{manifest.Chrome}})
+	if check := findCheck(t, report, "manifest chrome (user)"); check.Status != StatusFail || check.Fix == "" {
+		t.Errorf("Expected a manifest missing the extension origin to fail, got: %+v", check)
+	}
+}
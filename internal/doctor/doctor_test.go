@@ -0,0 +1,51 @@
+package doctor
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+)
+
+func findCheck(t *testing.T, report Report, name string) Check {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("No %q check in report: %+v", name, report.Checks)
+	return Check{}
+}
+
+// keyringStore lists only the known items, like the keyring and keyctl backends
+type keyringStore struct {
+	keystore.SecretStore
+}
+
+func (s keyringStore) List() ([]string, error) {
+	items, err := s.SecretStore.List()
+	return slices.DeleteFunc(items, func(item string) bool { return !slices.Contains(config.Items, item) }), err
+}
+
+func TestCheckStateInterruptedWrite(t *testing.T) {
+	store := keyringStore{keystore.NewMemoryStore()}
+
+	var r Report
+	r.checkState(store, keystore.NewKeeper(store), "")
+	if check := findCheck(t, r, "items"); check.Status != StatusOK {
+		t.Errorf("Expected an empty keystore to pass, got: %+v", check)
+	}
+
+	if err := store.Set(config.TransactionJournal, "{}"); err != nil {
+		t.Fatalf("Failed to store journal: %v", err)
+	}
+	r = Report{}
+	r.checkState(store, keystore.NewKeeper(store), "")
+	check := findCheck(t, r, "items")
+	if check.Status != StatusWarn || !strings.Contains(check.Detail, "interrupted write") || check.Fix == "" {
+		t.Errorf("Expected a pending journal to warn, got: %+v", check)
+	}
+}
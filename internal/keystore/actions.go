@@ -2,16 +2,14 @@ package keystore
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
 	"time"
-
-	"github.com/golang-jwt/jwt/v4"
 )
 
 // HandlePing handles ping requests
-func HandlePing(req PingRequest) BaseResponse {
-	log.Println("ping request processing...")
+func (k *Keeper) HandlePing(req PingRequest) BaseResponse {
+	k.log.Println("ping request processing...")
 	return BaseResponse{
 		Success: true,
 		Data: PingResponseData{
@@ -22,389 +20,404 @@ func HandlePing(req PingRequest) BaseResponse {
 	}
 }
 
-// HandleGenerateKeypair handles keypair generation requests
-func HandleGenerateKeypair(req GenerateKeypairRequest) BaseResponse {
-	log.Println("keypair generation request processing...")
+// HandleHello negotiates the protocol version and reports what this keeper supports,
+// so the extension can feature-detect instead of parsing Version
+func (k *Keeper) HandleHello(req HelloRequest) BaseResponse {
+	k.log.Printf("hello request processing, client %q speaks %v", req.ClientVersion, req.ProtocolVersions)
 
-	// Get server public key for signature verification
-	serverPubKeyPEM, err := getServerPublicKey()
-	if err != nil {
-		log.Printf("keypair generation error: failed to get server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get server public key: " + err.Error()}
+	clientVersions := req.ProtocolVersions
+	if len(clientVersions) == 0 {
+		clientVersions = []int{1}
 	}
-
-	// Parse server public key
-	serverPubKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(serverPubKeyPEM))
-	if err != nil {
-		log.Printf("keypair generation error: failed to parse server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse server public key: " + err.Error()}
+	protocol := 0
+	for _, v := range clientVersions {
+		if v >= MinProtocolVersion && v <= ProtocolVersion && v > protocol {
+			protocol = v
+		}
 	}
-
-	// Decode the signature from base64
-	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
-	if err != nil {
-		log.Printf("keypair generation error: failed to decode signature: %v", err)
-		return BaseResponse{Success: false, Error: "failed to decode signature: " + err.Error()}
+	if protocol == 0 {
+		k.log.Printf("hello error: no common protocol version with %v", clientVersions)
+		return codeResponse(ErrorCodeProtocolUnsupported, fmt.Sprintf("client speaks protocol %v, keeper supports %d to %d. please update the extension", clientVersions, MinProtocolVersion, ProtocolVersion))
 	}
 
-	// Verify signature using server's public key
-	if err := VerifySignature(serverPubKey, req.ChallengeToken, signatureBytes); err != nil {
-		log.Printf("keypair generation error: signature verification failed: %v", err)
-		return BaseResponse{Success: false, Error: "signature verification failed: " + err.Error()}
+	supported := make([]int, 0, ProtocolVersion-MinProtocolVersion+1)
+	for v := MinProtocolVersion; v <= ProtocolVersion; v++ {
+		supported = append(supported, v)
 	}
-	log.Println("signature verification successful")
 
-	keyPair, err := GenerateRSAKeyPair()
-	if err != nil {
-		log.Printf("keypair generation error: %v", err)
-		return BaseResponse{Success: false, Error: "keypair generation failed: " + err.Error()}
+	return BaseResponse{
+		Success: true,
+		Data: HelloResponseData{
+			Protocol:               protocol,
+			ProtocolVersions:       supported,
+			Version:                Version,
+			Actions:                k.Actions(),
+			KeyAlgorithms:          SupportedKeyAlgorithms,
+			SignatureSchemes:       SupportedSignatureSchemes,
+			ServerSignatureSchemes: SupportedServerSignatureSchemes,
+			StoreBackend:           storeBackend(k.store),
+			PayloadSchemas:         k.payloadSchemas(),
+		},
 	}
+}
 
-	// Save(Overwrite) the new private key to the keystore
-	if err := savePrivateKey(keyPair.PrivateKey); err != nil {
-		log.Printf("private key save error: %v", err)
-		return BaseResponse{Success: false, Error: "private key save failed: " + err.Error()}
+// HandleGenerateKeypair handles keypair generation requests
+func (k *Keeper) HandleGenerateKeypair(req GenerateKeypairRequest) BaseResponse {
+	k.log.Println("keypair generation request processing...")
+
+	// Verify the challenge token: server signature, and for JWT tokens freshness, audience and nonce
+	if err := k.authorizeChallenge(req.purpose, req.ChallengeToken, req.Signature, req.ServerScheme, req.Kid); err != nil {
+		k.log.Printf("keypair generation error: %v", err)
+		return errorResponse(err.Error(), err)
 	}
+	k.log.Println("signature verification successful")
 
-	// Save the new public key to the keystore
-	if err := savePublicKey(keyPair.PublicKey); err != nil {
-		log.Printf("public key save error: %v", err)
-		return BaseResponse{Success: false, Error: "public key save failed: " + err.Error()}
+	keyPair, err := GenerateKeyPair(req.Algorithm)
+	if err != nil {
+		k.log.Printf("keypair generation error: %v", err)
+		return errorResponse("keypair generation failed: "+err.Error(), err)
 	}
 
-	// Delete existing session code if exists
-	if err := deleteSessionCode(); err != nil {
-		log.Printf("warning: failed to delete existing session code: %v", err)
+	// Replace(Overwrite) the keypair and delete the existing session code in one transaction
+	if err := k.replaceKeypair(keyPair); err != nil {
+		k.log.Printf("keypair save error: %v", err)
+		return errorResponse("keypair save failed: "+err.Error(), err)
 	}
 
-	log.Println("keypair generation and keypair save successful")
-	return BaseResponse{Success: true, Data: GenerateKeypairResponseData{PublicKey: keyPair.PublicKey}}
+	k.log.Println("keypair generation and keypair save successful")
+	return BaseResponse{Success: true, Data: GenerateKeypairResponseData{PublicKey: keyPair.PublicKey, Fingerprint: keyPair.Fingerprint, Algorithm: keyPair.Algorithm}}
 }
 
 // HandleGetDeviceKey handles device key retrieval requests
-func HandleGetDeviceKey(req GetDeviceKeyRequest) BaseResponse {
-	log.Println("key retrieval request processing...")
-	key, err := getDeviceKey()
+func (k *Keeper) HandleGetDeviceKey(req GetDeviceKeyRequest) BaseResponse {
+	k.log.Println("key retrieval request processing...")
+	key, err := k.getDeviceKey()
 	if err != nil {
-		log.Printf("key retrieval error: %v", err)
-		return BaseResponse{Success: false, Error: "key retrieval failed: " + err.Error()}
+		k.log.Printf("key retrieval error: %v", err)
+		return errorResponse("key retrieval failed: "+err.Error(), err)
 	}
 	return BaseResponse{Success: true, Data: GetDeviceKeyResponseData{Key: key}}
 }
 
 // HandleSaveDeviceKey handles device key save requests
-func HandleSaveDeviceKey(req SaveDeviceKeyRequest) BaseResponse {
-	log.Println("key save request processing...")
-	if err := saveDeviceKey(req.Key); err != nil {
-		log.Printf("key save error: %v", err)
-		return BaseResponse{Success: false, Error: "key save failed: " + err.Error()}
+func (k *Keeper) HandleSaveDeviceKey(req SaveDeviceKeyRequest) BaseResponse {
+	k.log.Println("key save request processing...")
+	if err := k.saveDeviceKey(req.Key); err != nil {
+		k.log.Printf("key save error: %v", err)
+		return errorResponse("key save failed: "+err.Error(), err)
 	}
 	return BaseResponse{Success: true}
 }
 
 // HandleDeleteDeviceKey handles device key deletion requests
-func HandleDeleteDeviceKey(req DeleteDeviceKeyRequest) BaseResponse {
-	log.Println("key delete request processing...")
-	if err := deleteDeviceKey(); err != nil {
-		log.Printf("key delete error: %v", err)
-		return BaseResponse{Success: false, Error: "key delete failed: " + err.Error()}
+func (k *Keeper) HandleDeleteDeviceKey(req DeleteDeviceKeyRequest) BaseResponse {
+	k.log.Println("key delete request processing...")
+	if err := k.deleteDeviceKey(); err != nil {
+		k.log.Printf("key delete error: %v", err)
+		return errorResponse("key delete failed: "+err.Error(), err)
 	}
 	return BaseResponse{Success: true}
 }
 
 // HandleSaveSessionCode handles session code save requests
-func HandleSaveSessionCode(req SaveSessionCodeRequest) BaseResponse {
-	log.Println("encrypted session code save request processing...")
-
-	// Get server public key for signature verification
-	serverPubKeyPEM, err := getServerPublicKey()
-	if err != nil {
-		log.Printf("session code save error: failed to get server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get server public key: " + err.Error()}
-	}
-
-	// Parse server public key
-	serverPubKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(serverPubKeyPEM))
-	if err != nil {
-		log.Printf("session code save error: failed to parse server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse server public key: " + err.Error()}
-	}
-
-	// Decode the signature from base64
-	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
-	if err != nil {
-		log.Printf("session code save error: failed to decode signature: %v", err)
-		return BaseResponse{Success: false, Error: "failed to decode signature: " + err.Error()}
-	}
+func (k *Keeper) HandleSaveSessionCode(req SaveSessionCodeRequest) BaseResponse {
+	k.log.Println("encrypted session code save request processing...")
 
 	// Verify signature using server's public key
-	if err := VerifySignature(serverPubKey, req.EncryptedSessionCode, signatureBytes); err != nil {
-		log.Printf("session code save error: signature verification failed: %v", err)
-		return BaseResponse{Success: false, Error: "signature verification failed: " + err.Error()}
+	if _, err := k.verifyPurposeSignature(req.purpose, req.EncryptedSessionCode, req.Signature, req.ServerScheme, req.Kid, time.Now()); err != nil {
+		k.log.Printf("session code save error: %v", err)
+		return errorResponse(err.Error(), err)
 	}
-	log.Println("signature verification successful")
+	k.log.Println("signature verification successful")
 
 	// Try to promote pending keypair to permanent storage
 	// This is safe for both signup and login-on-another-device flows:
 	// - Signup: pending keypair exists, gets promoted ✅
 	// - Login on another device: no pending keypair, nothing happens ✅
-	promoted, err := promotePendingKeypair()
+	promoted, err := k.promotePendingKeypair()
 	if err != nil {
-		log.Printf("session code save error: failed to promote pending keypair: %v", err)
-		return BaseResponse{Success: false, Error: "failed to promote pending keypair: " + err.Error()}
+		k.log.Printf("session code save error: failed to promote pending keypair: %v", err)
+		return errorResponse("failed to promote pending keypair: "+err.Error(), err)
 	}
 	if promoted {
-		log.Println("pending keypair promoted to permanent storage (signup completed)")
+		k.log.Println("pending keypair promoted to permanent storage (signup completed)")
 	} else {
-		log.Println("no pending keypair found (login on another device flow)")
-	}
-
-	// Get the Helper's private key from keystore (now permanent after promotion)
-	privateKeyPEM, err := getPrivateKey()
-	if err != nil {
-		log.Printf("session code save error: failed to get private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get private key: " + err.Error()}
+		k.log.Println("no pending keypair found (login on another device flow)")
 	}
 
-	// Parse the private key
-	privateKey, err := ParsePrivateKey(privateKeyPEM)
+	// Get the Helper's private key from keystore (now permanent after promotion), checked against its fingerprint
+	privateKey, err := k.loadPrivateKey()
 	if err != nil {
-		log.Printf("session code save error: failed to parse private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse private key: " + err.Error()}
+		k.log.Printf("session code save error: failed to load private key: %v", err)
+		return errorResponse("failed to load private key: "+err.Error(), err)
 	}
 
 	// Decode the encrypted session code from base64
 	encryptedBytes, err := base64.StdEncoding.DecodeString(req.EncryptedSessionCode)
 	if err != nil {
-		log.Printf("session code save error: failed to decode encrypted session code: %v", err)
-		return BaseResponse{Success: false, Error: "failed to decode encrypted session code: " + err.Error()}
+		k.log.Printf("session code save error: failed to decode encrypted session code: %v", err)
+		return errorResponse("failed to decode encrypted session code: "+err.Error(), invalidField("encrypted_session_code", "%v", err))
 	}
 
-	// Decrypt the session code using Helper's private key
-	decryptedBytes, err := DecryptData(privateKey, encryptedBytes)
+	// Decrypt the session code using Helper's private key, either a single block or a hybrid envelope
+	sessionCode, bundle, err := decryptSessionPayload(privateKey, encryptedBytes)
 	if err != nil {
-		log.Printf("session code save error: failed to decrypt session code: %v", err)
-		return BaseResponse{Success: false, Error: "failed to decrypt session code: " + err.Error()}
+		k.log.Printf("session code save error: failed to decrypt session code: %v", err)
+		return errorResponse("failed to decrypt session code: "+err.Error(), err)
 	}
 
-	sessionCode := string(decryptedBytes)
-
 	// Save the decrypted session code
-	if err := saveSessionCode(sessionCode); err != nil {
-		log.Printf("session code save error: %v", err)
-		return BaseResponse{Success: false, Error: "session code save failed: " + err.Error()}
+	if err := k.saveSessionCode(sessionCode); err != nil {
+		k.log.Printf("session code save error: %v", err)
+		return errorResponse("session code save failed: "+err.Error(), err)
 	}
 
-	log.Println("session code decryption and save successful")
-	return BaseResponse{Success: true, Data: SaveSessionCodeResponseData{SessionCode: sessionCode}}
+	k.log.Println("session code decryption and save successful")
+	return BaseResponse{Success: true, Data: SaveSessionCodeResponseData{SessionCode: sessionCode, Bundle: bundle}}
 }
 
 // HandleGetSessionCode handles session code retrieval requests
-func HandleGetSessionCode(req GetSessionCodeRequest) BaseResponse {
-	log.Println("session code retrieval request processing...")
-	sessionCode, err := getSessionCode()
+func (k *Keeper) HandleGetSessionCode(req GetSessionCodeRequest) BaseResponse {
+	k.log.Println("session code retrieval request processing...")
+	sessionCode, err := k.getSessionCode()
 	if err != nil {
-		log.Printf("session code retrieval error: %v", err)
-		return BaseResponse{Success: false, Error: "session code retrieval failed: " + err.Error()}
+		k.log.Printf("session code retrieval error: %v", err)
+		return errorResponse("session code retrieval failed: "+err.Error(), err)
 	}
 	return BaseResponse{Success: true, Data: GetSessionCodeResponseData{SessionCode: sessionCode}}
 }
 
 // HandleGetPublicKey handles public key retrieval requests
-func HandleGetPublicKey(req GetPublicKeyRequest) BaseResponse {
-	log.Println("public key retrieval request processing...")
-	publicKeyPEM, err := getPublicKey()
+func (k *Keeper) HandleGetPublicKey(req GetPublicKeyRequest) BaseResponse {
+	k.log.Println("public key retrieval request processing...")
+	publicKeyPEM, err := k.getPublicKey()
+	if err != nil {
+		k.log.Printf("public key retrieval error: %v", err)
+		return errorResponse("public key retrieval failed: "+err.Error(), err)
+	}
+
+	publicKey, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		k.log.Printf("public key retrieval error: failed to parse public key: %v", err)
+		return errorResponse("failed to parse public key: "+err.Error(), err)
+	}
+	algorithm, _ := KeyAlgorithm(publicKey)
+
+	fingerprint, err := Fingerprint(publicKey)
 	if err != nil {
-		log.Printf("public key retrieval error: %v", err)
-		return BaseResponse{Success: false, Error: "public key retrieval failed: " + err.Error()}
+		k.log.Printf("public key retrieval error: failed to compute fingerprint: %v", err)
+		return errorResponse("public key fingerprint computation failed: "+err.Error(), err)
 	}
-	log.Println("public key retrieval successful")
-	return BaseResponse{Success: true, Data: GetPublicKeyResponseData{PublicKey: publicKeyPEM}}
+
+	// A stored fingerprint that disagrees with the public key is corruption, not something to paper over
+	stored, err := k.getPublicKeyFingerprint()
+	if err == nil && stored != fingerprint {
+		err = errPublicKeyFingerprintMismatch
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		k.log.Printf("public key retrieval error: %v", err)
+		return errorResponse("public key fingerprint check failed: "+err.Error(), err)
+	}
+
+	k.log.Println("public key retrieval successful")
+	return BaseResponse{Success: true, Data: GetPublicKeyResponseData{PublicKey: publicKeyPEM, Fingerprint: fingerprint, Algorithm: algorithm}}
 }
 
 // HandleGetServerPublicKey handles server public key retrieval requests
-func HandleGetServerPublicKey(req GetServerPublicKeyRequest) BaseResponse {
-	log.Println("server public key retrieval request processing...")
-	serverPublicKeyPEM, err := getServerPublicKey()
+func (k *Keeper) HandleGetServerPublicKey(req GetServerPublicKeyRequest) BaseResponse {
+	k.log.Println("server public key retrieval request processing...")
+	set, err := k.loadTrustedServerKeySet()
 	if err != nil {
-		log.Printf("server public key retrieval error: %v", err)
-		return BaseResponse{Success: false, Error: "server public key retrieval failed: " + err.Error()}
+		k.log.Printf("server public key retrieval error: %v", err)
+		return errorResponse("server public key retrieval failed: "+err.Error(), err)
 	}
-	log.Println("server public key retrieval successful")
-	return BaseResponse{Success: true, Data: GetServerPublicKeyResponseData{PublicKey: serverPublicKeyPEM}}
+	active, _ := set.lookup(set.Active)
+	k.log.Println("server public key retrieval successful")
+	return BaseResponse{Success: true, Data: GetServerPublicKeyResponseData{PublicKey: active.PublicKey, Kid: set.Active, Keys: set.trusted(time.Now())}}
+}
+
+// HandleRotateServerKey handles server key rotation requests
+func (k *Keeper) HandleRotateServerKey(req RotateServerKeyRequest) BaseResponse {
+	k.log.Println("server key rotation request processing...")
+	now := time.Now()
+	set, err := k.rotateServerKeys(req.purpose, req.KeySet, req.Signature, req.Kid, req.ServerScheme, now)
+	if err != nil {
+		k.log.Printf("server key rotation error: %v", err)
+		return errorResponse("server key rotation failed: "+err.Error(), err)
+	}
+	k.log.Printf("server key rotation successful, active key: %s", set.Active)
+	return BaseResponse{Success: true, Data: RotateServerKeyResponseData{Active: set.Active, Keys: set.trusted(now)}}
 }
 
 // HandleSignAlias handles alias signing requests (signup flow)
-func HandleSignAlias(req SignAliasRequest) BaseResponse {
-	log.Println("alias signing request processing...")
+func (k *Keeper) HandleSignAlias(req SignAliasRequest) BaseResponse {
+	k.log.Println("alias signing request processing...")
 
-	_, keyErr := getPrivateKey()
-	_, sessionErr := getSessionCode()
+	_, keyErr := k.getPrivateKey()
+	_, sessionErr := k.getSessionCode()
 
 	// keypair + session code already exist
 	if keyErr == nil && sessionErr == nil {
-		log.Println("alias signing error: device already registered and session code exists")
-		return BaseResponse{Success: false, Error: "device already registered. this device has already been registered for signup"}
+		k.log.Println("alias signing error: device already registered and session code exists")
+		return codeResponse(ErrorCodeAlreadyRegistered, "device already registered. this device has already been registered for signup")
 	}
 
-	// keypair exists but session code is missing
+	// keypair exists but session code is missing: a login is waiting for savesessioncode
 	if keyErr == nil && sessionErr != nil {
-		log.Println("alias signing error: orphaned keypair detected without session")
-		return BaseResponse{
-			Success: false,
-			Error:   "keypair exists without session. please contact support or use account recovery",
-		}
+		k.log.Println("alias signing error: login in progress, keypair waiting for its session code")
+		return codeResponse(ErrorCodeAlreadyRegistered, "keypair exists without session. finish the login with savesessioncode")
 	}
 
-	log.Println("generating new keypair for signup...")
-	keyPair, err := GenerateRSAKeyPair()
+	k.log.Println("generating new keypair for signup...")
+	keyPair, err := GenerateKeyPair(req.Algorithm)
 	if err != nil {
-		log.Printf("keypair generation error: %v", err)
-		return BaseResponse{Success: false, Error: "keypair generation failed: " + err.Error()}
+		k.log.Printf("keypair generation error: %v", err)
+		return errorResponse("keypair generation failed: "+err.Error(), err)
 	}
 
 	// Save the new keypair to PENDING storage (not active yet)
 	// This will be promoted to active status upon successful session code save
-	if err := savePendingPrivateKey(keyPair.PrivateKey); err != nil {
-		log.Printf("pending private key save error: %v", err)
-		return BaseResponse{Success: false, Error: "pending private key save failed: " + err.Error()}
+	if err := k.savePendingKeypair(keyPair); err != nil {
+		k.log.Printf("pending keypair save error: %v", err)
+		return errorResponse("pending keypair save failed: "+err.Error(), err)
 	}
+	k.log.Println("pending keypair generated and saved for signup (awaiting confirmation)")
 
-	if err := savePendingPublicKey(keyPair.PublicKey); err != nil {
-		log.Printf("pending public key save error: %v", err)
-		return BaseResponse{Success: false, Error: "pending public key save failed: " + err.Error()}
-	}
-	log.Println("pending keypair generated and saved for signup (awaiting confirmation)")
-
-	// Get the pending private key we just saved
-	privateKeyPEM, err := getPendingPrivateKey()
+	// Get the pending private key we just saved, checked against its fingerprint
+	privateKey, err := k.loadPendingPrivateKey()
 	if err != nil {
-		log.Printf("alias signing error: failed to get pending private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get pending private key: " + err.Error()}
+		k.log.Printf("alias signing error: failed to load pending private key: %v", err)
+		return errorResponse("failed to load pending private key: "+err.Error(), err)
 	}
 
-	// Parse the private key
-	privateKey, err := ParsePrivateKey(privateKeyPEM)
+	// Sign the alias using the pending private key
+	scheme, err := ResolveSignatureScheme(privateKey, req.Scheme)
 	if err != nil {
-		log.Printf("alias signing error: failed to parse private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse private key: " + err.Error()}
+		k.log.Printf("alias signing error: %v", err)
+		return errorResponse(err.Error(), err)
 	}
-
-	// Sign the alias using the pending private key
-	signatureBytes, err := SignData(privateKey, req.Alias)
+	signatureBytes, err := SignDataWithScheme(privateKey, scheme, req.Alias)
 	if err != nil {
-		log.Printf("alias signing error: failed to sign alias: %v", err)
-		return BaseResponse{Success: false, Error: "failed to sign alias: " + err.Error()}
+		k.log.Printf("alias signing error: failed to sign alias: %v", err)
+		return errorResponse("failed to sign alias: "+err.Error(), err)
 	}
 
 	// Encode the signature to base64
 	signatureBase64 := base64.StdEncoding.EncodeToString(signatureBytes)
 
 	// Get the pending public key
-	publicKeyPEM, err := getPendingPublicKey()
+	publicKeyPEM, err := k.getPendingPublicKey()
 	if err != nil {
-		log.Printf("alias signing error: failed to get pending public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get pending public key: " + err.Error()}
+		k.log.Printf("alias signing error: failed to get pending public key: %v", err)
+		return errorResponse("failed to get pending public key: "+err.Error(), err)
 	}
 
-	log.Println("alias signing successful with pending keypair")
-	return BaseResponse{Success: true, Data: SignAliasResponseData{Signature: signatureBase64, PublicKey: publicKeyPEM}}
+	k.log.Println("alias signing successful with pending keypair")
+	return BaseResponse{Success: true, Data: SignAliasResponseData{Signature: signatureBase64, Scheme: scheme, PublicKey: publicKeyPEM, Fingerprint: keyPair.Fingerprint, Algorithm: keyPair.Algorithm}}
 }
 
 // HandleSignAliasWithTimestamp handles alias with timestamp signing requests (login flow)
-func HandleSignAliasWithTimestamp(req SignAliasWithTimestampRequest) BaseResponse {
-	log.Println("alias with timestamp signing request processing...")
+func (k *Keeper) HandleSignAliasWithTimestamp(req SignAliasWithTimestampRequest) BaseResponse {
+	k.log.Println("alias with timestamp signing request processing...")
 
 	// Generate current timestamp
 	timestamp := time.Now().Unix()
 
-	// Get the Helper's private key from keystore (must exist for login)
-	privateKeyPEM, err := getPrivateKey()
-	if err != nil {
-		log.Printf("alias signing error: keypair not found. device not registered: %v", err)
-		return BaseResponse{Success: false, Error: "device not registered. please complete signup first"}
+	// Get the Helper's private key from keystore (must exist for login), checked against its fingerprint
+	privateKey, err := k.loadPrivateKey()
+	if errors.Is(err, ErrNotRegistered) {
+		k.log.Printf("alias signing error: keypair not found. device not registered: %v", err)
+		return codeResponse(ErrorCodeNotRegistered, "device not registered. please complete signup first")
 	}
-
-	// Parse the private key
-	privateKey, err := ParsePrivateKey(privateKeyPEM)
 	if err != nil {
-		log.Printf("alias signing error: failed to parse private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse private key: " + err.Error()}
+		k.log.Printf("alias signing error: failed to load private key: %v", err)
+		return errorResponse("failed to load private key: "+err.Error(), err)
 	}
 
 	// Create payload: Alias + ":" + Timestamp (matching server format)
 	payload := fmt.Sprintf("%s:%d", req.Alias, timestamp)
 
 	// Sign the payload using the Helper's private key
-	signatureBytes, err := SignData(privateKey, payload)
+	scheme, err := ResolveSignatureScheme(privateKey, req.Scheme)
+	if err != nil {
+		k.log.Printf("alias signing error: %v", err)
+		return errorResponse(err.Error(), err)
+	}
+	signatureBytes, err := SignDataWithScheme(privateKey, scheme, payload)
 	if err != nil {
-		log.Printf("alias signing error: failed to sign alias with timestamp: %v", err)
-		return BaseResponse{Success: false, Error: "failed to sign alias with timestamp: " + err.Error()}
+		k.log.Printf("alias signing error: failed to sign alias with timestamp: %v", err)
+		return errorResponse("failed to sign alias with timestamp: "+err.Error(), err)
 	}
 
 	// Encode the signature to base64
 	signatureBase64 := base64.StdEncoding.EncodeToString(signatureBytes)
 
-	log.Println("alias with timestamp signing successful")
-	return BaseResponse{Success: true, Data: SignAliasWithTimestampResponseData{Signature: signatureBase64, Timestamp: timestamp}}
+	k.log.Println("alias with timestamp signing successful")
+	return BaseResponse{Success: true, Data: SignAliasWithTimestampResponseData{Signature: signatureBase64, Scheme: scheme, Timestamp: timestamp}}
 }
 
 // HandleSignChallengeToken handles challenge token signing requests
-func HandleSignChallengeToken(req SignChallengeTokenRequest) BaseResponse {
-	log.Println("challenge token signing request processing...")
+func (k *Keeper) HandleSignChallengeToken(req SignChallengeTokenRequest) BaseResponse {
+	k.log.Println("challenge token signing request processing...")
 
-	// Get server public key for signature verification
-	serverPubKeyPEM, err := getServerPublicKey()
-	if err != nil {
-		log.Printf("challenge token signing error: failed to get server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get server public key: " + err.Error()}
+	// Verify the challenge token: server signature, and for JWT tokens freshness, audience and nonce
+	if err := k.authorizeChallenge(req.purpose, req.ChallengeToken, req.Signature, req.ServerScheme, req.Kid); err != nil {
+		k.log.Printf("challenge token signing error: %v", err)
+		return errorResponse(err.Error(), err)
 	}
+	k.log.Println("server signature verification successful")
 
-	// Parse server public key
-	serverPubKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(serverPubKeyPEM))
+	// Get the Helper's private key from keystore, checked against its fingerprint
+	privateKey, err := k.loadPrivateKey()
 	if err != nil {
-		log.Printf("challenge token signing error: failed to parse server public key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse server public key: " + err.Error()}
+		k.log.Printf("challenge token signing error: failed to load private key: %v", err)
+		return errorResponse("failed to load private key: "+err.Error(), err)
 	}
 
-	// Decode the signature from base64
-	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	// Sign the challenge token using Helper's private key
+	scheme, err := ResolveSignatureScheme(privateKey, req.Scheme)
 	if err != nil {
-		log.Printf("challenge token signing error: failed to decode signature: %v", err)
-		return BaseResponse{Success: false, Error: "failed to decode signature: " + err.Error()}
+		k.log.Printf("challenge token signing error: %v", err)
+		return errorResponse(err.Error(), err)
 	}
-
-	// Verify signature using server's public key
-	if err := VerifySignature(serverPubKey, req.ChallengeToken, signatureBytes); err != nil {
-		log.Printf("challenge token signing error: signature verification failed: %v", err)
-		return BaseResponse{Success: false, Error: "signature verification failed: " + err.Error()}
+	challengeSignatureBytes, err := SignDataWithScheme(privateKey, scheme, req.ChallengeToken)
+	if err != nil {
+		k.log.Printf("challenge token signing error: failed to sign challenge token: %v", err)
+		return errorResponse("failed to sign challenge token: "+err.Error(), err)
 	}
-	log.Println("server signature verification successful")
 
-	// Get the Helper's private key from keystore
-	privateKeyPEM, err := getPrivateKey()
+	// Encode the signature to base64
+	challengeSignatureBase64 := base64.StdEncoding.EncodeToString(challengeSignatureBytes)
+
+	k.log.Println("challenge token signing successful")
+	return BaseResponse{Success: true, Data: SignChallengeTokenResponseData{Signature: challengeSignatureBase64, Scheme: scheme}}
+}
+
+// HandleCheckState handles keystore consistency check requests
+func (k *Keeper) HandleCheckState(req CheckStateRequest) BaseResponse {
+	k.log.Println("keystore state check request processing...")
+	report, err := k.CheckState()
 	if err != nil {
-		log.Printf("challenge token signing error: failed to get private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to get private key: " + err.Error()}
+		k.log.Printf("keystore state check error: %v", err)
+		return errorResponse("keystore state check failed: "+err.Error(), err)
 	}
+	k.log.Printf("keystore state check successful: %s", report.State)
+	return BaseResponse{Success: true, Data: CheckStateResponseData{StateReport: *report}}
+}
 
-	// Parse the private key
-	privateKey, err := ParsePrivateKey(privateKeyPEM)
-	if err != nil {
-		log.Printf("challenge token signing error: failed to parse private key: %v", err)
-		return BaseResponse{Success: false, Error: "failed to parse private key: " + err.Error()}
+// HandleRepairState handles keystore repair requests
+func (k *Keeper) HandleRepairState(req RepairStateRequest) BaseResponse {
+	k.log.Printf("keystore repair request processing: %s", req.Repair)
+	if err := k.Repair(req.Repair); err != nil {
+		k.log.Printf("keystore repair error: %v", err)
+		return errorResponse("keystore repair failed: "+err.Error(), err)
 	}
 
-	// Sign the challenge token using Helper's private key
-	challengeSignatureBytes, err := SignData(privateKey, req.ChallengeToken)
+	report, err := k.CheckState()
 	if err != nil {
-		log.Printf("challenge token signing error: failed to sign challenge token: %v", err)
-		return BaseResponse{Success: false, Error: "failed to sign challenge token: " + err.Error()}
+		k.log.Printf("keystore state check error: %v", err)
+		return errorResponse("keystore state check failed: "+err.Error(), err)
 	}
-
-	// Encode the signature to base64
-	challengeSignatureBase64 := base64.StdEncoding.EncodeToString(challengeSignatureBytes)
-
-	log.Println("challenge token signing successful")
-	return BaseResponse{Success: true, Data: SignChallengeTokenResponseData{Signature: challengeSignatureBase64}}
+	k.log.Printf("keystore repair successful, state: %s", report.State)
+	return BaseResponse{Success: true, Data: RepairStateResponseData{StateReport: *report}}
 }
@@ -0,0 +1,360 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// newTestKeeper returns a keeper backed by an isolated in-memory store,
+// trusting a freshly generated server key in place of the embedded one
+func newTestKeeper(t *testing.T) (*Keeper, *rsa.PrivateKey) {
+	t.Helper()
+
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate server key: %v", err)
+	}
+	serverPubPEM, err := PublicKeyToPEM(&serverKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode server key: %v", err)
+	}
+
+	k := NewKeeper(NewMemoryStore())
+	k.serverKeyAnchor = base64.StdEncoding.EncodeToString([]byte(serverPubPEM))
+	// Most tests authorize with detached signatures; TestStrictChallengesByDefault covers the default
+	k.strictChallenges = false
+	if err := k.saveServerPublicKey(serverPubPEM); err != nil {
+		t.Fatalf("Failed to save server public key: %v", err)
+	}
+	return k, serverKey
+}
+
+func serverSign(t *testing.T, serverKey *rsa.PrivateKey, data string) string {
+	t.Helper()
+
+	hashed := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, serverKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("Failed to sign as server: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestHandleDeviceKeyLifecycle(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	if resp := k.HandleSaveDeviceKey(SaveDeviceKeyRequest{Key: "device-secret"}); !resp.Success {
+		t.Fatalf("Save failed: %s", resp.Error)
+	}
+
+	resp := k.HandleGetDeviceKey(GetDeviceKeyRequest{})
+	if !resp.Success {
+		t.Fatalf("Get failed: %s", resp.Error)
+	}
+	if got := resp.Data.(GetDeviceKeyResponseData).Key; got != "device-secret" {
+		t.Errorf("Device key mismatch.\nGot: %s\nWant: %s", got, "device-secret")
+	}
+
+	if resp := k.HandleDeleteDeviceKey(DeleteDeviceKeyRequest{}); !resp.Success {
+		t.Fatalf("Delete failed: %s", resp.Error)
+	}
+	if resp := k.HandleGetDeviceKey(GetDeviceKeyRequest{}); resp.Success {
+		t.Error("Expected get to fail after delete")
+	}
+}
+
+func TestHandleSignupFlow(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	resp := k.HandleSignAlias(SignAliasRequest{Alias: "alice"})
+	if !resp.Success {
+		t.Fatalf("SignAlias failed: %s", resp.Error)
+	}
+	keeperPubPEM := resp.Data.(SignAliasResponseData).PublicKey
+
+	keeperPub, err := ParsePublicKey(keeperPubPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse keeper public key: %v", err)
+	}
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, keeperPub.(*rsa.PublicKey), []byte("session-123"), nil)
+	if err != nil {
+		t.Fatalf("Failed to encrypt session code: %v", err)
+	}
+	encryptedB64 := base64.StdEncoding.EncodeToString(encrypted)
+
+	resp = k.HandleSaveSessionCode(SaveSessionCodeRequest{
+		EncryptedSessionCode: encryptedB64,
+		Signature:            serverSign(t, serverKey, purposeMessage(ActionSaveSessionCode, encryptedB64)),
+		purpose:              ActionSaveSessionCode,
+	})
+	if !resp.Success {
+		t.Fatalf("SaveSessionCode failed: %s", resp.Error)
+	}
+
+	resp = k.HandleGetSessionCode(GetSessionCodeRequest{})
+	if !resp.Success {
+		t.Fatalf("GetSessionCode failed: %s", resp.Error)
+	}
+	if got := resp.Data.(GetSessionCodeResponseData).SessionCode; got != "session-123" {
+		t.Errorf("Session code mismatch.\nGot: %s\nWant: %s", got, "session-123")
+	}
+
+	resp = k.HandleGetPublicKey(GetPublicKeyRequest{})
+	if !resp.Success || resp.Data.(GetPublicKeyResponseData).PublicKey != keeperPubPEM {
+		t.Errorf("Expected pending keypair to be promoted, got: %+v", resp)
+	}
+
+	if resp := k.HandleSignAlias(SignAliasRequest{Alias: "alice"}); resp.Success {
+		t.Error("Expected SignAlias to refuse an already registered device")
+	}
+}
+
+func TestHandleGetPublicKeyChecksFingerprint(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	keyPair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	if err := k.replaceKeypair(keyPair); err != nil {
+		t.Fatalf("Failed to store keypair: %v", err)
+	}
+
+	resp := k.HandleGetPublicKey(GetPublicKeyRequest{})
+	if !resp.Success || resp.Data.(GetPublicKeyResponseData).Fingerprint != keyPair.Fingerprint {
+		t.Fatalf("Expected the stored fingerprint, got: %+v", resp)
+	}
+
+	other, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	if err := k.store.Set(config.DragPassKeeperPublicKeyFingerprint, other.Fingerprint); err != nil {
+		t.Fatalf("Failed to overwrite fingerprint: %v", err)
+	}
+	if resp := k.HandleGetPublicKey(GetPublicKeyRequest{}); resp.Success || resp.Code != ErrorCodeKeystoreCorrupt {
+		t.Errorf("Expected %s for a mismatched fingerprint, got: %+v", ErrorCodeKeystoreCorrupt, resp)
+	}
+}
+
+func TestHandleGenerateKeypairRejectsBadSignature(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	resp := k.HandleGenerateKeypair(GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "other challenge")),
+		purpose:        ActionGenerateKeypair,
+	})
+	if resp.Success {
+		t.Fatal("Expected keypair generation to fail with a mismatched signature")
+	}
+	if _, err := k.getPrivateKey(); err == nil {
+		t.Error("Expected no keypair to be stored after a rejected request")
+	}
+
+	resp = k.HandleGenerateKeypair(GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "challenge")),
+		purpose:        ActionGenerateKeypair,
+	})
+	if !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+}
+
+func TestSigningRefusesFingerprintMismatch(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	keyPair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	if want, _ := FingerprintPEM(keyPair.PublicKey); keyPair.Fingerprint != want {
+		t.Fatalf("Fingerprint mismatch.\nGot: %s\nWant: %s", keyPair.Fingerprint, want)
+	}
+
+	// Keypairs stored before fingerprints existed get one backfilled on first use
+	_ = k.savePrivateKey(keyPair.PrivateKey)
+	_ = k.savePublicKey(keyPair.PublicKey)
+	if resp := k.HandleSignAliasWithTimestamp(SignAliasWithTimestampRequest{Alias: "alice"}); !resp.Success {
+		t.Fatalf("Signing failed: %s", resp.Error)
+	}
+	if got, _ := k.getPublicKeyFingerprint(); got != keyPair.Fingerprint {
+		t.Errorf("Backfilled fingerprint mismatch.\nGot: %s\nWant: %s", got, keyPair.Fingerprint)
+	}
+
+	// A swapped private key no longer matches the stored fingerprint
+	other, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	_ = k.savePrivateKey(other.PrivateKey)
+	if resp := k.HandleSignAliasWithTimestamp(SignAliasWithTimestampRequest{Alias: "alice"}); resp.Success {
+		t.Error("Expected signing to refuse a private key that does not match the stored fingerprint")
+	}
+}
+
+func TestHandleSignupFlowAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{KeyAlgorithmECDSAP256, KeyAlgorithmEd25519} {
+		t.Run(algorithm, func(t *testing.T) {
+			k, serverKey := newTestKeeper(t)
+
+			resp := k.HandleSignAlias(SignAliasRequest{Alias: "alice", Algorithm: algorithm})
+			if !resp.Success {
+				t.Fatalf("SignAlias failed: %s", resp.Error)
+			}
+			data := resp.Data.(SignAliasResponseData)
+			if data.Algorithm != algorithm {
+				t.Errorf("Algorithm mismatch.\nGot: %s\nWant: %s", data.Algorithm, algorithm)
+			}
+
+			keeperPub, err := ParsePublicKey(data.PublicKey)
+			if err != nil {
+				t.Fatalf("Failed to parse keeper public key: %v", err)
+			}
+			encryptedB64 := base64.StdEncoding.EncodeToString(encryptForKeeper(t, keeperPub, []byte("session-123")))
+
+			resp = k.HandleSaveSessionCode(SaveSessionCodeRequest{
+				EncryptedSessionCode: encryptedB64,
+				Signature:            serverSign(t, serverKey, purposeMessage(ActionSaveSessionCode, encryptedB64)),
+				purpose:              ActionSaveSessionCode,
+			})
+			if !resp.Success {
+				t.Fatalf("SaveSessionCode failed: %s", resp.Error)
+			}
+
+			resp = k.HandleSignAliasWithTimestamp(SignAliasWithTimestampRequest{Alias: "alice"})
+			if !resp.Success {
+				t.Fatalf("SignAliasWithTimestamp failed: %s", resp.Error)
+			}
+			signed := resp.Data.(SignAliasWithTimestampResponseData)
+			signature, _ := base64.StdEncoding.DecodeString(signed.Signature)
+			if !verifyKeeperSignature(t, keeperPub, fmt.Sprintf("alice:%d", signed.Timestamp), signature) {
+				t.Error("Login signature does not verify with the keeper public key")
+			}
+		})
+	}
+}
+
+func TestHandleSignatureSchemes(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	// The server signs PS256 with a salt length equal to the hash, as most JOSE libraries do
+	pssSign := func(data string) string {
+		hashed := sha256.Sum256([]byte(data))
+		pss, err := rsa.SignPSS(rand.Reader, serverKey, crypto.SHA256, hashed[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			t.Fatalf("Failed to sign as server: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(pss)
+	}
+	pssB64 := pssSign(purposeMessage(ActionGenerateKeypair, "challenge"))
+
+	if resp := k.HandleGenerateKeypair(GenerateKeypairRequest{ChallengeToken: "challenge", Signature: pssB64, purpose: ActionGenerateKeypair}); resp.Success {
+		t.Fatal("Expected a PS256 server signature to fail RS256 verification")
+	}
+	resp := k.HandleGenerateKeypair(GenerateKeypairRequest{ChallengeToken: "challenge", Signature: pssB64, ServerScheme: SignatureSchemePS256, purpose: ActionGenerateKeypair})
+	if !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+	keeperPub, _ := ParsePublicKey(resp.Data.(GenerateKeypairResponseData).PublicKey)
+
+	resp = k.HandleSignChallengeToken(SignChallengeTokenRequest{
+		ChallengeToken: "challenge",
+		Signature:      pssSign(purposeMessage(ActionSignChallengeToken, "challenge")),
+		Scheme:         SignatureSchemePS256,
+		ServerScheme:   SignatureSchemePS256,
+		purpose:        ActionSignChallengeToken,
+	})
+	if !resp.Success {
+		t.Fatalf("SignChallengeToken failed: %s", resp.Error)
+	}
+	signed := resp.Data.(SignChallengeTokenResponseData)
+	if signed.Scheme != SignatureSchemePS256 {
+		t.Errorf("Scheme mismatch.\nGot: %s\nWant: %s", signed.Scheme, SignatureSchemePS256)
+	}
+	signature, _ := base64.StdEncoding.DecodeString(signed.Signature)
+	if err := VerifySignatureWithScheme(keeperPub.(*rsa.PublicKey), SignatureSchemePS256, "challenge", signature); err != nil {
+		t.Errorf("Keeper PS256 signature does not verify: %v", err)
+	}
+
+	resp = k.HandleSignAliasWithTimestamp(SignAliasWithTimestampRequest{Alias: "alice"})
+	if !resp.Success {
+		t.Fatalf("SignAliasWithTimestamp failed: %s", resp.Error)
+	}
+	if got := resp.Data.(SignAliasWithTimestampResponseData).Scheme; got != SignatureSchemeRS256 {
+		t.Errorf("Default scheme mismatch.\nGot: %s\nWant: %s", got, SignatureSchemeRS256)
+	}
+
+	if err := (SignAliasRequest{Alias: "alice", Scheme: "HS256"}).Validate(); err == nil {
+		t.Error("Expected an unsupported scheme to be rejected")
+	}
+	if err := (SaveSessionCodeRequest{EncryptedSessionCode: "x", Signature: "y", ServerScheme: SignatureSchemeES256}).Validate(); err == nil {
+		t.Error("Expected an unsupported server scheme to be rejected")
+	}
+}
+
+func TestHandleSaveSessionCodeEnvelope(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	resp := k.HandleSignAlias(SignAliasRequest{Alias: "alice"})
+	if !resp.Success {
+		t.Fatalf("SignAlias failed: %s", resp.Error)
+	}
+	keeperPub, _ := ParsePublicKey(resp.Data.(SignAliasResponseData).PublicKey)
+
+	bundle := `{"session_code":"session-123","expires_at":1700000000}`
+	encryptedB64 := base64.StdEncoding.EncodeToString(sealEnvelope(t, keeperPub, []byte(bundle), nil))
+	resp = k.HandleSaveSessionCode(SaveSessionCodeRequest{
+		EncryptedSessionCode: encryptedB64,
+		Signature:            serverSign(t, serverKey, purposeMessage(ActionSaveSessionCode, encryptedB64)),
+		purpose:              ActionSaveSessionCode,
+	})
+	if !resp.Success {
+		t.Fatalf("SaveSessionCode failed: %s", resp.Error)
+	}
+	data := resp.Data.(SaveSessionCodeResponseData)
+	if data.SessionCode != "session-123" || string(data.Bundle) != bundle {
+		t.Errorf("Response mismatch.\nGot: %s, %s\nWant: session-123, %s", data.SessionCode, data.Bundle, bundle)
+	}
+	if got, _ := k.getSessionCode(); got != "session-123" {
+		t.Errorf("Stored session code mismatch.\nGot: %s\nWant: %s", got, "session-123")
+	}
+}
+
+func TestHandleHello(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	resp := dispatch(t, k, ActionHello, HelloRequest{ProtocolVersions: []int{1, ProtocolVersion, ProtocolVersion + 1}})
+	if !resp.Success {
+		t.Fatalf("Hello failed: %s", resp.Error)
+	}
+	hello := resp.Data.(HelloResponseData)
+	if hello.Protocol != ProtocolVersion {
+		t.Errorf("Negotiated protocol mismatch.\nGot: %d\nWant: %d", hello.Protocol, ProtocolVersion)
+	}
+	if hello.StoreBackend != "memory" {
+		t.Errorf("Store backend mismatch.\nGot: %s\nWant: memory", hello.StoreBackend)
+	}
+
+	// Every advertised action is served by the dispatcher
+	for _, action := range hello.Actions {
+		if resp := dispatch(t, k, action, nil); resp.Code == ErrorCodeUnknownAction {
+			t.Errorf("Advertised action %s is not dispatched", action)
+		}
+	}
+
+	if resp := dispatch(t, k, ActionHello, nil); !resp.Success || resp.Data.(HelloResponseData).Protocol != 1 {
+		t.Errorf("Expected a client without protocol_versions to get protocol 1, got: %+v", resp)
+	}
+	if resp := dispatch(t, k, ActionHello, HelloRequest{ProtocolVersions: []int{MinProtocolVersion - 1}}); resp.Success || resp.Code != ErrorCodeProtocolUnsupported {
+		t.Errorf("Expected %s for a client that is too old, got: %+v", ErrorCodeProtocolUnsupported, resp)
+	}
+}
@@ -0,0 +1,48 @@
+package keystore
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Audit events
+const (
+	// AuditServerKeyTampered is recorded whenever the stored server keys fail the integrity check
+	AuditServerKeyTampered = "server_key_tampered"
+	// AuditServerKeyRestored is recorded when a repair reinstates the embedded server key
+	AuditServerKeyRestored = "server_key_restored"
+	// AuditServerKeyRotated is recorded when a signed key set is accepted
+	AuditServerKeyRotated = "server_key_rotated"
+)
+
+// AuditEvent is a security relevant event, kept apart from the regular request log
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+	// RequestID is the id of the request that caused the event, if it had one
+	RequestID json.RawMessage `json:"request_id,omitempty"`
+	// Origin is the caller the keeper was launched by
+	Origin string `json:"origin,omitempty"`
+}
+
+// AuditSink receives audit events
+type AuditSink func(AuditEvent)
+
+// logAuditEvent writes the event as a single JSON line to the log (stderr)
+func logAuditEvent(event AuditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("audit: %s %s", event.Event, event.Detail)
+		return
+	}
+	log.Printf("audit: %s", data)
+}
+
+func (k *Keeper) audit(event, detail string) {
+	if k.auditSink == nil {
+		return
+	}
+	k.auditSink(AuditEvent{Time: time.Now().UTC(), Event: event, Detail: detail, RequestID: k.requestID, Origin: k.origin})
+}
@@ -0,0 +1,175 @@
+package keystore
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// MaxBatchRequests bounds the number of sub-requests in one batch
+const MaxBatchRequests = 32
+
+// HandleBatch runs the sub-requests in order through the dispatcher and returns a result for each.
+// Atomic batches stop at the first failure and write nothing; otherwise every sub-request runs
+// and keeps its own outcome.
+func (k *Keeper) HandleBatch(req BatchRequest) BaseResponse {
+	k.log.Printf("batch request processing: %d requests, atomic: %t", len(req.Requests), req.Atomic)
+
+	if !req.Atomic {
+		results := make([]BaseResponse, 0, len(req.Requests))
+		for _, sub := range req.Requests {
+			results = append(results, k.dispatchBatched(sub))
+		}
+		return BaseResponse{Success: true, Data: BatchResponseData{Results: results}}
+	}
+
+	// Sub-requests see their own writes, but nothing reaches the store until all of them succeed
+	overlay := newOverlayStore(k.store)
+	bk := *k
+	bk.store = overlay
+
+	results := make([]BaseResponse, 0, len(req.Requests))
+	for i, sub := range req.Requests {
+		resp := bk.dispatchBatched(sub)
+		if resp.Success {
+			results = append(results, resp)
+			continue
+		}
+
+		k.log.Printf("batch error: request %d (%s) failed, discarding the batch: %s", i+1, sub.Action, resp.Error)
+		for j := range results {
+			results[j] = batchAborted(req.Requests[j], "rolled back: request %d in the batch failed", i+1)
+		}
+		results = append(results, resp)
+		for _, skipped := range req.Requests[i+1:] {
+			results = append(results, batchAborted(skipped, "not run: request %d in the batch failed", i+1))
+		}
+		failed := codeResponse(resp.Code, fmt.Sprintf("batch request %d (%s) failed, nothing was saved: %s", i+1, sub.Action, resp.Error))
+		failed.Data = BatchResponseData{Results: results, RolledBack: true}
+		return failed
+	}
+
+	if err := overlay.commit(); err != nil {
+		k.log.Printf("batch error: failed to save batch: %v", err)
+		for j := range results {
+			results[j] = batchAborted(req.Requests[j], "rolled back: the batch could not be saved")
+		}
+		failed := errorResponse("batch save failed: "+err.Error(), err)
+		failed.Data = BatchResponseData{Results: results, RolledBack: true}
+		return failed
+	}
+
+	k.log.Println("batch request successful")
+	return BaseResponse{Success: true, Data: BatchResponseData{Results: results}}
+}
+
+// dispatchBatched dispatches one sub-request under the batch's lock, tagged with its own id
+func (k *Keeper) dispatchBatched(sub BaseRequest) BaseResponse {
+	resp := k.dispatch(sub)
+	resp.ID = sub.ID
+	return resp
+}
+
+func batchAborted(sub BaseRequest, format string, args ...any) BaseResponse {
+	resp := codeResponse(ErrorCodeBatchAborted, fmt.Sprintf(format, args...))
+	resp.ID = sub.ID
+	return resp
+}
+
+// overlayStore buffers writes in memory on top of a base store. Reads see the buffered
+// writes first. commit applies them to the base store in a single transaction.
+type overlayStore struct {
+	base SecretStore
+
+	mu sync.Mutex
+	// changes holds the buffered value of every written item; nil marks a deleted item
+	changes map[string]*string
+}
+
+func newOverlayStore(base SecretStore) *overlayStore {
+	return &overlayStore{base: base, changes: make(map[string]*string)}
+}
+
+func (s *overlayStore) Get(item string) (string, error) {
+	s.mu.Lock()
+	value, changed := s.changes[item]
+	s.mu.Unlock()
+
+	if !changed {
+		return s.base.Get(item)
+	}
+	if value == nil {
+		return "", ErrNotFound
+	}
+	return *value, nil
+}
+
+func (s *overlayStore) Set(item, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes[item] = &value
+	return nil
+}
+
+func (s *overlayStore) Delete(item string) error {
+	if _, err := s.Get(item); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes[item] = nil
+	return nil
+}
+
+func (s *overlayStore) List() ([]string, error) {
+	items, err := s.base.List()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items = slices.DeleteFunc(items, func(item string) bool {
+		_, changed := s.changes[item]
+		return changed
+	})
+	for item, value := range s.changes {
+		if value != nil {
+			items = append(items, item)
+		}
+	}
+	slices.Sort(items)
+	return items, nil
+}
+
+// buffersWrites makes transactions write straight into the overlay; commit saves them in one transaction
+func (s *overlayStore) buffersWrites() {}
+
+func (s *overlayStore) Backend() string {
+	return storeBackend(s.base)
+}
+
+// commit writes every buffered change to the base store in one transaction
+func (s *overlayStore) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.changes) == 0 {
+		return nil
+	}
+
+	tx := newTransaction(s.base)
+	for _, item := range slices.Sorted(maps.Keys(s.changes)) {
+		if value := s.changes[item]; value != nil {
+			tx.Set(item, *value)
+		} else {
+			tx.Delete(item)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,185 @@
+package keystore
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// batchItem builds a batch sub-request
+func batchItem(t *testing.T, id, action string, payload any) BaseRequest {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Failed to marshal payload: %v", err)
+	}
+	return BaseRequest{ID: json.RawMessage(id), Action: action, Payload: data}
+}
+
+func batchResults(t *testing.T, resp BaseResponse) BatchResponseData {
+	t.Helper()
+
+	data, ok := resp.Data.(BatchResponseData)
+	if !ok {
+		t.Fatalf("Expected batch results, got: %+v", resp)
+	}
+	return data
+}
+
+func TestHandleBatch(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	resp := dispatch(t, k, ActionBatch, BatchRequest{Requests: []BaseRequest{
+		batchItem(t, "1", ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "device-secret"}),
+		batchItem(t, "2", ActionGetSessionCode, nil),
+		batchItem(t, "3", ActionGetDeviceKey, nil),
+	}})
+	if !resp.Success {
+		t.Fatalf("Batch failed: %s", resp.Error)
+	}
+
+	results := batchResults(t, resp).Results
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got: %+v", results)
+	}
+	for i, result := range results {
+		if want := string(rune('1' + i)); string(result.ID) != want {
+			t.Errorf("Result %d id mismatch.\nGot: %s\nWant: %s", i, result.ID, want)
+		}
+	}
+	if !results[0].Success || results[1].Code != ErrorCodeNotFound {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+	if data, ok := results[2].Data.(GetDeviceKeyResponseData); !ok || data.Key != "device-secret" {
+		t.Errorf("Expected the batch to read its own write, got: %+v", results[2])
+	}
+}
+
+func TestHandleBatchAtomic(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	resp := dispatch(t, k, ActionBatch, BatchRequest{Atomic: true, Requests: []BaseRequest{
+		batchItem(t, "1", ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "device-secret"}),
+		batchItem(t, "2", ActionGetDeviceKey, nil),
+	}})
+	if !resp.Success {
+		t.Fatalf("Atomic batch failed: %s", resp.Error)
+	}
+	if data, ok := batchResults(t, resp).Results[1].Data.(GetDeviceKeyResponseData); !ok || data.Key != "device-secret" {
+		t.Errorf("Expected the batch to read its own write, got: %+v", resp.Data)
+	}
+	if key, err := k.getDeviceKey(); err != nil || key != "device-secret" {
+		t.Fatalf("Expected the batch to be saved, got %q: %v", key, err)
+	}
+
+	before, _ := k.store.List()
+	resp = dispatch(t, k, ActionBatch, BatchRequest{Atomic: true, Requests: []BaseRequest{
+		batchItem(t, "1", ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "other-secret"}),
+		batchItem(t, "2", ActionDeleteDeviceKey, nil),
+		batchItem(t, "3", ActionGetSessionCode, nil),
+		batchItem(t, "4", ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "never-run"}),
+	}})
+	if resp.Success || resp.Code != ErrorCodeNotFound {
+		t.Fatalf("Expected the batch to fail with %s, got: %+v", ErrorCodeNotFound, resp)
+	}
+
+	data := batchResults(t, resp)
+	if !data.RolledBack {
+		t.Error("Expected the batch to report the rollback")
+	}
+	var codes []string
+	for _, result := range data.Results {
+		codes = append(codes, result.Code)
+	}
+	want := []string{ErrorCodeBatchAborted, ErrorCodeBatchAborted, ErrorCodeNotFound, ErrorCodeBatchAborted}
+	if !slices.Equal(codes, want) {
+		t.Errorf("Result codes mismatch.\nGot: %v\nWant: %v", codes, want)
+	}
+
+	if key, err := k.getDeviceKey(); err != nil || key != "device-secret" {
+		t.Errorf("Failed batch changed the device key to %q: %v", key, err)
+	}
+	if after, _ := k.store.List(); !slices.Equal(before, after) {
+		t.Errorf("Failed batch changed the stored items.\nGot: %v\nWant: %v", after, before)
+	}
+}
+
+// recordingStore records the items written to it
+type recordingStore struct {
+	SecretStore
+	sets, deletes []string
+}
+
+func (s *recordingStore) Set(item, value string) error {
+	s.sets = append(s.sets, item)
+	return s.SecretStore.Set(item, value)
+}
+
+func (s *recordingStore) Delete(item string) error {
+	s.deletes = append(s.deletes, item)
+	return s.SecretStore.Delete(item)
+}
+
+func TestHandleBatchAtomicTransactions(t *testing.T) {
+	k, _ := newTestKeeper(t)
+	store := &recordingStore{SecretStore: k.store}
+	k.store = store
+
+	// signalias saves the pending keypair in a transaction of its own
+	resp := dispatch(t, k, ActionBatch, BatchRequest{Atomic: true, Requests: []BaseRequest{
+		batchItem(t, "1", ActionSignAlias, SignAliasRequest{Alias: "alice"}),
+		batchItem(t, "2", ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "device-secret"}),
+	}})
+	if !resp.Success {
+		t.Fatalf("Atomic batch failed: %s", resp.Error)
+	}
+
+	// Only the batch's own transaction may stage items and write the journal
+	count := func(items []string, item string) int {
+		return len(slices.DeleteFunc(slices.Clone(items), func(i string) bool { return i != item }))
+	}
+	if sets, deletes := count(store.sets, config.TransactionJournal), count(store.deletes, config.TransactionJournal); sets != 1 || deletes != 1 {
+		t.Errorf("Expected one journal write and delete, got %d and %d", sets, deletes)
+	}
+	for _, item := range store.sets {
+		if strings.HasPrefix(item, config.StagedItemPrefix+config.StagedItemPrefix) {
+			t.Errorf("Nested transaction item reached the store: %s", item)
+		}
+	}
+	for _, item := range store.deletes {
+		if strings.HasPrefix(item, config.StagedItemPrefix) && !slices.Contains(store.sets, item) {
+			t.Errorf("Nested transaction item reached the store: %s", item)
+		}
+	}
+
+	report, err := k.CheckState()
+	if err != nil {
+		t.Fatalf("CheckState failed: %v", err)
+	}
+	if report.State != StatePendingSignup || len(report.Issues) != 0 {
+		t.Errorf("Unexpected state after the batch: %+v", report)
+	}
+}
+
+func TestHandleBatchValidation(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	tooMany := make([]BaseRequest, MaxBatchRequests+1)
+	for i := range tooMany {
+		tooMany[i] = batchItem(t, "", ActionPing, nil)
+	}
+	for name, req := range map[string]BatchRequest{
+		"empty":     {},
+		"too many":  {Requests: tooMany},
+		"no action": {Requests: []BaseRequest{{}}},
+		"nested":    {Requests: []BaseRequest{batchItem(t, "", ActionBatch, BatchRequest{})}},
+	} {
+		if resp := dispatch(t, k, ActionBatch, req); resp.Code != ErrorCodeInvalidPayload || resp.Field != "requests" {
+			t.Errorf("%s: expected %s for requests, got: %+v", name, ErrorCodeInvalidPayload, resp)
+		}
+	}
+}
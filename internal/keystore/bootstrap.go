@@ -2,30 +2,82 @@ package keystore
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
+
+	"github.com/personalconnect/dragpass-keeper/config"
 )
 
 const (
 	serverPubKey = "LS0tLS1CRUdJTiBQVUJMSUMgS0VZLS0tLS0KTUlJQklqQU5CZ2txaGtpRzl3MEJBUUVGQUFPQ0FROEFNSUlCQ2dLQ0FRRUF3MG1NZ0FycExYVUhTemJmTGNudAowU1NhTEVhMnhCVms2SXNGTFlOVEl2NzdiZTdYdHhwZzRPd0hDc3JMMzAxV3R0Z2FEWDJBM0pYSnZEQ3FuNXJsCkZGbXNQY2RoeGxwbWdsRjNmODVSMW5KNlB6RW9Dekt1aVVjWE1pc21YSkJteGU2bEpDenZoWXJnbWpKT2xtMkUKY0xJUUpzelFvMUllRml3Mm5wN2c2TzNGSCt2aXRYSkRmV2toakV2RlFGQnd6aFp6cXZUT1o3SDNveUhGZ3RGSwpYeEJwOW5uN2N5L2RmRmVlYkRhSzBmVE1jQ2dEMWxGMjUwZDJMNDdPUmIrbkpEaklObjU4WkZxRVIvTkhWb3dpCnRyanFROU5mWG9rVVFYV2RCWHpjajZDMnNFbGRuR3B5TzFIUzhpYVEvM0RYeXZ2eG9oUWQrWTl3RDJqQnBOajkKYVFJREFRQUIKLS0tLS1FTkQgUFVCTElDIEtFWS0tLS0tCg=="
 )
 
-func EnsureServerPublicKey() error {
-	// Check if the server public key already exists
-	_, err := getServerPublicKey()
-	if err == nil {
+// pinnedServerKeyFingerprints are trusted alongside the embedded server key, so a keeper
+// can accept a key the server has announced ahead of time without a signed rotation
+var pinnedServerKeyFingerprints = []string{}
+
+// anchorServerKey returns the PEM server key this keeper was built to trust
+func (k *Keeper) anchorServerKey() (string, error) {
+	serverPubKeyBytes, err := base64.StdEncoding.DecodeString(k.serverKeyAnchor)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode hardcoded server public key: %v", err)
+	}
+	return string(serverPubKeyBytes), nil
+}
+
+// EnsureServerPublicKey trusts the embedded server key on first run.
+// Keepers that stored a server key before rotation existed get a key set built from it;
+// whether that key can be trusted is up to VerifyServerKey.
+func (k *Keeper) EnsureServerPublicKey() error {
+	// Check if the server key set already exists
+	if _, err := k.store.Get(config.DragPassServerKeySet); err == nil {
 		return nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to get server key set: %v", err)
+	}
+
+	serverPubKeyPEM, err := k.getServerPublicKey()
+	if errors.Is(err, ErrNotFound) {
+		// Decode the hardcoded server public key
+		if serverPubKeyPEM, err = k.anchorServerKey(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get server public key: %v", err)
 	}
 
-	// Decode the hardcoded server public key
-	serverPubKeyBytes, err := base64.StdEncoding.DecodeString(serverPubKey)
+	set, err := newServerKeySet(serverPubKeyPEM)
 	if err != nil {
-		return fmt.Errorf("failed to decode hardcoded server public key: %v", err)
+		return fmt.Errorf("failed to create server key set: %v", err)
 	}
 
 	// Save to keystore
-	if err := saveServerPublicKey(string(serverPubKeyBytes)); err != nil {
+	if err := k.saveServerKeySet(set); err != nil {
 		return fmt.Errorf("failed to save server public key: %v", err)
 	}
 
 	return nil
 }
+
+// Prepare readies the keystore before serving: it finishes interrupted transactions
+// and stores the embedded server key. Problems the extension can fix with repairstate are only logged.
+func (k *Keeper) Prepare() error {
+	if err := k.RecoverTransactions(); err != nil {
+		return fmt.Errorf("failed to recover interrupted keystore transaction: %w", err)
+	}
+
+	if _, err := k.ReconcileState(); err != nil {
+		log.Printf("Warning: Failed to check keystore state: %v", err)
+	}
+
+	if err := k.EnsureServerPublicKey(); err != nil {
+		return fmt.Errorf("failed to ensure server public key: %w", err)
+	}
+
+	// A tampered server key is not fatal, so that repairstate can restore the embedded one
+	if err := k.VerifyServerKey(); err != nil {
+		log.Printf("Warning: Server public key check failed, repair with %q: %v", RepairRestoreServerKey, err)
+	}
+	return nil
+}
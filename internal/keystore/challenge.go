@@ -0,0 +1,171 @@
+package keystore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// Challenge token limits
+const (
+	// maxChallengeLifetime bounds exp - iat, which also bounds how long a nonce must be remembered
+	maxChallengeLifetime = 10 * time.Minute
+	// challengeClockSkew is tolerated between the server and keeper clocks
+	challengeClockSkew = 30 * time.Second
+	// maxChallengeNonces bounds the seen nonce store. Unexpired nonces are never evicted,
+	// so new challenges are refused while the store is full.
+	maxChallengeNonces = 1024
+	// maxChallengeNonceLength keeps a single nonce from bloating the store
+	maxChallengeNonceLength = 128
+)
+
+var (
+	ErrChallengeInvalid  = errors.New("invalid challenge token")
+	ErrChallengeExpired  = errors.New("challenge token expired")
+	ErrChallengeReplayed = errors.New("challenge token nonce already used")
+	ErrChallengeLegacy   = errors.New("legacy challenge tokens are not accepted")
+	// ErrChallengeBusy is retryable: it clears as earlier challenge tokens expire
+	ErrChallengeBusy = errors.New("too many unexpired challenge tokens, retry later")
+)
+
+// ChallengeClaims are the claims of a structured challenge token
+type ChallengeClaims struct {
+	Nonce string `json:"nonce"`
+	// Purpose names the action the token authorizes
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// isChallengeJWT reports whether the challenge token is a compact JWT rather than a legacy raw string
+func isChallengeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// authorizeChallenge accepts a challenge token the server issued to this keeper for purpose.
+// JWT tokens carry their own signature and must be fresh, addressed to this keeper,
+// issued for purpose and unused. Legacy raw tokens are checked against the detached
+// signature only, unless strict challenges are enabled.
+func (k *Keeper) authorizeChallenge(purpose, token, signature, scheme, kid string) error {
+	now := time.Now()
+	if !isChallengeJWT(token) {
+		if k.strictChallenges {
+			return ErrChallengeLegacy
+		}
+		_, err := k.verifyPurposeSignature(purpose, token, signature, scheme, kid, now)
+		return err
+	}
+
+	claims, err := k.verifyChallengeToken(token, now)
+	if err != nil {
+		return err
+	}
+	if err := checkPurposeClaim(purpose, claims.Purpose); err != nil {
+		return err
+	}
+	return k.consumeChallengeNonce(claims.Nonce, claims.ExpiresAt.Time, now)
+}
+
+// verifyChallengeToken checks the JWT signature with the trusted server keys and validates its claims
+func (k *Keeper) verifyChallengeToken(token string, now time.Time) (*ChallengeClaims, error) {
+	claims := &ChallengeClaims{}
+	parsed, parts, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrChallengeInvalid, err)
+	}
+
+	alg, _ := parsed.Header["alg"].(string)
+	if alg != SignatureSchemeRS256 && alg != SignatureSchemePS256 {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrChallengeInvalid, alg)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode signature: %v", ErrChallengeInvalid, err)
+	}
+	if _, err := k.verifyServerSignatureAt(parts[0]+"."+parts[1], base64.StdEncoding.EncodeToString(signature), alg, kid, now); err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == nil || claims.IssuedAt == nil {
+		return nil, fmt.Errorf("%w: exp and iat are required", ErrChallengeInvalid)
+	}
+	if now.After(claims.ExpiresAt.Add(challengeClockSkew)) {
+		return nil, ErrChallengeExpired
+	}
+	if claims.IssuedAt.After(now.Add(challengeClockSkew)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrChallengeInvalid)
+	}
+	if claims.ExpiresAt.Sub(claims.IssuedAt.Time) > maxChallengeLifetime {
+		return nil, fmt.Errorf("%w: lifetime exceeds %s", ErrChallengeInvalid, maxChallengeLifetime)
+	}
+	if claims.NotBefore != nil && claims.NotBefore.After(now.Add(challengeClockSkew)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrChallengeInvalid)
+	}
+	if !claims.VerifyAudience(config.ChallengeAudience, true) {
+		return nil, fmt.Errorf("%w: audience is not %s", ErrChallengeInvalid, config.ChallengeAudience)
+	}
+	if claims.Nonce == "" || len(claims.Nonce) > maxChallengeNonceLength {
+		return nil, fmt.Errorf("%w: nonce must be 1 to %d characters", ErrChallengeInvalid, maxChallengeNonceLength)
+	}
+
+	return claims, nil
+}
+
+type seenNonce struct {
+	Nonce   string `json:"nonce"`
+	Expires int64  `json:"exp"`
+}
+
+// consumeChallengeNonce records the nonce, failing if it was recorded before.
+// Nonces are kept until their token expires, since an expired token is refused anyway.
+// The check and the write hold the store's transaction lock, so two keeper processes
+// cannot both accept the same token.
+func (k *Keeper) consumeChallengeNonce(nonce string, expires, now time.Time) error {
+	unlock, err := lockTransactions(k.store)
+	if err != nil {
+		return fmt.Errorf("failed to lock challenge nonces: %w", err)
+	}
+	defer unlock()
+
+	var seen []seenNonce
+	data, err := k.store.Get(config.ChallengeNonces)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to read challenge nonces: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(data), &seen); err != nil {
+			k.log.Printf("discarding unreadable challenge nonce store: %v", err)
+			seen = nil
+		}
+	}
+
+	kept := seen[:0]
+	for _, entry := range seen {
+		if entry.Nonce == nonce {
+			return ErrChallengeReplayed
+		}
+		if now.Unix() <= entry.Expires+int64(challengeClockSkew/time.Second) {
+			kept = append(kept, entry)
+		}
+	}
+	// Forgetting a nonce before its token expires would let the token be replayed
+	if len(kept) >= maxChallengeNonces {
+		return ErrChallengeBusy
+	}
+	kept = append(kept, seenNonce{Nonce: nonce, Expires: expires.Unix()})
+
+	updated, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	if err := k.store.Set(config.ChallengeNonces, string(updated)); err != nil {
+		return fmt.Errorf("failed to save challenge nonces: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package keystore
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// issueChallenge signs a JWT challenge token the way the server does
+func issueChallenge(t *testing.T, serverKey *rsa.PrivateKey, method jwt.SigningMethod, claims ChallengeClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(method, claims).SignedString(serverKey)
+	if err != nil {
+		t.Fatalf("Failed to sign challenge token: %v", err)
+	}
+	return token
+}
+
+func freshClaims(nonce string) ChallengeClaims {
+	now := time.Now()
+	return ChallengeClaims{
+		Nonce:   nonce,
+		Purpose: ActionGenerateKeypair,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{config.ChallengeAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Minute)),
+		},
+	}
+}
+
+func TestAuthorizeChallenge(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+	otherKey, _ := newServerKey(t)
+
+	token := issueChallenge(t, serverKey, jwt.SigningMethodRS256, freshClaims("nonce-1"))
+	if err := k.authorizeChallenge(ActionGenerateKeypair, token, "", "", ""); err != nil {
+		t.Fatalf("authorizeChallenge failed: %v", err)
+	}
+	if err := k.authorizeChallenge(ActionGenerateKeypair, token, "", "", ""); !errors.Is(err, ErrChallengeReplayed) {
+		t.Errorf("Expected ErrChallengeReplayed, got: %v", err)
+	}
+	if err := k.authorizeChallenge(ActionGenerateKeypair, issueChallenge(t, serverKey, jwt.SigningMethodPS256, freshClaims("nonce-2")), "", "", ""); err != nil {
+		t.Errorf("PS256 challenge failed: %v", err)
+	}
+
+	expired := freshClaims("nonce-3")
+	expired.IssuedAt = jwt.NewNumericDate(time.Now().Add(-5 * time.Minute))
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	wrongAudience := freshClaims("nonce-4")
+	wrongAudience.Audience = jwt.ClaimStrings{"someone-else"}
+	tooLong := freshClaims("nonce-5")
+	tooLong.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	noExpiry := freshClaims("nonce-6")
+	noExpiry.ExpiresAt = nil
+
+	for name, tc := range map[string]struct {
+		token string
+		want  error
+	}{
+		"expired":        {issueChallenge(t, serverKey, jwt.SigningMethodRS256, expired), ErrChallengeExpired},
+		"wrong audience": {issueChallenge(t, serverKey, jwt.SigningMethodRS256, wrongAudience), ErrChallengeInvalid},
+		"too long":       {issueChallenge(t, serverKey, jwt.SigningMethodRS256, tooLong), ErrChallengeInvalid},
+		"no expiry":      {issueChallenge(t, serverKey, jwt.SigningMethodRS256, noExpiry), ErrChallengeInvalid},
+		"no nonce":       {issueChallenge(t, serverKey, jwt.SigningMethodRS256, freshClaims("")), ErrChallengeInvalid},
+		"hmac":           {mustSignHMAC(t, freshClaims("nonce-7")), ErrChallengeInvalid},
+		"untrusted key":  {issueChallenge(t, otherKey, jwt.SigningMethodRS256, freshClaims("nonce-8")), nil},
+	} {
+		err := k.authorizeChallenge(ActionGenerateKeypair, tc.token, "", "", "")
+		if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+			t.Errorf("%s: expected %v, got: %v", name, tc.want, err)
+		}
+	}
+
+	// Legacy tokens are refused in strict mode
+	if err := k.authorizeChallenge(ActionSignChallengeToken, "challenge", serverSign(t, serverKey, "challenge"), "", ""); err != nil {
+		t.Errorf("Legacy challenge failed: %v", err)
+	}
+	k.strictChallenges = true
+	if err := k.authorizeChallenge(ActionSignChallengeToken, "challenge", serverSign(t, serverKey, purposeMessage(ActionSignChallengeToken, "challenge")), "", ""); !errors.Is(err, ErrChallengeLegacy) {
+		t.Errorf("Expected ErrChallengeLegacy, got: %v", err)
+	}
+}
+
+func mustSignHMAC(t *testing.T, claims ChallengeClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign challenge token: %v", err)
+	}
+	return token
+}
+
+func TestHandleGenerateKeypairRejectsReplayedChallenge(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	token := issueChallenge(t, serverKey, jwt.SigningMethodRS256, freshClaims("nonce-1"))
+	if resp := k.HandleGenerateKeypair(GenerateKeypairRequest{ChallengeToken: token, purpose: ActionGenerateKeypair}); !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+	first, _ := k.getPublicKey()
+
+	if resp := k.HandleGenerateKeypair(GenerateKeypairRequest{ChallengeToken: token, purpose: ActionGenerateKeypair}); resp.Success {
+		t.Fatal("Expected a replayed challenge to be rejected")
+	}
+	if got, _ := k.getPublicKey(); got != first {
+		t.Error("Replayed challenge replaced the keypair")
+	}
+
+	claims := freshClaims("nonce-2")
+	claims.Purpose = ActionSignChallengeToken
+	resp := k.HandleSignChallengeToken(SignChallengeTokenRequest{ChallengeToken: issueChallenge(t, serverKey, jwt.SigningMethodRS256, claims), purpose: ActionSignChallengeToken})
+	if !resp.Success {
+		t.Fatalf("SignChallengeToken failed: %s", resp.Error)
+	}
+}
+
+func TestConsumeChallengeNonceBounded(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
+	now := time.Unix(1700000000, 0)
+
+	if err := k.consumeChallengeNonce("old", now.Add(-time.Hour), now.Add(-2*time.Hour)); err != nil {
+		t.Fatalf("consumeChallengeNonce failed: %v", err)
+	}
+	for i := 0; i < maxChallengeNonces; i++ {
+		if err := k.consumeChallengeNonce(fmt.Sprintf("nonce-%d", i), now.Add(time.Duration(i)*time.Second), now); err != nil {
+			t.Fatalf("consumeChallengeNonce failed: %v", err)
+		}
+	}
+
+	data, _ := k.store.Get(config.ChallengeNonces)
+	var seen []seenNonce
+	_ = json.Unmarshal([]byte(data), &seen)
+	if len(seen) != maxChallengeNonces {
+		t.Errorf("Nonce store size mismatch.\nGot: %d\nWant: %d", len(seen), maxChallengeNonces)
+	}
+	for _, entry := range seen {
+		if entry.Nonce == "old" {
+			t.Errorf("Expected the expired nonce to be dropped")
+		}
+	}
+
+	// A full store refuses new tokens rather than forgetting an unexpired nonce
+	if err := k.consumeChallengeNonce("one-too-many", now.Add(time.Hour), now); !errors.Is(err, ErrChallengeBusy) {
+		t.Errorf("Expected ErrChallengeBusy, got: %v", err)
+	}
+	if err := k.consumeChallengeNonce("nonce-0", now.Add(time.Hour), now); !errors.Is(err, ErrChallengeReplayed) {
+		t.Errorf("Expected the soonest to expire nonce to still be refused, got: %v", err)
+	}
+
+	// Once tokens expire there is room again
+	later := now.Add(maxChallengeNonces*time.Second + challengeClockSkew + time.Second)
+	if err := k.consumeChallengeNonce("one-too-many", later.Add(time.Minute), later); err != nil {
+		t.Errorf("Expected room once the stored tokens expired, got: %v", err)
+	}
+}
+
+func TestStrictChallengesByDefault(t *testing.T) {
+	t.Setenv(config.StrictChallengesEnv, "")
+	k, serverKey := newTestKeeper(t)
+	k.strictChallenges = NewKeeper(NewMemoryStore()).strictChallenges
+
+	// A captured legacy token and signature must not regenerate the keypair again and again
+	req := GenerateKeypairRequest{ChallengeToken: "challenge", Signature: serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "challenge"))}
+	for range 3 {
+		if resp := dispatch(t, k, ActionGenerateKeypair, req); resp.Success || resp.Code != ErrorCodeChallengeInvalid {
+			t.Fatalf("Expected a legacy generatekeypair token to be refused, got: %+v", resp)
+		}
+	}
+
+	t.Setenv(config.StrictChallengesEnv, "false")
+	if NewKeeper(NewMemoryStore()).strictChallenges {
+		t.Errorf("Expected %s=false to turn strict mode off", config.StrictChallengesEnv)
+	}
+}
+
+func TestConsumeChallengeNonceAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), config.VaultFile)
+	now := time.Now()
+
+	// Each keeper has its own FileStore on the shared vault, like separate keeper processes
+	const keepers = 6
+	var wg sync.WaitGroup
+	results := make(chan error, keepers)
+	for range keepers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := NewKeeper(NewFileStore(path, []byte("correct horse")))
+			results <- k.consumeChallengeNonce("shared-nonce", now.Add(time.Minute), now)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	accepted := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, ErrChallengeReplayed):
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("Expected exactly one keeper to accept the nonce, %d did", accepted)
+	}
+}
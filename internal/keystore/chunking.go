@@ -0,0 +1,125 @@
+package keystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// MaxOutboundMessageSize is the largest message Chrome accepts from a native host (1MB).
+// Larger responses are split into chunk frames once hello negotiated ChunkingProtocolVersion.
+const MaxOutboundMessageSize = 1024 * 1024
+
+// ChunkSize is the number of message bytes carried by one chunk frame.
+// Base64 and the frame envelope keep each frame well under MaxOutboundMessageSize.
+const ChunkSize = 512 * 1024
+
+// maxPendingTransfers bounds the chunked requests being reassembled at once
+const maxPendingTransfers = 4
+
+// Chunk is one sequenced part of a message too large to send in a single frame.
+// The parts of a transfer are sent in order, seq 0 to total-1, and joined to the original JSON message.
+type Chunk struct {
+	Transfer string `json:"transfer"`
+	Seq      int    `json:"seq"`
+	Total    int    `json:"total"`
+	// Data is base64 encoded in JSON
+	Data []byte `json:"data"`
+}
+
+// chunkFrame is the message carrying a Chunk, told apart from a request or response by its chunk field
+type chunkFrame struct {
+	Chunk *Chunk `json:"chunk"`
+}
+
+// parseChunk returns the chunk carried by msg, or nil when msg is a whole message
+func parseChunk(msg []byte) (*Chunk, error) {
+	var frame chunkFrame
+	if err := json.Unmarshal(msg, &frame); err != nil || frame.Chunk == nil {
+		// Not a chunk frame; HandleRequest reports malformed JSON
+		return nil, nil
+	}
+
+	chunk := frame.Chunk
+	switch {
+	case chunk.Transfer == "":
+		return nil, fmt.Errorf("invalid chunk: transfer is required")
+	case chunk.Total < 1 || chunk.Seq < 0 || chunk.Seq >= chunk.Total:
+		return nil, fmt.Errorf("invalid chunk %d of %d in transfer %s", chunk.Seq, chunk.Total, chunk.Transfer)
+	}
+	return chunk, nil
+}
+
+// splitMessage splits msg into chunk frames of at most ChunkSize message bytes each
+func splitMessage(transfer string, msg []byte) ([][]byte, error) {
+	total := (len(msg) + ChunkSize - 1) / ChunkSize
+	frames := make([][]byte, 0, total)
+	for seq := range total {
+		end := min((seq+1)*ChunkSize, len(msg))
+		frame, err := json.Marshal(chunkFrame{Chunk: &Chunk{
+			Transfer: transfer,
+			Seq:      seq,
+			Total:    total,
+			Data:     msg[seq*ChunkSize : end],
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("chunk serialization error: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// reassembler joins the chunks of incoming transfers. Only the reading goroutine uses it.
+type reassembler struct {
+	transfers map[string]*transfer
+}
+
+type transfer struct {
+	total    int
+	received int
+	data     []byte
+}
+
+// add records chunk and returns the whole message once its last chunk arrived
+func (r *reassembler) add(chunk *Chunk) ([]byte, error) {
+	if r.transfers == nil {
+		r.transfers = make(map[string]*transfer)
+	}
+
+	t, ok := r.transfers[chunk.Transfer]
+	if !ok {
+		if len(r.transfers) >= maxPendingTransfers {
+			return nil, fmt.Errorf("too many chunked messages in flight (max %d)", maxPendingTransfers)
+		}
+		t = &transfer{total: chunk.Total}
+		r.transfers[chunk.Transfer] = t
+	}
+
+	// A broken transfer is dropped; the extension has to resend it under a new transfer id
+	if chunk.Total != t.total || chunk.Seq != t.received {
+		delete(r.transfers, chunk.Transfer)
+		return nil, fmt.Errorf("chunk %d of %d out of sequence in transfer %s, expected chunk %d of %d",
+			chunk.Seq, chunk.Total, chunk.Transfer, t.received, t.total)
+	}
+	if uint64(len(t.data))+uint64(len(chunk.Data)) > uint64(MaxMessageSize) {
+		delete(r.transfers, chunk.Transfer)
+		return nil, fmt.Errorf("chunked message in transfer %s exceeds maximum allowed size %d", chunk.Transfer, MaxMessageSize)
+	}
+
+	t.data = append(t.data, chunk.Data...)
+	t.received++
+	if t.received < t.total {
+		return nil, nil
+	}
+
+	delete(r.transfers, chunk.Transfer)
+	if len(t.data) == 0 {
+		return nil, fmt.Errorf("invalid message: zero length in transfer %s", chunk.Transfer)
+	}
+	return t.data, nil
+}
+
+func transferID(n uint64) string {
+	return "keeper-" + strconv.FormatUint(n, 10)
+}
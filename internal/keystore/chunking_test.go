@@ -0,0 +1,96 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSendResponseChunking(t *testing.T) {
+	big := BaseResponse{ID: json.RawMessage(`7`), Success: true, Data: GetDeviceKeyResponseData{Key: strings.Repeat("k", 3*ChunkSize)}}
+
+	// Without chunking the oversized response turns into an error
+	var out bytes.Buffer
+	msgr := NewMessenger(nil, &out)
+	if err := msgr.SendResponse(big); err != nil {
+		t.Fatalf("SendResponse failed: %v", err)
+	}
+	responses := readResponses(t, &out)
+	if len(responses) != 1 || responses[0].Code != ErrorCodeMessageTooLarge || string(responses[0].ID) != "7" {
+		t.Fatalf("Expected %s for request 7, got: %+v", ErrorCodeMessageTooLarge, responses)
+	}
+
+	// With chunking it is split into frames under the limit, which read back as the response
+	msgr.chunking.Store(true)
+	if err := msgr.SendResponse(big); err != nil {
+		t.Fatalf("SendResponse failed: %v", err)
+	}
+	frames := out.Bytes()
+	for r := bytes.NewReader(frames); r.Len() > 0; {
+		frame, err := NewMessenger(r, nil).readFrame()
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		if len(frame) > MaxOutboundMessageSize {
+			t.Errorf("Frame of %d bytes exceeds the outbound limit", len(frame))
+		}
+	}
+
+	msg, err := NewMessenger(bytes.NewReader(frames), nil).ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to reassemble response: %v", err)
+	}
+	want, _ := json.Marshal(big)
+	if !bytes.Equal(msg, want) {
+		t.Errorf("Reassembled response mismatch: got %d bytes, want %d", len(msg), len(want))
+	}
+}
+
+func TestReadMessageReassemblesChunks(t *testing.T) {
+	request := `{"id":1,"action":"savedevicekey","payload":{"key":"device-secret"}}`
+	chunks, err := splitMessage("ext-1", []byte(request))
+	if err != nil {
+		t.Fatalf("splitMessage failed: %v", err)
+	}
+	half := len(request) / 2
+	first, _ := json.Marshal(chunkFrame{Chunk: &Chunk{Transfer: "ext-2", Seq: 0, Total: 2, Data: []byte(request[:half])}})
+	second, _ := json.Marshal(chunkFrame{Chunk: &Chunk{Transfer: "ext-2", Seq: 1, Total: 2, Data: []byte(request[half:])}})
+	outOfOrder, _ := json.Marshal(chunkFrame{Chunk: &Chunk{Transfer: "ext-3", Seq: 1, Total: 2, Data: []byte("x")}})
+
+	msgr := NewMessenger(frame(
+		string(chunks[0]),
+		string(first),
+		`{"action":"ping"}`,
+		string(second),
+		string(outOfOrder),
+	), nil)
+
+	for _, want := range []string{request, `{"action":"ping"}`, request} {
+		msg, err := msgr.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if string(msg) != want {
+			t.Errorf("Message mismatch.\nGot: %s\nWant: %s", msg, want)
+		}
+	}
+	if _, err := msgr.ReadMessage(); err == nil || !strings.Contains(err.Error(), "out of sequence") {
+		t.Errorf("Expected an out of sequence chunk to be rejected, got: %v", err)
+	}
+	if len(msgr.incoming.transfers) != 0 {
+		t.Errorf("Expected no transfers left pending, got: %v", msgr.incoming.transfers)
+	}
+}
+
+func TestServeNegotiatesChunking(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	for versions, want := range map[string]bool{"[1,2]": false, "[1,2,3]": true} {
+		msgr := NewMessenger(frame(`{"action":"hello","payload":{"protocol_versions":`+versions+`}}`), &bytes.Buffer{})
+		k.Serve(msgr)
+		if got := msgr.chunking.Load(); got != want {
+			t.Errorf("hello with %s: chunking = %t, want %t", versions, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package keystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Client sends requests to a keeper in another process the way the extension does:
+// length-prefixed frames, with chunked responses reassembled.
+// Requests are sent one at a time, so each response answers the last request.
+type Client struct {
+	mu   sync.Mutex
+	msgr *Messenger
+}
+
+// NewClient returns a client reading responses from r and writing requests to w
+func NewClient(r io.Reader, w io.Writer) *Client {
+	return &Client{msgr: NewMessenger(r, w)}
+}
+
+// Hello negotiates the newest protocol, so responses over MaxOutboundMessageSize arrive chunked
+// instead of as MESSAGE_TOO_LARGE errors
+func (c *Client) Hello() (BaseResponse, error) {
+	versions := make([]int, 0, ProtocolVersion-MinProtocolVersion+1)
+	for v := MinProtocolVersion; v <= ProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	payload, _ := json.Marshal(HelloRequest{ProtocolVersions: versions, ClientVersion: "dragpass-keeper " + Version})
+	msg, _ := json.Marshal(BaseRequest{Action: ActionHello, Payload: payload})
+
+	raw, err := c.Call(msg)
+	if err != nil {
+		return BaseResponse{}, err
+	}
+	var resp BaseResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return BaseResponse{}, fmt.Errorf("invalid hello response: %v", err)
+	}
+	return resp, nil
+}
+
+// Call sends the request msg and returns the raw JSON response
+func (c *Client) Call(msg []byte) ([]byte, error) {
+	if uint32(len(msg)) > MaxMessageSize {
+		return nil, fmt.Errorf("request of %d bytes exceeds maximum allowed size %d", len(msg), MaxMessageSize)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.msgr.writeMu.Lock()
+	err := c.msgr.writeFrame(msg)
+	c.msgr.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.msgr.ReadMessage()
+	if err == io.EOF {
+		return nil, fmt.Errorf("keeper closed the connection")
+	}
+	return resp, err
+}
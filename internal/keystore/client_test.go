@@ -0,0 +1,51 @@
+package keystore
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestClientCall(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.Serve(NewMessenger(reqR, respW))
+	}()
+	client := NewClient(respR, reqW)
+
+	hello, err := client.Hello()
+	if err != nil || !hello.Success {
+		t.Fatalf("Hello failed: %+v: %v", hello, err)
+	}
+
+	// A response over the outbound limit arrives chunked and is reassembled
+	key := strings.Repeat("k", 3*ChunkSize)
+	save, _ := json.Marshal(BaseRequest{ID: json.RawMessage(`1`), Action: ActionSaveDeviceKey, Payload: json.RawMessage(`{"key":"` + key + `"}`)})
+	if _, err := client.Call(save); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	raw, err := client.Call([]byte(`{"id":2,"action":"getdevicekey"}`))
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	var resp struct {
+		ID   int                      `json:"id"`
+		Data GetDeviceKeyResponseData `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil || resp.ID != 2 || resp.Data.Key != key {
+		t.Errorf("Unexpected response for request 2 (%v): %d bytes", err, len(raw))
+	}
+
+	reqW.Close()
+	<-done
+	respW.Close()
+	if _, err := client.Call([]byte(`{"action":"ping"}`)); err == nil {
+		t.Errorf("Expected a call after the keeper exited to fail")
+	}
+}
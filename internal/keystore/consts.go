@@ -4,6 +4,9 @@ const (
 	// Health check action
 	ActionPing = "ping"
 
+	// Protocol negotiation and feature detection
+	ActionHello = "hello"
+
 	// Device key related actions
 	ActionGetDeviceKey    = "getdevicekey"
 	ActionSaveDeviceKey   = "savedevicekey"
@@ -24,4 +27,14 @@ const (
 	ActionGenerateKeypair    = "generatekeypair"
 	ActionGetPublicKey       = "getpublickey"
 	ActionGetServerPublicKey = "getserverpubkey"
+
+	// Server key rotation
+	ActionRotateServerKey = "rotateserverkey"
+
+	// Keystore consistency check and repair
+	ActionCheckState  = "checkstate"
+	ActionRepairState = "repairstate"
+
+	// Several requests in one message
+	ActionBatch = "batch"
 )
@@ -0,0 +1,16 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// userDataDir is ~/Library/Application Support
+func userDataDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve home directory: %v", err)
+	}
+	return filepath.Join(home, "Library", "Application Support"), nil
+}
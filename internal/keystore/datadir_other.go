@@ -0,0 +1,18 @@
+//go:build !darwin && !windows
+
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// userDataDir is the XDG default data directory, ~/.local/share
+func userDataDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve home directory: %v", err)
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
@@ -0,0 +1,15 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+)
+
+// userDataDir is %LOCALAPPDATA%
+func userDataDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve local app data directory: %v", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,72 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// StoreBackend names the storage backend behind store, e.g. "keyring" or "file"
+func StoreBackend(store SecretStore) string {
+	return storeBackend(store)
+}
+
+// ProbeStore writes a random probe item to store, reads it back and deletes it,
+// telling whether the backend is usable beyond being reachable
+func ProbeStore(store SecretStore) error {
+	store = availabilityStore{store}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate probe value: %v", err)
+	}
+	value := hex.EncodeToString(nonce)
+
+	if err := store.Set(config.DoctorProbe, value); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	got, err := store.Get(config.DoctorProbe)
+	if err != nil {
+		return fmt.Errorf("read back failed: %w", err)
+	}
+	if err := store.Delete(config.DoctorProbe); err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+	if got != value {
+		return errors.New("read back a different value than was written")
+	}
+	return nil
+}
+
+// ServerKeyInfo describes the server keys the keeper trusts
+type ServerKeyInfo struct {
+	// Active is the kid of the key the server signs with
+	Active string
+	// Embedded reports whether the active key is the server key built into the keeper
+	Embedded bool
+	// Rotations is the number of signed rotations since the embedded key
+	Rotations int
+}
+
+// ServerKeyInfo runs the server key integrity check and describes the trusted keys.
+// It returns ErrNotFound before the server key is first stored.
+func (k *Keeper) ServerKeyInfo() (ServerKeyInfo, error) {
+	set, err := k.checkServerKeyIntegrity()
+	if err != nil {
+		return ServerKeyInfo{}, err
+	}
+
+	anchorPEM, err := k.anchorServerKey()
+	if err != nil {
+		return ServerKeyInfo{}, err
+	}
+	anchorFingerprint, err := FingerprintPEM(anchorPEM)
+	if err != nil {
+		return ServerKeyInfo{}, fmt.Errorf("failed to fingerprint hardcoded server public key: %v", err)
+	}
+
+	return ServerKeyInfo{Active: set.Active, Embedded: set.Active == anchorFingerprint, Rotations: len(set.Rotations)}, nil
+}
@@ -2,58 +2,151 @@ package keystore
 
 import (
 	"encoding/json"
-	"log"
+	"maps"
+	"slices"
+	"time"
 )
 
-// HandleRequest processes incoming requests using the BaseRequest envelope pattern
-func HandleRequest(msg []byte) BaseResponse {
-	var base BaseRequest
-	if err := json.Unmarshal(msg, &base); err != nil {
-		log.Printf("failed to unmarshal base request: %v", err)
-		return BaseResponse{Success: false, Error: "invalid JSON format"}
-	}
+// ActionHandler serves one request. k is the keeper copy serving that request (see forRequest).
+type ActionHandler func(k *Keeper, req BaseRequest) BaseResponse
 
-	log.Printf("received action: %s", base.Action)
+// Middleware wraps every ActionHandler call, e.g. for timing, authorization or rate limiting.
+// It may answer the request itself instead of calling next.
+type Middleware func(next ActionHandler) ActionHandler
 
-	switch base.Action {
-	case ActionPing:
-		return process(base.Payload, HandlePing)
+type registeredAction struct {
+	handler ActionHandler
+	// readOnly actions never write to the store, so they may run alongside each other
+	readOnly bool
+	// schema is the payload schema version, bumped whenever the payload or response changes incompatibly
+	schema int
+}
 
-	case ActionGenerateKeypair:
-		return process(base.Payload, HandleGenerateKeypair)
+// defaultActions registers every action the keeper serves. A new action is a single entry.
+func defaultActions() map[string]registeredAction {
+	return map[string]registeredAction{
+		ActionPing:  {handler: handle((*Keeper).HandlePing), readOnly: true, schema: 1},
+		ActionHello: {handler: handle((*Keeper).HandleHello), readOnly: true, schema: 1},
 
-	case ActionGetDeviceKey:
-		return process(base.Payload, HandleGetDeviceKey)
+		ActionGetDeviceKey:    {handler: handle((*Keeper).HandleGetDeviceKey), readOnly: true, schema: 1},
+		ActionSaveDeviceKey:   {handler: handle((*Keeper).HandleSaveDeviceKey), schema: 1},
+		ActionDeleteDeviceKey: {handler: handle((*Keeper).HandleDeleteDeviceKey), schema: 1},
 
-	case ActionSaveDeviceKey:
-		return process(base.Payload, HandleSaveDeviceKey)
+		ActionGetSessionCode:  {handler: handle((*Keeper).HandleGetSessionCode), readOnly: true, schema: 1},
+		ActionSaveSessionCode: {handler: handle((*Keeper).HandleSaveSessionCode), schema: 1},
 
-	case ActionDeleteDeviceKey:
-		return process(base.Payload, HandleDeleteDeviceKey)
+		ActionSignAlias:              {handler: handle((*Keeper).HandleSignAlias), schema: 1},
+		ActionSignAliasWithTimestamp: {handler: handle((*Keeper).HandleSignAliasWithTimestamp), schema: 1},
+		ActionSignChallengeToken:     {handler: handle((*Keeper).HandleSignChallengeToken), schema: 1},
 
-	case ActionSaveSessionCode:
-		return process(base.Payload, HandleSaveSessionCode)
+		ActionGenerateKeypair:    {handler: handle((*Keeper).HandleGenerateKeypair), schema: 1},
+		ActionGetPublicKey:       {handler: handle((*Keeper).HandleGetPublicKey), readOnly: true, schema: 1},
+		ActionGetServerPublicKey: {handler: handle((*Keeper).HandleGetServerPublicKey), readOnly: true, schema: 1},
+		ActionRotateServerKey:    {handler: handle((*Keeper).HandleRotateServerKey), schema: 1},
 
-	case ActionGetSessionCode:
-		return process(base.Payload, HandleGetSessionCode)
+		ActionCheckState:  {handler: handle((*Keeper).HandleCheckState), schema: 1},
+		ActionRepairState: {handler: handle((*Keeper).HandleRepairState), schema: 1},
+
+		ActionBatch: {handler: handle((*Keeper).HandleBatch), schema: 1},
+	}
+}
 
-	case ActionGetPublicKey:
-		return process(base.Payload, HandleGetPublicKey)
+// handle adapts a typed handler through process: [Unmarshal] -> [Validate] -> [Handler call].
+// Requests carrying a server-signed payload are bound to the dispatched action,
+// which the server signature must name.
+func handle[T any](handler func(*Keeper, T) BaseResponse) ActionHandler {
+	return func(k *Keeper, req BaseRequest) BaseResponse {
+		return process(req.Payload, func(payload T) BaseResponse {
+			if bound, ok := any(&payload).(purposeBound); ok {
+				bound.bindPurpose(req.Action)
+			}
+			return handler(k, payload)
+		})
+	}
+}
 
-	case ActionGetServerPublicKey:
-		return process(base.Payload, HandleGetServerPublicKey)
+// Use appends middleware around every action. The first middleware added is the outermost.
+// Call it before serving requests.
+func (k *Keeper) Use(middleware ...Middleware) {
+	k.middleware = append(k.middleware, middleware...)
+}
 
-	case ActionSignAlias:
-		return process(base.Payload, HandleSignAlias)
+// Actions returns the names of the registered actions, sorted
+func (k *Keeper) Actions() []string {
+	return slices.Sorted(maps.Keys(k.actions))
+}
 
-	case ActionSignAliasWithTimestamp:
-		return process(base.Payload, HandleSignAliasWithTimestamp)
+// payloadSchemas returns the payload schema version of every registered action
+func (k *Keeper) payloadSchemas() map[string]int {
+	schemas := make(map[string]int, len(k.actions))
+	for name, action := range k.actions {
+		schemas[name] = action.schema
+	}
+	return schemas
+}
 
-	case ActionSignChallengeToken:
-		return process(base.Payload, HandleSignChallengeToken)
+// HandleRequest processes incoming requests using the BaseRequest envelope pattern.
+// It is safe to call from several goroutines: requests that write to the store run one at a time.
+// The response carries the request id.
+func (k *Keeper) HandleRequest(msg []byte) BaseResponse {
+	var base BaseRequest
+	if err := json.Unmarshal(msg, &base); err != nil {
+		k.log.Printf("failed to unmarshal base request: %v", err)
+		return codeResponse(ErrorCodeInvalidRequest, "invalid JSON format")
+	}
+
+	resp := k.forRequest(base.ID).dispatch(base)
+	resp.ID = base.ID
+	return resp
+}
+
+// dispatch runs the registered action through the built-in middleware, then the keeper's own
+func (k *Keeper) dispatch(req BaseRequest) BaseResponse {
+	k.log.Printf("received action: %s", req.Action)
+
+	action, ok := k.actions[req.Action]
+	if !ok {
+		k.log.Printf("unknown action: %s", req.Action)
+		return codeResponse(ErrorCodeUnknownAction, "unknown action: "+req.Action)
+	}
+
+	chain := append([]Middleware{timeRequests, serializeWrites(action.readOnly)}, k.middleware...)
+	handler := action.handler
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler(k, req)
+}
+
+// timeRequests logs how long each action took
+func timeRequests(next ActionHandler) ActionHandler {
+	return func(k *Keeper, req BaseRequest) BaseResponse {
+		start := time.Now()
+		resp := next(k, req)
+		k.log.Printf("handled action %s in %s (success: %t)", req.Action, time.Since(start).Round(time.Microsecond), resp.Success)
+		return resp
+	}
+}
 
-	default:
-		log.Printf("unknown action: %s", base.Action)
-		return BaseResponse{Success: false, Error: "unknown action: " + base.Action}
+// serializeWrites runs actions that write to the store one at a time.
+// Actions dispatched by a keeper that already holds the write lock run under that lock.
+func serializeWrites(readOnly bool) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(k *Keeper, req BaseRequest) BaseResponse {
+			if k.locked {
+				return next(k, req)
+			}
+			if readOnly {
+				k.mu.RLock()
+				defer k.mu.RUnlock()
+				return next(k, req)
+			}
+
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			lk := *k
+			lk.locked = true
+			return next(&lk, req)
+		}
 	}
 }
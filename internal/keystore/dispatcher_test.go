@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next ActionHandler) ActionHandler {
+			return func(k *Keeper, req BaseRequest) BaseResponse {
+				calls = append(calls, name+" "+req.Action)
+				return next(k, req)
+			}
+		}
+	}
+	denyDelete := func(next ActionHandler) ActionHandler {
+		return func(k *Keeper, req BaseRequest) BaseResponse {
+			if req.Action == ActionDeleteDeviceKey {
+				return codeResponse(ErrorCodeInvalidRequest, "denied")
+			}
+			return next(k, req)
+		}
+	}
+	k.Use(trace("outer"), trace("inner"), denyDelete)
+
+	if resp := dispatch(t, k, ActionSaveDeviceKey, SaveDeviceKeyRequest{Key: "device-secret"}); !resp.Success {
+		t.Fatalf("SaveDeviceKey failed: %s", resp.Error)
+	}
+	if resp := dispatch(t, k, ActionDeleteDeviceKey, nil); resp.Success || resp.Error != "denied" {
+		t.Errorf("Expected the middleware to deny the request, got: %+v", resp)
+	}
+	if _, err := k.getDeviceKey(); err != nil {
+		t.Errorf("Denied request reached the handler: %v", err)
+	}
+	dispatch(t, k, "nope", nil)
+
+	want := []string{"outer savedevicekey", "inner savedevicekey", "outer deletedevicekey", "inner deletedevicekey"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("Middleware calls mismatch.\nGot: %v\nWant: %v", calls, want)
+	}
+}
+
+func TestRegisteredActions(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	// A new action is a single registration
+	k.actions["echo"] = registeredAction{handler: handle(func(k *Keeper, req SaveDeviceKeyRequest) BaseResponse {
+		return BaseResponse{Success: true, Data: req.Key}
+	}), readOnly: true, schema: 1}
+
+	if resp := dispatch(t, k, "echo", SaveDeviceKeyRequest{Key: "hello"}); !resp.Success || resp.Data != "hello" {
+		t.Errorf("Unexpected echo response: %+v", resp)
+	}
+	if resp := dispatch(t, k, "echo", SaveDeviceKeyRequest{}); resp.Code != ErrorCodeInvalidPayload || resp.Field != "key" {
+		t.Errorf("Expected the payload to be validated, got: %+v", resp)
+	}
+
+	actions := k.Actions()
+	if !slices.IsSorted(actions) || !slices.Contains(actions, "echo") || !slices.Contains(actions, ActionPing) {
+		t.Errorf("Unexpected registered actions: %v", actions)
+	}
+}
@@ -0,0 +1,133 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Envelope versions and content encryption algorithms
+const (
+	EnvelopeVersion1 = 1
+
+	// EnvelopeAlgorithmA256GCM is AES-256-GCM with a 12-byte nonce
+	EnvelopeAlgorithmA256GCM = "A256GCM"
+)
+
+// Envelope is a hybrid encrypted payload for data that does not fit a single
+// keeper key block. The random AES-256-GCM content key is encrypted to the keeper
+// key exactly like legacy single-block data (RSA-OAEP or ECIES, see DecryptData).
+// All binary fields are standard base64.
+type Envelope struct {
+	Version      int    `json:"v"`
+	Algorithm    string `json:"alg"`
+	EncryptedKey string `json:"ek"`
+	IV           string `json:"iv"`
+	Ciphertext   string `json:"ct"`
+	AAD          string `json:"aad,omitempty"`
+}
+
+// SessionBundle is the envelope plaintext the server sends when it has more to
+// deliver than the session code. Fields other than session_code are passed back as is.
+type SessionBundle struct {
+	SessionCode string `json:"session_code"`
+}
+
+// parseEnvelope reports whether data is a JSON envelope rather than a legacy
+// single-block ciphertext. Raw key blocks are random bytes and cannot decode as one.
+func parseEnvelope(data []byte) (*Envelope, bool) {
+	if len(data) == 0 || data[0] != '{' {
+		return nil, false
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Version == 0 {
+		return nil, false
+	}
+	return &env, true
+}
+
+// DecryptEnvelope unwraps the content key with the keeper private key and opens the ciphertext.
+// A malformed envelope fails with ErrDecryptionFailed like a ciphertext that does not open.
+func DecryptEnvelope(privateKey crypto.Signer, env *Envelope) ([]byte, error) {
+	if env.Version != EnvelopeVersion1 {
+		return nil, fmt.Errorf("%w: unsupported envelope version: %d", ErrDecryptionFailed, env.Version)
+	}
+	if env.Algorithm != EnvelopeAlgorithmA256GCM {
+		return nil, fmt.Errorf("%w: unsupported envelope algorithm: %s", ErrDecryptionFailed, env.Algorithm)
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(env.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode envelope key: %v", ErrDecryptionFailed, err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(env.IV)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode envelope iv: %v", ErrDecryptionFailed, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode envelope ciphertext: %v", ErrDecryptionFailed, err)
+	}
+	aad, err := base64.StdEncoding.DecodeString(env.AAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode envelope aad: %v", ErrDecryptionFailed, err)
+	}
+
+	contentKey, err := DecryptData(privateKey, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap envelope key: %w", err)
+	}
+	if len(contentKey) != 32 {
+		return nil, fmt.Errorf("%w: invalid envelope key length: %d", ErrDecryptionFailed, len(contentKey))
+	}
+
+	gcm, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid envelope iv length: %d", ErrDecryptionFailed, len(iv))
+	}
+
+	plaintext, err := gcm.Open(nil, iv, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: envelope authentication failed", ErrDecryptionFailed)
+	}
+	return plaintext, nil
+}
+
+// decryptSessionPayload decrypts an encrypted_session_code in either format and
+// returns the session code, plus the raw bundle when the envelope carried one
+func decryptSessionPayload(privateKey crypto.Signer, data []byte) (string, json.RawMessage, error) {
+	env, ok := parseEnvelope(data)
+	if !ok {
+		// Legacy single-block payload: the plaintext is the session code itself
+		decrypted, err := DecryptData(privateKey, data)
+		if err != nil {
+			return "", nil, err
+		}
+		return string(decrypted), nil, nil
+	}
+
+	plaintext, err := DecryptEnvelope(privateKey, env)
+	if err != nil {
+		return "", nil, err
+	}
+
+	trimmed := bytes.TrimSpace(plaintext)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return string(plaintext), nil, nil
+	}
+
+	var bundle SessionBundle
+	if err := json.Unmarshal(trimmed, &bundle); err != nil {
+		return "", nil, fmt.Errorf("%w: invalid session bundle: %v", ErrDecryptionFailed, err)
+	}
+	if bundle.SessionCode == "" {
+		return "", nil, fmt.Errorf("%w: invalid session bundle: session_code is required", ErrDecryptionFailed)
+	}
+	return bundle.SessionCode, json.RawMessage(trimmed), nil
+}
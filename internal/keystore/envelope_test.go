@@ -0,0 +1,148 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// sealEnvelope builds a hybrid envelope the way the server does
+func sealEnvelope(t *testing.T, publicKey crypto.PublicKey, plaintext, aad []byte) []byte {
+	t.Helper()
+
+	contentKey := make([]byte, 32)
+	iv := make([]byte, 12)
+	_, _ = rand.Read(contentKey)
+	_, _ = rand.Read(iv)
+
+	gcm, err := newGCM(contentKey)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	data, err := json.Marshal(Envelope{
+		Version:      EnvelopeVersion1,
+		Algorithm:    EnvelopeAlgorithmA256GCM,
+		EncryptedKey: base64.StdEncoding.EncodeToString(encryptForKeeper(t, publicKey, contentKey)),
+		IV:           base64.StdEncoding.EncodeToString(iv),
+		Ciphertext:   base64.StdEncoding.EncodeToString(gcm.Seal(nil, iv, plaintext, aad)),
+		AAD:          base64.StdEncoding.EncodeToString(aad),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal envelope: %v", err)
+	}
+	return data
+}
+
+func TestDecryptSessionPayload(t *testing.T) {
+	bundle := `{"session_code":"session-123","device_id":"dev-1","wrapped_keys":["` + strings.Repeat("A", 512) + `"]}`
+
+	for _, algorithm := range SupportedKeyAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			keyPair, err := GenerateKeyPair(algorithm)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair failed: %v", err)
+			}
+			privateKey, _ := ParsePrivateKey(keyPair.PrivateKey)
+			publicKey := privateKey.Public()
+
+			// Legacy single-block payload
+			sessionCode, raw, err := decryptSessionPayload(privateKey, encryptForKeeper(t, publicKey, []byte("session-123")))
+			if err != nil {
+				t.Fatalf("Legacy payload failed: %v", err)
+			}
+			if sessionCode != "session-123" || raw != nil {
+				t.Errorf("Legacy payload mismatch.\nGot: %s, %s\nWant: session-123, <nil>", sessionCode, raw)
+			}
+
+			// Envelope carrying a bundle larger than any single key block
+			sessionCode, raw, err = decryptSessionPayload(privateKey, sealEnvelope(t, publicKey, []byte(bundle), []byte("alice")))
+			if err != nil {
+				t.Fatalf("Envelope payload failed: %v", err)
+			}
+			if sessionCode != "session-123" || string(raw) != bundle {
+				t.Errorf("Envelope payload mismatch.\nGot: %s, %s\nWant: session-123, %s", sessionCode, raw, bundle)
+			}
+
+			// Envelope carrying a bare session code
+			sessionCode, raw, err = decryptSessionPayload(privateKey, sealEnvelope(t, publicKey, []byte("session-456"), nil))
+			if err != nil {
+				t.Fatalf("Envelope payload failed: %v", err)
+			}
+			if sessionCode != "session-456" || raw != nil {
+				t.Errorf("Envelope payload mismatch.\nGot: %s, %s\nWant: session-456, <nil>", sessionCode, raw)
+			}
+		})
+	}
+}
+
+func TestDecryptEnvelopeRejectsTampering(t *testing.T) {
+	keyPair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	privateKey, _ := ParsePrivateKey(keyPair.PrivateKey)
+
+	var env Envelope
+	_ = json.Unmarshal(sealEnvelope(t, privateKey.Public(), []byte("session-123"), []byte("alice")), &env)
+
+	tampered := env
+	tampered.AAD = base64.StdEncoding.EncodeToString([]byte("mallory"))
+	if _, err := DecryptEnvelope(privateKey, &tampered); err == nil {
+		t.Error("Expected a changed AAD to fail authentication")
+	}
+
+	tampered = env
+	tampered.Version = 2
+	if _, err := DecryptEnvelope(privateKey, &tampered); err == nil {
+		t.Error("Expected an unknown envelope version to be rejected")
+	}
+
+	tampered = env
+	tampered.Algorithm = "A128CBC-HS256"
+	if _, err := DecryptEnvelope(privateKey, &tampered); err == nil {
+		t.Error("Expected an unknown envelope algorithm to be rejected")
+	}
+
+	if _, err := DecryptEnvelope(privateKey, &env); err != nil {
+		t.Errorf("DecryptEnvelope failed: %v", err)
+	}
+}
+
+func TestDecryptSessionPayloadMalformed(t *testing.T) {
+	keyPair, err := GenerateKeyPair(KeyAlgorithmECDSAP256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+	privateKey, _ := ParsePrivateKey(keyPair.PrivateKey)
+
+	var env Envelope
+	_ = json.Unmarshal(sealEnvelope(t, privateKey.Public(), []byte("session-123"), nil), &env)
+
+	for name, tamper := range map[string]func(*Envelope){
+		"bad key base64":        func(e *Envelope) { e.EncryptedKey = "not base64!" },
+		"bad iv base64":         func(e *Envelope) { e.IV = "not base64!" },
+		"bad ciphertext base64": func(e *Envelope) { e.Ciphertext = "not base64!" },
+		"truncated key":         func(e *Envelope) { e.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("short")) },
+		"short iv":              func(e *Envelope) { e.IV = base64.StdEncoding.EncodeToString([]byte("short")) },
+		"unknown version":       func(e *Envelope) { e.Version = 2 },
+		"bundle without code": func(e *Envelope) {
+			*e = Envelope{}
+			_ = json.Unmarshal(sealEnvelope(t, privateKey.Public(), []byte(`{"device_id":"dev-1"}`), nil), e)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tampered := env
+			tamper(&tampered)
+			data, _ := json.Marshal(tampered)
+
+			_, _, err := decryptSessionPayload(privateKey, data)
+			if code := errorCode(err); code != ErrorCodeDecryptionFailed {
+				t.Errorf("Expected %s, got %s (%v)", ErrorCodeDecryptionFailed, code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package keystore
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeystoreUnavailable wraps failures of the storage backend itself, as opposed to missing items
+	ErrKeystoreUnavailable = errors.New("keystore unavailable")
+	ErrNotRegistered       = errors.New("device not registered")
+	ErrSignatureInvalid    = errors.New("signature verification failed")
+	ErrDecryptionFailed    = errors.New("failed to decrypt data")
+)
+
+// FieldError is a request validation failure attributed to one payload field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+func requiredField(field string) error {
+	return &FieldError{Field: field, Message: field + " is required"}
+}
+
+func invalidField(field, format string, args ...any) error {
+	return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode classifies err into one of the ErrorCode values. The most specific cause wins.
+func errorCode(err error) string {
+	var fieldErr *FieldError
+	switch {
+	case errors.Is(err, ErrServerKeyTampered):
+		return ErrorCodeServerKeyTampered
+	case errors.As(err, &fieldErr):
+		return ErrorCodeInvalidPayload
+	case errors.Is(err, ErrNotRegistered):
+		return ErrorCodeNotRegistered
+	case errors.Is(err, ErrKeystoreUnavailable):
+		return ErrorCodeKeystoreUnavailable
+	case errors.Is(err, ErrNotFound):
+		return ErrorCodeNotFound
+	case errors.Is(err, ErrChallengeExpired):
+		return ErrorCodeChallengeExpired
+	case errors.Is(err, ErrChallengeReplayed):
+		return ErrorCodeChallengeReplayed
+	case errors.Is(err, ErrChallengeBusy):
+		return ErrorCodeChallengeBusy
+	case errors.Is(err, ErrChallengeInvalid), errors.Is(err, ErrChallengeLegacy), errors.Is(err, ErrPurposeMismatch):
+		return ErrorCodeChallengeInvalid
+	case errors.Is(err, ErrSignatureInvalid), errors.Is(err, rsa.ErrVerification):
+		return ErrorCodeSignatureInvalid
+	case errors.Is(err, ErrDecryptionFailed), errors.Is(err, rsa.ErrDecryption):
+		return ErrorCodeDecryptionFailed
+	case errors.Is(err, errKeypairMismatch), errors.Is(err, errFingerprintMismatch), errors.Is(err, errPublicKeyFingerprintMismatch):
+		return ErrorCodeKeystoreCorrupt
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// errorResponse builds the failure response for err, with its error code and, for
+// validation failures, the offending field
+func errorResponse(message string, err error) BaseResponse {
+	resp := BaseResponse{Success: false, Error: message, Code: errorCode(err)}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		resp.Field = fieldErr.Field
+	}
+	return resp
+}
+
+// codeResponse builds a failure response that is not caused by an error value
+func codeResponse(code, message string) BaseResponse {
+	return BaseResponse{Success: false, Error: message, Code: code}
+}
@@ -0,0 +1,84 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// unavailableStore fails every operation the way a locked keyring does
+type unavailableStore struct{}
+
+var errLocked = errors.New("keyring is locked")
+
+func (unavailableStore) Get(item string) (string, error) { return "", errLocked }
+func (unavailableStore) Set(item, value string) error    { return errLocked }
+func (unavailableStore) Delete(item string) error        { return errLocked }
+func (unavailableStore) List() ([]string, error)         { return nil, errLocked }
+
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("key retrieval failed: %w", ErrNotFound), ErrorCodeNotFound},
+		{fmt.Errorf("%w: %w", ErrNotRegistered, ErrNotFound), ErrorCodeNotRegistered},
+		{markUnavailable(errLocked), ErrorCodeKeystoreUnavailable},
+		{fmt.Errorf("%w: no trusted server key", ErrSignatureInvalid), ErrorCodeSignatureInvalid},
+		{fmt.Errorf("failed to get server public key: %w", ErrServerKeyTampered), ErrorCodeServerKeyTampered},
+		{ErrChallengeExpired, ErrorCodeChallengeExpired},
+		{ErrChallengeReplayed, ErrorCodeChallengeReplayed},
+		{ErrChallengeBusy, ErrorCodeChallengeBusy},
+		{fmt.Errorf("%w: dispatched elsewhere", ErrPurposeMismatch), ErrorCodeChallengeInvalid},
+		{fmt.Errorf("%w: envelope authentication failed", ErrDecryptionFailed), ErrorCodeDecryptionFailed},
+		{errFingerprintMismatch, ErrorCodeKeystoreCorrupt},
+		{errPublicKeyFingerprintMismatch, ErrorCodeKeystoreCorrupt},
+		{requiredField("alias"), ErrorCodeInvalidPayload},
+		{errors.New("something else"), ErrorCodeInternal},
+	} {
+		if got := errorCode(tc.err); got != tc.want {
+			t.Errorf("errorCode(%q) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestHandleRequestErrorCodes(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	for name, tc := range map[string]struct {
+		resp  BaseResponse
+		code  string
+		field string
+	}{
+		"not json":        {k.HandleRequest([]byte("{")), ErrorCodeInvalidRequest, ""},
+		"unknown action":  {dispatch(t, k, "nope", nil), ErrorCodeUnknownAction, ""},
+		"wrong type":      {k.HandleRequest([]byte(`{"action":"signalias","payload":{"alias":1}}`)), ErrorCodeInvalidPayload, "alias"},
+		"missing field":   {dispatch(t, k, ActionSignAlias, SignAliasRequest{}), ErrorCodeInvalidPayload, "alias"},
+		"bad scheme":      {dispatch(t, k, ActionSignAlias, SignAliasRequest{Alias: "alice", Scheme: "HS256"}), ErrorCodeInvalidPayload, "scheme"},
+		"unknown repair":  {dispatch(t, k, ActionRepairState, RepairStateRequest{Repair: "nope"}), ErrorCodeInvalidPayload, "repair"},
+		"not found":       {dispatch(t, k, ActionGetSessionCode, nil), ErrorCodeNotFound, ""},
+		"not registered":  {dispatch(t, k, ActionSignAliasWithTimestamp, SignAliasWithTimestampRequest{Alias: "alice"}), ErrorCodeNotRegistered, ""},
+		"bad signature":   {dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{ChallengeToken: "challenge", Signature: serverSign(t, serverKey, "other")}), ErrorCodeSignatureInvalid, ""},
+		"not base64":      {dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{ChallengeToken: "challenge", Signature: "!"}), ErrorCodeSignatureInvalid, ""},
+		"store is locked": {NewKeeper(unavailableStore{}).HandleRequest([]byte(`{"action":"getdevicekey"}`)), ErrorCodeKeystoreUnavailable, ""},
+	} {
+		if tc.resp.Success || tc.resp.Code != tc.code || tc.resp.Field != tc.field {
+			t.Errorf("%s: expected code %s field %q, got success=%v code=%s field=%q error=%q", name, tc.code, tc.field, tc.resp.Success, tc.resp.Code, tc.resp.Field, tc.resp.Error)
+		}
+	}
+
+	// Signup on a registered device
+	resp := dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "challenge")),
+	})
+	if !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+	if err := k.saveSessionCode("session-123"); err != nil {
+		t.Fatalf("Failed to save session code: %v", err)
+	}
+	if resp := dispatch(t, k, ActionSignAlias, SignAliasRequest{Alias: "alice"}); resp.Code != ErrorCodeAlreadyRegistered {
+		t.Errorf("Expected %s, got code=%s error=%q", ErrorCodeAlreadyRegistered, resp.Code, resp.Error)
+	}
+}
@@ -0,0 +1,36 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFile takes an exclusive lock on path that other processes see, creating the file if needed.
+// The returned function releases it.
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := lockFD(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() {
+		_ = unlockFD(f)
+		f.Close()
+	}, nil
+}
+
+// serviceLockPath is the transaction lock file of a keystore service, next to the file vaults
+func serviceLockPath(service string) (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, service+".lock"), nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package keystore
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lockFD(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX)
+}
+
+func unlockFD(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
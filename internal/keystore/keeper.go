@@ -0,0 +1,86 @@
+package keystore
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// Keeper serves native messaging requests against a SecretStore
+type Keeper struct {
+	store SecretStore
+
+	// serverKeyAnchor is the base64 PEM server key compiled into the binary and
+	// serverKeyPins the fingerprints of further server keys trusted without a rotation.
+	// Every stored server key must lead back to one of them.
+	serverKeyAnchor string
+	serverKeyPins   []string
+
+	// strictChallenges rejects legacy challenge tokens that are not JWTs
+	strictChallenges bool
+
+	auditSink AuditSink
+	// origin is the caller the keeper serves, recorded with every audit event
+	origin string
+
+	// actions maps action names to their handlers, wrapped by middleware on every call
+	actions    map[string]registeredAction
+	middleware []Middleware
+
+	// mu serializes requests that write to the store; read-only requests share it
+	mu *sync.RWMutex
+	// locked is set on the keeper copy that already holds mu for writing, e.g. while serving a batch
+	locked bool
+
+	// requestID and log belong to the request a keeper copy serves, see forRequest
+	requestID json.RawMessage
+	log       *log.Logger
+}
+
+func NewKeeper(store SecretStore) *Keeper {
+	// Legacy challenge tokens can be replayed, so they are only accepted when strict mode is turned off
+	strict := true
+	if value, err := strconv.ParseBool(os.Getenv(config.StrictChallengesEnv)); err == nil {
+		strict = value
+	}
+	return &Keeper{
+		store:            availabilityStore{store},
+		serverKeyAnchor:  serverPubKey,
+		serverKeyPins:    pinnedServerKeyFingerprints,
+		strictChallenges: strict,
+		auditSink:        logAuditEvent,
+		actions:          defaultActions(),
+		mu:               &sync.RWMutex{},
+		log:              log.Default(),
+	}
+}
+
+// forRequest returns a copy of the keeper serving a single request: every log line
+// and audit event it writes carries the request id. The store and lock are shared.
+func (k *Keeper) forRequest(id json.RawMessage) *Keeper {
+	if len(id) == 0 {
+		return k
+	}
+	rk := *k
+	rk.requestID = id
+	rk.log = log.New(log.Writer(), "[id="+string(id)+"] ", log.Flags()|log.Lmsgprefix)
+	return &rk
+}
+
+// SetOrigin records the caller the keeper serves in every audit event.
+// Call it before serving requests.
+func (k *Keeper) SetOrigin(origin Origin) {
+	k.origin = origin.String()
+}
+
+// ForOrigin returns a copy of the keeper serving origin, for a keeper shared by several callers.
+// The store and lock are shared.
+func (k *Keeper) ForOrigin(origin Origin) *Keeper {
+	ck := *k
+	ck.origin = origin.String()
+	return &ck
+}
@@ -2,22 +2,99 @@ package keystore
 
 import (
 	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 )
 
+// Keeper keypair algorithms
+const (
+	KeyAlgorithmRSA2048   = "rsa-2048"
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmEd25519   = "ed25519"
+
+	// DefaultKeyAlgorithm is used when a request does not state an algorithm
+	DefaultKeyAlgorithm = KeyAlgorithmRSA2048
+)
+
+// Signature schemes, named after their JWS "alg" identifiers
+const (
+	// SignatureSchemeRS256 is RSASSA-PKCS1-v1_5 with SHA-256, the default for RSA keys
+	SignatureSchemeRS256 = "RS256"
+	// SignatureSchemePS256 is RSASSA-PSS with SHA-256 and MGF1-SHA-256
+	SignatureSchemePS256 = "PS256"
+	// SignatureSchemeES256 is ECDSA P-256 with SHA-256, r||s encoded
+	SignatureSchemeES256 = "ES256"
+	// SignatureSchemeEdDSA is Ed25519
+	SignatureSchemeEdDSA = "EdDSA"
+)
+
+// SupportedSignatureSchemes lists every scheme the keeper can sign with
+var SupportedSignatureSchemes = []string{SignatureSchemeRS256, SignatureSchemePS256, SignatureSchemeES256, SignatureSchemeEdDSA}
+
+// SupportedServerSignatureSchemes lists the schemes accepted for server signatures
+var SupportedServerSignatureSchemes = []string{SignatureSchemeRS256, SignatureSchemePS256}
+
+// SupportedKeyAlgorithms lists the algorithms GenerateKeyPair accepts
+var SupportedKeyAlgorithms = []string{KeyAlgorithmRSA2048, KeyAlgorithmECDSAP256, KeyAlgorithmEd25519}
+
+// eciesInfo is the HKDF context for session data encrypted to ECDSA and Ed25519 keeper keys
+const eciesInfo = "dragpass-keeper-ecies-v1"
+
 type KeyPair struct {
-	PrivateKey string `json:"private_key"`
-	PublicKey  string `json:"public_key"`
+	Algorithm   string `json:"algorithm"`
+	PrivateKey  string `json:"private_key"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// IsSupportedKeyAlgorithm reports whether algorithm can be passed to GenerateKeyPair
+func IsSupportedKeyAlgorithm(algorithm string) bool {
+	for _, a := range SupportedKeyAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
 }
 
 // GenerateRSAKeyPair generates a new RSA key pair and returns it in PEM format
 func GenerateRSAKeyPair() (*KeyPair, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return GenerateKeyPair(KeyAlgorithmRSA2048)
+}
+
+// GenerateKeyPair generates a new key pair of the given algorithm and returns it in PEM format.
+// An empty algorithm selects DefaultKeyAlgorithm.
+func GenerateKeyPair(algorithm string) (*KeyPair, error) {
+	if algorithm == "" {
+		algorithm = DefaultKeyAlgorithm
+	}
+
+	var privateKey crypto.Signer
+	var err error
+	switch algorithm {
+	case KeyAlgorithmRSA2048:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmECDSAP256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate private key: %v", err)
 	}
@@ -32,11 +109,8 @@ func GenerateRSAKeyPair() (*KeyPair, error) {
 		Bytes: privateKeyDER,
 	})
 
-	// Extract public key from the private key
-	publickey := &privateKey.PublicKey
-
 	// Convert public key to PEM format
-	publickeyDER, err := x509.MarshalPKIXPublicKey(publickey)
+	publickeyDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal public key: %v", err)
 	}
@@ -47,13 +121,33 @@ func GenerateRSAKeyPair() (*KeyPair, error) {
 	})
 
 	return &KeyPair{
-		PrivateKey: string(privateKeyPEM),
-		PublicKey:  string(publicKeyPEM),
+		Algorithm:   algorithm,
+		PrivateKey:  string(privateKeyPEM),
+		PublicKey:   string(publicKeyPEM),
+		Fingerprint: fingerprintDER(publickeyDER),
 	}, nil
 }
 
-// ParsePrivateKey parses a PEM encoded private key
-func ParsePrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
+// KeyAlgorithm returns the keeper algorithm name of a public key.
+// RSA keys are named by their actual size, e.g. rsa-4096 for a larger server key.
+func KeyAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", pub.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported ECDSA curve: %s", pub.Curve.Params().Name)
+		}
+		return KeyAlgorithmECDSAP256, nil
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", publicKey)
+	}
+}
+
+// ParsePrivateKey parses a PEM encoded RSA, ECDSA P-256 or Ed25519 private key
+func ParsePrivateKey(privateKeyPEM string) (crypto.Signer, error) {
 	block, _ := pem.Decode([]byte(privateKeyPEM))
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block")
@@ -64,36 +158,38 @@ func ParsePrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
 		return nil, fmt.Errorf("failed to parse private key: %v", err)
 	}
 
-	privateKey, ok := privateKeyInterface.(*rsa.PrivateKey)
+	privateKey, ok := privateKeyInterface.(crypto.Signer)
 	if !ok {
-		return nil, fmt.Errorf("not an RSA private key")
+		return nil, fmt.Errorf("unsupported private key type: %T", privateKeyInterface)
+	}
+	if _, err := KeyAlgorithm(privateKey.Public()); err != nil {
+		return nil, err
 	}
 
 	return privateKey, nil
 }
 
-// ParsePublicKey parses a PEM encoded public key
-func ParsePublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+// ParsePublicKey parses a PEM encoded RSA, ECDSA P-256 or Ed25519 public key
+func ParsePublicKey(publicKeyPEM string) (crypto.PublicKey, error) {
 	block, _ := pem.Decode([]byte(publicKeyPEM))
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block")
 	}
 
-	publicKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse public key: %v", err)
 	}
 
-	publicKey, ok := publicKeyInterface.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("not an RSA public key")
+	if _, err := KeyAlgorithm(publicKey); err != nil {
+		return nil, err
 	}
 
 	return publicKey, nil
 }
 
 // PublicKeyToPEM converts a public key to PEM format
-func PublicKeyToPEM(publicKey *rsa.PublicKey) (string, error) {
+func PublicKeyToPEM(publicKey crypto.PublicKey) (string, error) {
 	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal public key: %v", err)
@@ -107,27 +203,124 @@ func PublicKeyToPEM(publicKey *rsa.PublicKey) (string, error) {
 	return string(publicKeyPEM), nil
 }
 
+// Fingerprint returns the SHA-256 fingerprint of the public key's SPKI DER encoding,
+// formatted like OpenSSH fingerprints ("SHA256:<unpadded base64>")
+func Fingerprint(publicKey crypto.PublicKey) (string, error) {
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	return fingerprintDER(publicKeyDER), nil
+}
+
+// FingerprintPEM returns the fingerprint of a PEM encoded public key
+func FingerprintPEM(publicKeyPEM string) (string, error) {
+	publicKey, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(publicKey)
+}
+
+func fingerprintDER(publicKeyDER []byte) string {
+	sum := sha256.Sum256(publicKeyDER)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
 // VerifySignature verifies the signature of the challenge token using the server's public key
 func VerifySignature(publicKey *rsa.PublicKey, challengeToken string, signature []byte) error {
-	// Hash the challenge token using SHA-256
-	hashed := sha256.Sum256([]byte(challengeToken))
+	return VerifySignatureWithScheme(publicKey, SignatureSchemeRS256, challengeToken, signature)
+}
+
+// VerifySignatureWithScheme verifies an RS256 or PS256 server signature.
+// An empty scheme is RS256. PS256 accepts any salt length, since server libraries differ in their defaults.
+func VerifySignatureWithScheme(publicKey *rsa.PublicKey, scheme string, data string, signature []byte) error {
+	// Hash the data using SHA-256
+	hashed := sha256.Sum256([]byte(data))
 
-	// Verify the signature
-	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature)
+	var err error
+	switch scheme {
+	case "", SignatureSchemeRS256:
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature)
+	case SignatureSchemePS256:
+		err = rsa.VerifyPSS(publicKey, crypto.SHA256, hashed[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	default:
+		return fmt.Errorf("unsupported server signature scheme: %s", scheme)
+	}
 	if err != nil {
-		return fmt.Errorf("signature verification failed: %v", err)
+		return fmt.Errorf("%w: %w", ErrSignatureInvalid, err)
 	}
 
 	return nil
 }
 
-// SignData signs the given data using the provided private key
-func SignData(privateKey *rsa.PrivateKey, data string) ([]byte, error) {
-	// Hash the data using SHA-256
-	hashed := sha256.Sum256([]byte(data))
+// ResolveSignatureScheme returns the scheme used to sign with privateKey.
+// An empty scheme selects the key's default: RS256, ES256 or EdDSA.
+func ResolveSignatureScheme(privateKey crypto.Signer, scheme string) (string, error) {
+	algorithm, err := KeyAlgorithm(privateKey.Public())
+	if err != nil {
+		return "", err
+	}
+
+	var allowed []string
+	switch privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		allowed = []string{SignatureSchemeRS256, SignatureSchemePS256}
+	case *ecdsa.PublicKey:
+		allowed = []string{SignatureSchemeES256}
+	case ed25519.PublicKey:
+		allowed = []string{SignatureSchemeEdDSA}
+	}
+
+	if scheme == "" {
+		return allowed[0], nil
+	}
+	for _, a := range allowed {
+		if a == scheme {
+			return scheme, nil
+		}
+	}
+	return "", invalidField("scheme", "signature scheme %s cannot be used with a %s key", scheme, algorithm)
+}
+
+// SignData signs the given data using the provided private key with the key's default scheme
+func SignData(privateKey crypto.Signer, data string) ([]byte, error) {
+	return SignDataWithScheme(privateKey, "", data)
+}
+
+// SignDataWithScheme signs the given data using the provided private key.
+// RS256 and PS256 (salt length equal to the hash) sign SHA-256 with an RSA key,
+// ES256 signs SHA-256 and returns the fixed-size r||s encoding used by JWS,
+// EdDSA signs the data itself.
+func SignDataWithScheme(privateKey crypto.Signer, scheme string, data string) ([]byte, error) {
+	scheme, err := ResolveSignatureScheme(privateKey, scheme)
+	if err != nil {
+		return nil, err
+	}
 
-	// Sign the hashed data
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+	var signature []byte
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		// Hash the data using SHA-256
+		hashed := sha256.Sum256([]byte(data))
+		if scheme == SignatureSchemePS256 {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, hashed[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		}
+	case *ecdsa.PrivateKey:
+		hashed := sha256.Sum256([]byte(data))
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, hashed[:]); err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(data))
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", privateKey)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign data: %v", err)
 	}
@@ -135,13 +328,102 @@ func SignData(privateKey *rsa.PrivateKey, data string) ([]byte, error) {
 	return signature, nil
 }
 
-// DecryptData decrypts the given encrypted data using the provided private key
-func DecryptData(privateKey *rsa.PrivateKey, encryptedData []byte) ([]byte, error) {
-	// Decrypt the data using RSA OAEP
-	decryptedData, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedData, nil)
+// DecryptData decrypts the given encrypted data using the provided private key.
+// RSA keys use RSA-OAEP with SHA-256. ECDSA P-256 and Ed25519 keys use ECIES:
+// ephemeral public key || 12-byte nonce || AES-256-GCM ciphertext, keyed with
+// HKDF-SHA256 over the ECDH shared secret. Ed25519 keys take part in ECDH as their
+// X25519 equivalent (the clamped SHA-512 of the seed, as in libsodium).
+func DecryptData(privateKey crypto.Signer, encryptedData []byte) ([]byte, error) {
+	var ecdhKey *ecdh.PrivateKey
+	var err error
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		// Decrypt the data using RSA OAEP
+		decryptedData, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, encryptedData, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+		}
+		return decryptedData, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err = key.ECDH()
+	case ed25519.PrivateKey:
+		h := sha512.Sum512(key.Seed())
+		ecdhKey, err = ecdh.X25519().NewPrivateKey(h[:32])
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", privateKey)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt data: %v", err)
+		return nil, fmt.Errorf("failed to derive ECDH key: %v", err)
 	}
 
+	decryptedData, err := eciesDecrypt(ecdhKey, encryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
 	return decryptedData, nil
 }
+
+func eciesDecrypt(privateKey *ecdh.PrivateKey, encryptedData []byte) ([]byte, error) {
+	ephemeralSize := len(privateKey.PublicKey().Bytes())
+	if len(encryptedData) < ephemeralSize+12 {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	ephemeral, err := privateKey.Curve().NewPublicKey(encryptedData[:ephemeralSize])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral public key: %v", err)
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, shared, nil, eciesInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := encryptedData[ephemeralSize : ephemeralSize+gcm.NonceSize()]
+	return gcm.Open(nil, nonce, encryptedData[ephemeralSize+gcm.NonceSize():], nil)
+}
+
+var (
+	errKeypairMismatch     = errors.New("public key does not match private key")
+	errFingerprintMismatch = errors.New("private key does not match the stored public key fingerprint")
+	// errPublicKeyFingerprintMismatch means the stored fingerprint is not the one of the stored public key
+	errPublicKeyFingerprintMismatch = errors.New("stored fingerprint does not match the public key")
+)
+
+// checkKeypairMatches reports whether the PEM encoded public key belongs to the private key
+func checkKeypairMatches(privateKeyPEM, publicKeyPEM string) error {
+	privateKey, err := ParsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return err
+	}
+	publicKey, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	derived, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !derived.Equal(publicKey) {
+		return errKeypairMismatch
+	}
+	return nil
+}
+
+// checkPrivateKeyFingerprint verifies that the public key derived from privateKey has the given fingerprint
+func checkPrivateKeyFingerprint(privateKey crypto.Signer, fingerprint string) error {
+	derived, err := Fingerprint(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(derived), []byte(fingerprint)) != 1 {
+		return errFingerprintMismatch
+	}
+	return nil
+}
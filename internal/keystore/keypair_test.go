@@ -0,0 +1,195 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// encryptForKeeper encrypts data the way the server does for each keeper key algorithm
+func encryptForKeeper(t *testing.T, publicKey crypto.PublicKey, data []byte) []byte {
+	t.Helper()
+
+	var recipient *ecdh.PublicKey
+	var err error
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data, nil)
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		return encrypted
+	case *ecdsa.PublicKey:
+		recipient, err = pub.ECDH()
+	case ed25519.PublicKey:
+		recipient, err = ed25519ToX25519(pub)
+	}
+	if err != nil {
+		t.Fatalf("Failed to convert recipient key: %v", err)
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ephemeral key: %v", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		t.Fatalf("ECDH failed: %v", err)
+	}
+	key, err := hkdf.Key(sha256.New, shared, nil, eciesInfo, 32)
+	if err != nil {
+		t.Fatalf("HKDF failed: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, _ = rand.Read(nonce)
+
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return gcm.Seal(out, nonce, data, nil)
+}
+
+// ed25519ToX25519 maps an Edwards public key to its Montgomery form: u = (1 + y) / (1 - y) mod p
+func ed25519ToX25519(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	for i, j := 0, 31; i < j; i, j = i+1, j-1 {
+		le[i], le[j] = le[j], le[i]
+	}
+	y := new(big.Int).SetBytes(le)
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	u := new(big.Int).Mul(num, new(big.Int).ModInverse(den, p))
+	u.Mod(u, p)
+
+	out := u.FillBytes(make([]byte, 32))
+	for i, j := 0, 31; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
+
+func verifyKeeperSignature(t *testing.T, publicKey crypto.PublicKey, data string, signature []byte) bool {
+	t.Helper()
+
+	hashed := sha256.Sum256([]byte(data))
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, hashed[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, []byte(data), signature)
+	}
+	return false
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	for _, algorithm := range SupportedKeyAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			keyPair, err := GenerateKeyPair(algorithm)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair failed: %v", err)
+			}
+			if keyPair.Algorithm != algorithm {
+				t.Errorf("Algorithm mismatch.\nGot: %s\nWant: %s", keyPair.Algorithm, algorithm)
+			}
+
+			privateKey, err := ParsePrivateKey(keyPair.PrivateKey)
+			if err != nil {
+				t.Fatalf("ParsePrivateKey failed: %v", err)
+			}
+			publicKey, err := ParsePublicKey(keyPair.PublicKey)
+			if err != nil {
+				t.Fatalf("ParsePublicKey failed: %v", err)
+			}
+			if got, _ := KeyAlgorithm(publicKey); got != algorithm {
+				t.Errorf("KeyAlgorithm mismatch.\nGot: %s\nWant: %s", got, algorithm)
+			}
+			if err := checkKeypairMatches(keyPair.PrivateKey, keyPair.PublicKey); err != nil {
+				t.Errorf("Generated keypair does not match: %v", err)
+			}
+
+			signature, err := SignData(privateKey, "alias:1700000000")
+			if err != nil {
+				t.Fatalf("SignData failed: %v", err)
+			}
+			if !verifyKeeperSignature(t, publicKey, "alias:1700000000", signature) {
+				t.Error("Signature does not verify with the public key")
+			}
+
+			decrypted, err := DecryptData(privateKey, encryptForKeeper(t, publicKey, []byte("session-code")))
+			if err != nil {
+				t.Fatalf("DecryptData failed: %v", err)
+			}
+			if string(decrypted) != "session-code" {
+				t.Errorf("Decrypted data mismatch.\nGot: %s\nWant: %s", decrypted, "session-code")
+			}
+		})
+	}
+
+	if _, err := GenerateKeyPair("dsa-1024"); err == nil {
+		t.Error("Expected an unsupported algorithm to be rejected")
+	}
+
+	// RSA keys the keeper did not generate, like server keys, are named by their actual size
+	large := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 4095), E: 65537}
+	if got, err := KeyAlgorithm(large); err != nil || got != "rsa-4096" {
+		t.Errorf("KeyAlgorithm mismatch.\nGot: %s (%v)\nWant: rsa-4096", got, err)
+	}
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	keyPair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	privateKey, _ := ParsePrivateKey(keyPair.PrivateKey)
+	publicKey := privateKey.Public().(*rsa.PublicKey)
+
+	if scheme, _ := ResolveSignatureScheme(privateKey, ""); scheme != SignatureSchemeRS256 {
+		t.Errorf("Default RSA scheme mismatch.\nGot: %s\nWant: %s", scheme, SignatureSchemeRS256)
+	}
+
+	signature, err := SignDataWithScheme(privateKey, SignatureSchemePS256, "challenge")
+	if err != nil {
+		t.Fatalf("SignDataWithScheme failed: %v", err)
+	}
+	if err := VerifySignatureWithScheme(publicKey, SignatureSchemePS256, "challenge", signature); err != nil {
+		t.Errorf("PS256 signature does not verify: %v", err)
+	}
+	if err := VerifySignatureWithScheme(publicKey, SignatureSchemeRS256, "challenge", signature); err == nil {
+		t.Error("Expected a PS256 signature to fail RS256 verification")
+	}
+
+	ecKeyPair, err := GenerateKeyPair(KeyAlgorithmECDSAP256)
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	ecPrivateKey, _ := ParsePrivateKey(ecKeyPair.PrivateKey)
+	if _, err := SignDataWithScheme(ecPrivateKey, SignatureSchemePS256, "challenge"); err == nil {
+		t.Error("Expected PS256 to be rejected for an ECDSA key")
+	}
+	if scheme, _ := ResolveSignatureScheme(ecPrivateKey, ""); scheme != SignatureSchemeES256 {
+		t.Errorf("Default ECDSA scheme mismatch.\nGot: %s\nWant: %s", scheme, SignatureSchemeES256)
+	}
+}
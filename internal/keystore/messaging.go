@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
 )
 
 // MaxMessageSize defines the maximum allowed message size (10MB)
@@ -15,6 +17,14 @@ const MaxMessageSize uint32 = 10 * 1024 * 1024 // 10MB
 type Messenger struct {
 	in  io.Reader
 	out io.Writer
+
+	// writeMu keeps responses sent from concurrent requests from interleaving
+	writeMu sync.Mutex
+
+	// chunking is set once hello negotiates ChunkingProtocolVersion, see SendResponse
+	chunking  atomic.Bool
+	transfers atomic.Uint64
+	incoming  reassembler
 }
 
 func NewMessenger(in io.Reader, out io.Writer) *Messenger {
@@ -24,8 +34,30 @@ func NewMessenger(in io.Reader, out io.Writer) *Messenger {
 	}
 }
 
-// ReadMessage reads a length-prefixed message from the input
+// ReadMessage reads a length-prefixed message from the input.
+// Chunk frames are reassembled; the message is returned once its last chunk arrived.
 func (m *Messenger) ReadMessage() ([]byte, error) {
+	for {
+		msg, err := m.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		chunk, err := parseChunk(msg)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return msg, nil
+		}
+		if msg, err = m.incoming.add(chunk); err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+// readFrame reads a single length-prefixed frame from the input
+func (m *Messenger) readFrame() ([]byte, error) {
 	var length uint32
 
 	if err := binary.Read(m.in, binary.LittleEndian, &length); err != nil {
@@ -51,21 +83,49 @@ func (m *Messenger) ReadMessage() ([]byte, error) {
 	return msgBody, nil
 }
 
+// SendResponse writes resp as a length-prefixed message. Responses over MaxOutboundMessageSize
+// are sent as chunk frames when chunking was negotiated, and replaced by a MESSAGE_TOO_LARGE error otherwise.
 func (m *Messenger) SendResponse(resp BaseResponse) error {
 	respBytes, err := json.Marshal(resp)
 	if err != nil {
 		return fmt.Errorf("response serialization error: %v", err)
 	}
 
+	frames := [][]byte{respBytes}
+	if len(respBytes) > MaxOutboundMessageSize {
+		if !m.chunking.Load() {
+			log.Printf("response of %d bytes exceeds the outbound limit and chunking was not negotiated", len(respBytes))
+			tooLarge := codeResponse(ErrorCodeMessageTooLarge, fmt.Sprintf("response of %d bytes exceeds the %d byte native messaging limit. negotiate protocol %d with hello to receive chunked responses", len(respBytes), MaxOutboundMessageSize, ChunkingProtocolVersion))
+			tooLarge.ID = resp.ID
+			return m.SendResponse(tooLarge)
+		}
+		if frames, err = splitMessage(transferID(m.transfers.Add(1)), respBytes); err != nil {
+			return err
+		}
+	}
+
 	logSafeResponse(resp)
 
+	// The frames of a chunked response are written back to back
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	for _, frame := range frames {
+		if err := m.writeFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Messenger) writeFrame(frame []byte) error {
 	// Write response length
-	if err := binary.Write(m.out, binary.LittleEndian, uint32(len(respBytes))); err != nil {
+	if err := binary.Write(m.out, binary.LittleEndian, uint32(len(frame))); err != nil {
 		return fmt.Errorf("failed to write response length: %w", err)
 	}
 
 	// Write body
-	if _, err := m.out.Write(respBytes); err != nil {
+	if _, err := m.out.Write(frame); err != nil {
 		return fmt.Errorf("failed to write response body: %w", err)
 	}
 
@@ -74,8 +134,11 @@ func (m *Messenger) SendResponse(resp BaseResponse) error {
 
 func logSafeResponse(resp BaseResponse) {
 	safeResp := BaseResponse{
+		ID:      resp.ID,
 		Success: resp.Success,
 		Error:   resp.Error,
+		Code:    resp.Code,
+		Field:   resp.Field,
 		Data:    "[DATA_MASKED]",
 	}
 
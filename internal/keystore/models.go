@@ -2,15 +2,26 @@ package keystore
 
 import (
 	"encoding/json"
-	"errors"
+	"slices"
+	"strings"
 )
 
 type BaseRequest struct {
+	// ID is optional and echoed in the response, so responses can be matched to requests
+	// answered out of order. Any JSON string or number.
+	ID      json.RawMessage `json:"id,omitempty"`
 	Action  string          `json:"action"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 type PingRequest struct{}
+
+type HelloRequest struct {
+	// ProtocolVersions lists the protocol versions the client speaks. Empty means version 1.
+	ProtocolVersions []int `json:"protocol_versions,omitempty"`
+	// ClientVersion is informational, e.g. the extension version
+	ClientVersion string `json:"client_version,omitempty"`
+}
 type GetDeviceKeyRequest struct{}
 type DeleteDeviceKeyRequest struct{}
 type GetSessionCodeRequest struct{}
@@ -22,16 +33,27 @@ type DeleteDeviceKeyResponseData struct{}
 type GenerateKeypairRequest struct {
 	ChallengeToken string `json:"challenge_token"`
 	Signature      string `json:"signature"`
+	Algorithm      string `json:"algorithm,omitempty"`
+	ServerScheme   string `json:"server_scheme,omitempty"`
+	Kid            string `json:"kid,omitempty"`
+
+	purpose string
 }
 
+func (r *GenerateKeypairRequest) bindPurpose(action string) { r.purpose = action }
+
 func (r GenerateKeypairRequest) Validate() error {
 	if r.ChallengeToken == "" {
-		return errors.New("challenge_token is required")
+		return requiredField("challenge_token")
 	}
-	if r.Signature == "" {
-		return errors.New("signature is required")
+	// JWT challenge tokens carry their own signature
+	if r.Signature == "" && !isChallengeJWT(r.ChallengeToken) {
+		return requiredField("signature")
 	}
-	return nil
+	if err := validateServerScheme(r.ServerScheme); err != nil {
+		return err
+	}
+	return validateKeyAlgorithm(r.Algorithm)
 }
 
 type SaveDeviceKeyRequest struct {
@@ -40,7 +62,7 @@ type SaveDeviceKeyRequest struct {
 
 func (r SaveDeviceKeyRequest) Validate() error {
 	if r.Key == "" {
-		return errors.New("key is required")
+		return requiredField("key")
 	}
 	return nil
 }
@@ -48,59 +70,215 @@ func (r SaveDeviceKeyRequest) Validate() error {
 type SaveSessionCodeRequest struct {
 	EncryptedSessionCode string `json:"encrypted_session_code"`
 	Signature            string `json:"signature"`
+	ServerScheme         string `json:"server_scheme,omitempty"`
+	Kid                  string `json:"kid,omitempty"`
+
+	purpose string
 }
 
+func (r *SaveSessionCodeRequest) bindPurpose(action string) { r.purpose = action }
+
 func (r SaveSessionCodeRequest) Validate() error {
 	if r.EncryptedSessionCode == "" {
-		return errors.New("encrypted_session_code is required")
+		return requiredField("encrypted_session_code")
 	}
 	if r.Signature == "" {
-		return errors.New("signature is required")
+		return requiredField("signature")
 	}
-	return nil
+	return validateServerScheme(r.ServerScheme)
 }
 
 type SignAliasRequest struct {
-	Alias string `json:"alias"`
+	Alias     string `json:"alias"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Scheme    string `json:"scheme,omitempty"`
 }
 
 func (r SignAliasRequest) Validate() error {
 	if r.Alias == "" {
-		return errors.New("alias is required")
+		return requiredField("alias")
 	}
-	return nil
+	if err := validateSignatureScheme(r.Scheme); err != nil {
+		return err
+	}
+	return validateKeyAlgorithm(r.Algorithm)
 }
 
 type SignAliasWithTimestampRequest struct {
-	Alias string `json:"alias"`
+	Alias  string `json:"alias"`
+	Scheme string `json:"scheme,omitempty"`
 }
 
 func (r SignAliasWithTimestampRequest) Validate() error {
 	if r.Alias == "" {
-		return errors.New("alias is required")
+		return requiredField("alias")
 	}
-	return nil
+	return validateSignatureScheme(r.Scheme)
 }
 
 type SignChallengeTokenRequest struct {
 	ChallengeToken string `json:"challenge_token"`
 	Signature      string `json:"signature"`
+	Scheme         string `json:"scheme,omitempty"`
+	ServerScheme   string `json:"server_scheme,omitempty"`
+	Kid            string `json:"kid,omitempty"`
+
+	purpose string
 }
 
+func (r *SignChallengeTokenRequest) bindPurpose(action string) { r.purpose = action }
+
 func (r SignChallengeTokenRequest) Validate() error {
 	if r.ChallengeToken == "" {
-		return errors.New("challenge_token is required")
+		return requiredField("challenge_token")
+	}
+	// JWT challenge tokens carry their own signature
+	if r.Signature == "" && !isChallengeJWT(r.ChallengeToken) {
+		return requiredField("signature")
+	}
+	if err := validateSignatureScheme(r.Scheme); err != nil {
+		return err
+	}
+	return validateServerScheme(r.ServerScheme)
+}
+
+type RotateServerKeyRequest struct {
+	KeySet       string `json:"key_set"`
+	Signature    string `json:"signature"`
+	Kid          string `json:"kid,omitempty"`
+	ServerScheme string `json:"server_scheme,omitempty"`
+
+	purpose string
+}
+
+func (r *RotateServerKeyRequest) bindPurpose(action string) { r.purpose = action }
+
+func (r RotateServerKeyRequest) Validate() error {
+	if r.KeySet == "" {
+		return requiredField("key_set")
 	}
 	if r.Signature == "" {
-		return errors.New("signature is required")
+		return requiredField("signature")
+	}
+	return validateServerScheme(r.ServerScheme)
+}
+
+type CheckStateRequest struct{}
+
+// validateKeyAlgorithm accepts an empty algorithm, which selects DefaultKeyAlgorithm
+func validateKeyAlgorithm(algorithm string) error {
+	if algorithm != "" && !IsSupportedKeyAlgorithm(algorithm) {
+		return invalidField("algorithm", "algorithm must be one of %s", strings.Join(SupportedKeyAlgorithms, ", "))
+	}
+	return nil
+}
+
+// validateSignatureScheme accepts an empty scheme, which selects the keeper key's default scheme.
+// Whether the scheme fits the key is checked when signing.
+func validateSignatureScheme(scheme string) error {
+	if scheme != "" && !slices.Contains(SupportedSignatureSchemes, scheme) {
+		return invalidField("scheme", "scheme must be one of %s", strings.Join(SupportedSignatureSchemes, ", "))
 	}
 	return nil
 }
 
+// validateServerScheme accepts an empty scheme, which selects RS256
+func validateServerScheme(scheme string) error {
+	if scheme != "" && !slices.Contains(SupportedServerSignatureSchemes, scheme) {
+		return invalidField("server_scheme", "server_scheme must be one of %s", strings.Join(SupportedServerSignatureSchemes, ", "))
+	}
+	return nil
+}
+
+type RepairStateRequest struct {
+	Repair string `json:"repair"`
+}
+
+func (r RepairStateRequest) Validate() error {
+	if r.Repair == "" {
+		return requiredField("repair")
+	}
+	return nil
+}
+
+type BatchRequest struct {
+	// Requests run in order, each with its own optional id
+	Requests []BaseRequest `json:"requests"`
+	// Atomic saves the writes of every request or of none
+	Atomic bool `json:"atomic,omitempty"`
+}
+
+func (r BatchRequest) Validate() error {
+	if len(r.Requests) == 0 {
+		return requiredField("requests")
+	}
+	if len(r.Requests) > MaxBatchRequests {
+		return invalidField("requests", "at most %d requests per batch", MaxBatchRequests)
+	}
+	for i, sub := range r.Requests {
+		switch sub.Action {
+		case "":
+			return invalidField("requests", "request %d has no action", i+1)
+		case ActionBatch:
+			return invalidField("requests", "request %d: batches cannot be nested", i+1)
+		}
+	}
+	return nil
+}
+
+// Error codes set in BaseResponse.Code on every failure. Error stays a human readable
+// message; callers branch on Code, which does not change between releases.
+const (
+	// ErrorCodeInvalidRequest means the message is not a JSON request envelope
+	ErrorCodeInvalidRequest = "INVALID_REQUEST"
+	// ErrorCodeUnknownAction means the action is not one the keeper serves
+	ErrorCodeUnknownAction = "UNKNOWN_ACTION"
+	// ErrorCodeInvalidPayload means the payload failed to parse or validate. Field names the offending field when known.
+	ErrorCodeInvalidPayload = "INVALID_PAYLOAD"
+	// ErrorCodeNotFound means the requested item is not in the keystore
+	ErrorCodeNotFound = "NOT_FOUND"
+	// ErrorCodeNotRegistered means the action needs the keeper keypair, which does not exist yet
+	ErrorCodeNotRegistered = "NOT_REGISTERED"
+	// ErrorCodeAlreadyRegistered means signup was requested on a registered device
+	ErrorCodeAlreadyRegistered = "ALREADY_REGISTERED"
+	// ErrorCodeSignatureInvalid means a server signature did not verify with any trusted server key
+	ErrorCodeSignatureInvalid = "SIGNATURE_INVALID"
+	// ErrorCodeChallengeInvalid means a challenge token is malformed, not addressed to this keeper or action,
+	// or a legacy token in strict mode
+	ErrorCodeChallengeInvalid = "CHALLENGE_INVALID"
+	// ErrorCodeChallengeExpired means a challenge token is past its exp
+	ErrorCodeChallengeExpired = "CHALLENGE_EXPIRED"
+	// ErrorCodeChallengeReplayed means a challenge token nonce was used before
+	ErrorCodeChallengeReplayed = "CHALLENGE_REPLAYED"
+	// ErrorCodeChallengeBusy means too many challenge tokens are still unexpired; retry once some expire
+	ErrorCodeChallengeBusy = "CHALLENGE_BUSY"
+	// ErrorCodeDecryptionFailed means a payload could not be decrypted with the keeper key
+	ErrorCodeDecryptionFailed = "DECRYPTION_FAILED"
+	// ErrorCodeKeystoreUnavailable means the storage backend could not be read or written
+	ErrorCodeKeystoreUnavailable = "KEYSTORE_UNAVAILABLE"
+	// ErrorCodeKeystoreCorrupt means the stored items are inconsistent; checkstate lists the repairs
+	ErrorCodeKeystoreCorrupt = "KEYSTORE_CORRUPT"
+	// ErrorCodeServerKeyTampered means the stored server keys failed the integrity check.
+	// Nothing the server signed is accepted until repairstate restore_server_key is run.
+	ErrorCodeServerKeyTampered = "SERVER_KEY_TAMPERED"
+	// ErrorCodeProtocolUnsupported means hello found no protocol version both sides speak
+	ErrorCodeProtocolUnsupported = "PROTOCOL_UNSUPPORTED"
+	// ErrorCodeMessageTooLarge means a response exceeds the 1MB native messaging limit and chunking was not negotiated
+	ErrorCodeMessageTooLarge = "MESSAGE_TOO_LARGE"
+	// ErrorCodeBatchAborted marks a batch item that was rolled back or never ran because another item failed
+	ErrorCodeBatchAborted = "BATCH_ABORTED"
+	// ErrorCodeInternal covers every other failure
+	ErrorCodeInternal = "INTERNAL"
+)
+
 type BaseResponse struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
-	Data    any    `json:"data,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"`
+	// Field is the payload field that failed validation, with ErrorCodeInvalidPayload
+	Field string `json:"field,omitempty"`
+	Data  any    `json:"data,omitempty"`
 }
 
 type PingResponseData struct {
@@ -109,8 +287,24 @@ type PingResponseData struct {
 	Path    string `json:"path"`
 }
 
+type HelloResponseData struct {
+	// Protocol is the version negotiated for this connection, the highest both sides speak
+	Protocol         int    `json:"protocol"`
+	ProtocolVersions []int  `json:"protocol_versions"`
+	Version          string `json:"version"`
+	// Actions lists every action the dispatcher serves, sorted
+	Actions                []string       `json:"actions"`
+	KeyAlgorithms          []string       `json:"key_algorithms"`
+	SignatureSchemes       []string       `json:"signature_schemes"`
+	ServerSignatureSchemes []string       `json:"server_signature_schemes"`
+	StoreBackend           string         `json:"store_backend"`
+	PayloadSchemas         map[string]int `json:"payload_schemas"`
+}
+
 type GenerateKeypairResponseData struct {
-	PublicKey string `json:"publickey"`
+	PublicKey   string `json:"publickey"`
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
 }
 
 type GetDeviceKeyResponseData struct {
@@ -118,7 +312,8 @@ type GetDeviceKeyResponseData struct {
 }
 
 type SaveSessionCodeResponseData struct {
-	SessionCode string `json:"session_code"`
+	SessionCode string          `json:"session_code"`
+	Bundle      json.RawMessage `json:"bundle,omitempty"`
 }
 
 type GetSessionCodeResponseData struct {
@@ -126,23 +321,52 @@ type GetSessionCodeResponseData struct {
 }
 
 type GetPublicKeyResponseData struct {
-	PublicKey string `json:"publickey"`
+	PublicKey   string `json:"publickey"`
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
 }
 
 type GetServerPublicKeyResponseData struct {
-	PublicKey string `json:"publickey"`
+	PublicKey string      `json:"publickey"`
+	Kid       string      `json:"kid"`
+	Keys      []ServerKey `json:"keys"`
+}
+
+type RotateServerKeyResponseData struct {
+	Active string      `json:"active"`
+	Keys   []ServerKey `json:"keys"`
 }
 
 type SignAliasResponseData struct {
-	Signature string `json:"signature"`
-	PublicKey string `json:"publickey"`
+	Signature   string `json:"signature"`
+	Scheme      string `json:"scheme"`
+	PublicKey   string `json:"publickey"`
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
 }
 
 type SignAliasWithTimestampResponseData struct {
 	Signature string `json:"signature"`
+	Scheme    string `json:"scheme"`
 	Timestamp int64  `json:"timestamp"`
 }
 
 type SignChallengeTokenResponseData struct {
 	Signature string `json:"signature"`
+	Scheme    string `json:"scheme"`
+}
+
+type CheckStateResponseData struct {
+	StateReport
+}
+
+type RepairStateResponseData struct {
+	StateReport
+}
+
+type BatchResponseData struct {
+	// Results holds one response per request, in request order
+	Results []BaseResponse `json:"results"`
+	// RolledBack reports that an atomic batch saved nothing
+	RolledBack bool `json:"rolled_back,omitempty"`
 }
@@ -0,0 +1,177 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// AuditOriginRejected is recorded when the keeper is launched by an origin it does not serve
+const AuditOriginRejected = "origin_rejected"
+
+// ErrOriginNotAllowed is returned for a launch by a caller outside the allow-list
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+const chromeOriginPrefix = "chrome-extension://"
+
+var (
+	// Chrome extension ids are 32 letters from a to p
+	chromeExtensionIDPattern = regexp.MustCompile(`^[a-p]{32}$`)
+	// Firefox extension ids are email-like or a GUID in braces
+	firefoxExtensionIDPattern = regexp.MustCompile(`^([A-Za-z0-9._+-]+@[A-Za-z0-9.-]+|\{[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\})$`)
+	namespacePattern          = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+// Origin is the caller that launched the keeper, as passed by the browser on the command line
+type Origin struct {
+	// URL is the calling origin, e.g. chrome-extension://<id>/. Firefox passes no origin.
+	URL         string
+	ExtensionID string
+	// ParentWindow is the native window handle of the caller, passed by Chrome on Windows only
+	ParentWindow string
+	// Manifest is the path of the manifest Firefox launched the keeper from
+	Manifest string
+	// Namespace selects the keystore of this origin; empty for the default keystore
+	Namespace string
+}
+
+// String identifies the caller: its origin URL, or the extension id for Firefox
+func (o Origin) String() string {
+	if o.URL != "" {
+		return o.URL
+	}
+	return o.ExtensionID
+}
+
+// Service returns the keystore service name of the origin's namespace
+func (o Origin) Service() string {
+	if o.Namespace == "" {
+		return config.Service
+	}
+	return config.Service + "." + o.Namespace
+}
+
+// ParseOrigin reads the caller from the arguments a browser launches a native host with.
+// Chromium based browsers pass the origin, and on Windows --parent-window=<handle>;
+// Firefox passes the manifest path and the extension id.
+func ParseOrigin(args []string) (Origin, error) {
+	var origin Origin
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, chromeOriginPrefix):
+			origin.URL = arg
+			origin.ExtensionID = strings.TrimSuffix(strings.TrimPrefix(arg, chromeOriginPrefix), "/")
+		case strings.HasPrefix(arg, "--parent-window="):
+			origin.ParentWindow = strings.TrimPrefix(arg, "--parent-window=")
+		}
+	}
+
+	if origin.URL == "" {
+		if len(args) == 2 && strings.HasSuffix(args[0], ".json") {
+			return parseFirefoxOrigin(args[0], args[1])
+		}
+		return Origin{}, fmt.Errorf("%w: launched without a caller origin", ErrOriginNotAllowed)
+	}
+	if !chromeExtensionIDPattern.MatchString(origin.ExtensionID) || origin.URL != chromeOriginPrefix+origin.ExtensionID+"/" {
+		return Origin{}, fmt.Errorf("%w: malformed origin %q", ErrOriginNotAllowed, origin.URL)
+	}
+	return origin, nil
+}
+
+func parseFirefoxOrigin(manifest, extensionID string) (Origin, error) {
+	if !firefoxExtensionIDPattern.MatchString(extensionID) {
+		return Origin{}, fmt.Errorf("%w: malformed Firefox extension id %q", ErrOriginNotAllowed, extensionID)
+	}
+	return Origin{ExtensionID: extensionID, Manifest: manifest}, nil
+}
+
+// OriginPolicy maps the extension ids allowed to launch the keeper to their keystore namespace
+type OriginPolicy map[string]string
+
+// LoadOriginPolicy returns the allow-list from config.AllowedOriginsEnv,
+// or config.ExtensionID and config.FirefoxExtensionID when it is unset
+func LoadOriginPolicy() (OriginPolicy, error) {
+	value := os.Getenv(config.AllowedOriginsEnv)
+	if value == "" {
+		return OriginPolicy{config.ExtensionID: "", config.FirefoxExtensionID: ""}, nil
+	}
+
+	policy := OriginPolicy{}
+	for entry := range strings.SplitSeq(value, ",") {
+		id, namespace, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if !chromeExtensionIDPattern.MatchString(id) && !firefoxExtensionIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid extension id %q in %s", id, config.AllowedOriginsEnv)
+		}
+		if namespace != "" && !namespacePattern.MatchString(namespace) {
+			return nil, fmt.Errorf("invalid namespace %q for %s in %s", namespace, id, config.AllowedOriginsEnv)
+		}
+		policy[id] = namespace
+	}
+	return policy, nil
+}
+
+// Authorize returns the origin with its namespace set, or ErrOriginNotAllowed
+func (p OriginPolicy) Authorize(origin Origin) (Origin, error) {
+	namespace, ok := p[origin.ExtensionID]
+	if !ok {
+		return Origin{}, fmt.Errorf("%w: %s", ErrOriginNotAllowed, origin)
+	}
+	origin.Namespace = namespace
+	return origin, nil
+}
+
+// AuthorizeLaunch checks the origin in the launch arguments against the allow-list.
+// Rejected launches are recorded in the audit log, since no keeper is serving them.
+func AuthorizeLaunch(args []string) (Origin, error) {
+	policy, err := LoadOriginPolicy()
+	if err != nil {
+		return Origin{}, err
+	}
+
+	origin, err := ParseOrigin(args)
+	if err == nil {
+		origin, err = policy.Authorize(origin)
+	}
+	if err != nil {
+		logAuditEvent(AuditEvent{Time: time.Now().UTC(), Event: AuditOriginRejected, Detail: err.Error()})
+		return Origin{}, err
+	}
+	return origin, nil
+}
+
+// Origins returns the origin URL of every allowed Chrome extension, sorted
+func (p OriginPolicy) Origins() []string {
+	var origins []string
+	for id := range p {
+		if chromeExtensionIDPattern.MatchString(id) {
+			origins = append(origins, chromeOriginPrefix+id+"/")
+		}
+	}
+	slices.Sort(origins)
+	return origins
+}
+
+// FirefoxExtensions returns the id of every allowed Firefox extension, sorted
+func (p OriginPolicy) FirefoxExtensions() []string {
+	var extensions []string
+	for id := range p {
+		if firefoxExtensionIDPattern.MatchString(id) {
+			extensions = append(extensions, id)
+		}
+	}
+	slices.Sort(extensions)
+	return extensions
+}
+
+// Namespaces returns every keystore namespace the allow-list maps to, sorted, "" for the default keystore
+func (p OriginPolicy) Namespaces() []string {
+	namespaces := slices.Sorted(maps.Values(p))
+	return slices.Compact(namespaces)
+}
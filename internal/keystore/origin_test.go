@@ -0,0 +1,143 @@
+package keystore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+const (
+	devExtensionID  = "abcdefghijklmnopabcdefghijklmnop"
+	betaExtensionID = "ponmlkjihgfedcbaponmlkjihgfedcba"
+)
+
+func TestParseOrigin(t *testing.T) {
+	origin, err := ParseOrigin([]string{"chrome-extension://" + config.ExtensionID + "/", "--parent-window=6620"})
+	if err != nil {
+		t.Fatalf("ParseOrigin failed: %v", err)
+	}
+	if origin.ExtensionID != config.ExtensionID || origin.ParentWindow != "6620" {
+		t.Errorf("Unexpected origin: %+v", origin)
+	}
+
+	for name, args := range map[string][]string{
+		"no arguments":   nil,
+		"no origin":      {"--parent-window=6620"},
+		"bad id":         {"chrome-extension://not-an-extension-id/"},
+		"trailing path":  {"chrome-extension://" + config.ExtensionID + "/popup.html"},
+		"missing slash":  {"chrome-extension://" + config.ExtensionID},
+		"uppercase id":   {"chrome-extension://" + strings.ToUpper(config.ExtensionID) + "/"},
+		"web page":       {"https://example.com/"},
+		"empty argument": {""},
+		"firefox bad id": {"/usr/lib/mozilla/native-messaging-hosts/com.dragpass.keeper.json", "not an id"},
+		"firefox no id":  {"/usr/lib/mozilla/native-messaging-hosts/com.dragpass.keeper.json"},
+	} {
+		if _, err := ParseOrigin(args); !errors.Is(err, ErrOriginNotAllowed) {
+			t.Errorf("%s: expected ErrOriginNotAllowed, got: %v", name, err)
+		}
+	}
+}
+
+func TestParseFirefoxOrigin(t *testing.T) {
+	manifest := "/home/alice/.mozilla/native-messaging-hosts/com.dragpass.keeper.json"
+	for _, id := range []string{config.FirefoxExtensionID, "{8f3b1c2d-4e5f-6a7b-8c9d-0e1f2a3b4c5d}"} {
+		origin, err := ParseOrigin([]string{manifest, id})
+		if err != nil {
+			t.Fatalf("ParseOrigin failed for %s: %v", id, err)
+		}
+		if origin.ExtensionID != id || origin.Manifest != manifest || origin.URL != "" || origin.String() != id {
+			t.Errorf("Unexpected Firefox origin: %+v", origin)
+		}
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	t.Setenv(config.AllowedOriginsEnv, "")
+	policy, err := LoadOriginPolicy()
+	if err != nil {
+		t.Fatalf("LoadOriginPolicy failed: %v", err)
+	}
+	origin, err := policy.Authorize(Origin{URL: "chrome-extension://" + config.ExtensionID + "/", ExtensionID: config.ExtensionID})
+	if err != nil || origin.Service() != config.Service {
+		t.Errorf("Expected the default extension in the default keystore, got %+v: %v", origin, err)
+	}
+	if _, err := policy.Authorize(Origin{ExtensionID: devExtensionID}); !errors.Is(err, ErrOriginNotAllowed) {
+		t.Errorf("Expected an unknown extension to be refused, got: %v", err)
+	}
+	if _, err := policy.Authorize(Origin{ExtensionID: config.FirefoxExtensionID}); err != nil {
+		t.Errorf("Expected the default Firefox extension to be allowed, got: %v", err)
+	}
+	if origins, extensions := policy.Origins(), policy.FirefoxExtensions(); len(origins) != 1 || len(extensions) != 1 || extensions[0] != config.FirefoxExtensionID {
+		t.Errorf("Unexpected allow-list: origins %v, extensions %v", origins, extensions)
+	}
+
+	t.Setenv(config.AllowedOriginsEnv, config.ExtensionID+", "+devExtensionID+"=dev, dev@dragpass.app=dev")
+	if policy, err = LoadOriginPolicy(); err != nil {
+		t.Fatalf("LoadOriginPolicy failed: %v", err)
+	}
+	if origin, err = policy.Authorize(Origin{ExtensionID: devExtensionID}); err != nil || origin.Service() != config.Service+".dev" {
+		t.Errorf("Expected the dev extension in its own keystore, got %+v: %v", origin, err)
+	}
+	if _, err := policy.Authorize(Origin{ExtensionID: betaExtensionID}); !errors.Is(err, ErrOriginNotAllowed) {
+		t.Errorf("Expected an unlisted extension to be refused, got: %v", err)
+	}
+	if origin, err = policy.Authorize(Origin{ExtensionID: "dev@dragpass.app"}); err != nil || origin.Namespace != "dev" {
+		t.Errorf("Expected the Firefox dev extension in the dev keystore, got %+v: %v", origin, err)
+	}
+
+	for _, value := range []string{"not-an-id", devExtensionID + "=Dev", devExtensionID + "=../vault"} {
+		t.Setenv(config.AllowedOriginsEnv, value)
+		if _, err := LoadOriginPolicy(); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestAuthorizeLaunch(t *testing.T) {
+	t.Setenv(config.AllowedOriginsEnv, devExtensionID+"=dev")
+
+	origin, err := AuthorizeLaunch([]string{"chrome-extension://" + devExtensionID + "/"})
+	if err != nil || origin.Namespace != "dev" {
+		t.Errorf("Expected the dev extension to be served, got %+v: %v", origin, err)
+	}
+	if _, err := AuthorizeLaunch([]string{"chrome-extension://" + config.ExtensionID + "/"}); !errors.Is(err, ErrOriginNotAllowed) {
+		t.Errorf("Expected an extension missing from the allow-list to be refused, got: %v", err)
+	}
+}
+
+func TestOriginNamespacesAreSeparate(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv(config.VaultPassphraseEnv, "passphrase")
+	t.Setenv(config.StoreBackendEnv, config.StoreBackendFile)
+
+	prod, err := OpenStore(Origin{}.Service())
+	if err != nil {
+		t.Fatalf("Failed to open default keystore: %v", err)
+	}
+	dev, err := OpenStore(Origin{Namespace: "dev"}.Service())
+	if err != nil {
+		t.Fatalf("Failed to open dev keystore: %v", err)
+	}
+
+	if err := prod.Set(config.DeviceKey, "prod-device-key"); err != nil {
+		t.Fatalf("Failed to save device key: %v", err)
+	}
+	if _, err := dev.Get(config.DeviceKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the dev keystore not to see the default one, got: %v", err)
+	}
+}
+
+func TestAuditEventsCarryOrigin(t *testing.T) {
+	k, _ := newTestKeeper(t)
+	events := recordAudit(k)
+
+	url := "chrome-extension://" + config.ExtensionID + "/"
+	k.SetOrigin(Origin{URL: url, ExtensionID: config.ExtensionID})
+	k.forRequest([]byte(`1`)).audit(AuditServerKeyRestored, "test")
+
+	if len(*events) != 1 || (*events)[0].Origin != url {
+		t.Errorf("Expected the audit event to carry the origin, got: %+v", *events)
+	}
+}
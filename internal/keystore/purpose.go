@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// purposeMessagePrefix starts every detached server signature that states its purpose
+const purposeMessagePrefix = "dragpass-keeper:"
+
+var (
+	ErrPurposeMissing  = errors.New("request was not dispatched with a purpose")
+	ErrPurposeMismatch = errors.New("server signature was issued for another action")
+)
+
+// legacyPurposes may still be authorized by a detached signature over the bare payload,
+// unless strict challenges are enabled. generatekeypair is destructive and
+// rotateserverkey postdates purposes, so neither is listed.
+var legacyPurposes = map[string]bool{
+	ActionSignChallengeToken: true,
+	ActionSaveSessionCode:    true,
+}
+
+// purposeBound is implemented by requests that carry a server-signed payload.
+// The dispatcher binds the dispatched action, which the server signature must name.
+type purposeBound interface {
+	bindPurpose(action string)
+}
+
+// purposeMessage is what the server signs to authorize payload for the given action only:
+// "dragpass-keeper:<action>:<payload>"
+func purposeMessage(purpose, payload string) string {
+	return purposeMessagePrefix + purpose + ":" + payload
+}
+
+// verifyPurposeSignature verifies a detached server signature over purposeMessage(purpose, payload).
+// It returns the kid of the key that verified.
+func (k *Keeper) verifyPurposeSignature(purpose, payload, signature, scheme, kid string, now time.Time) (string, error) {
+	if purpose == "" {
+		return "", ErrPurposeMissing
+	}
+
+	signingKid, err := k.verifyServerSignatureAt(purposeMessage(purpose, payload), signature, scheme, kid, now)
+	if err == nil || !legacyPurposes[purpose] || k.strictChallenges || errors.Is(err, ErrServerKeyTampered) {
+		return signingKid, err
+	}
+
+	// Servers that predate purposes sign the bare payload
+	signingKid, legacyErr := k.verifyServerSignatureAt(payload, signature, scheme, kid, now)
+	if legacyErr != nil {
+		return "", err
+	}
+	return signingKid, nil
+}
+
+// checkPurposeClaim compares the purpose claim of a challenge token with the dispatched action
+func checkPurposeClaim(purpose, claimed string) error {
+	if purpose == "" {
+		return ErrPurposeMissing
+	}
+	if claimed != purpose {
+		return fmt.Errorf("%w: token purpose %q, dispatched %q", ErrPurposeMismatch, claimed, purpose)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package keystore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// dispatch sends the request through HandleRequest, which binds the action as its purpose
+func dispatch(t *testing.T, k *Keeper, action string, payload any) BaseResponse {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Failed to marshal payload: %v", err)
+	}
+	msg, err := json.Marshal(BaseRequest{Action: action, Payload: data})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	return k.HandleRequest(msg)
+}
+
+func TestPurposeBoundSignatures(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	// A detached signature only authorizes the action it names
+	signature := serverSign(t, serverKey, purposeMessage(ActionSignChallengeToken, "challenge"))
+	if resp := dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{ChallengeToken: "challenge", Signature: signature}); resp.Success {
+		t.Fatal("Expected a signchallengetoken signature to be refused by generatekeypair")
+	}
+	if resp := dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{ChallengeToken: "challenge", Signature: serverSign(t, serverKey, "challenge")}); resp.Success {
+		t.Fatal("Expected generatekeypair to refuse a signature without purpose")
+	}
+	if _, err := k.getPrivateKey(); err == nil {
+		t.Fatal("Expected no keypair after rejected requests")
+	}
+
+	resp := dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "challenge")),
+	})
+	if !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+	if resp := dispatch(t, k, ActionSignChallengeToken, SignChallengeTokenRequest{ChallengeToken: "challenge", Signature: signature}); !resp.Success {
+		t.Fatalf("SignChallengeToken failed: %s", resp.Error)
+	}
+
+	// Servers that predate purposes may still authorize signchallengetoken, unless strict
+	legacy := serverSign(t, serverKey, "challenge")
+	if resp := dispatch(t, k, ActionSignChallengeToken, SignChallengeTokenRequest{ChallengeToken: "challenge", Signature: legacy}); !resp.Success {
+		t.Fatalf("Legacy SignChallengeToken failed: %s", resp.Error)
+	}
+	k.strictChallenges = true
+	if _, err := k.verifyPurposeSignature(ActionSaveSessionCode, "payload", serverSign(t, serverKey, "payload"), "", "", time.Now()); err == nil {
+		t.Error("Expected strict mode to refuse a signature without purpose")
+	}
+}
+
+func TestPurposeBoundChallengeTokens(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+
+	keygen := issueChallenge(t, serverKey, jwt.SigningMethodRS256, freshClaims("nonce-1"))
+	if resp := dispatch(t, k, ActionGenerateKeypair, GenerateKeypairRequest{ChallengeToken: keygen}); !resp.Success {
+		t.Fatalf("GenerateKeypair failed: %s", resp.Error)
+	}
+
+	// A generatekeypair token cannot be spent on signchallengetoken, nor can one without purpose
+	noPurpose := freshClaims("nonce-2")
+	noPurpose.Purpose = ""
+	for name, token := range map[string]string{
+		"other purpose": issueChallenge(t, serverKey, jwt.SigningMethodRS256, freshClaims("nonce-3")),
+		"no purpose":    issueChallenge(t, serverKey, jwt.SigningMethodRS256, noPurpose),
+	} {
+		resp := dispatch(t, k, ActionSignChallengeToken, SignChallengeTokenRequest{ChallengeToken: token})
+		if resp.Success || !strings.Contains(resp.Error, ErrPurposeMismatch.Error()) {
+			t.Errorf("%s: expected %v, got success=%v error=%q", name, ErrPurposeMismatch, resp.Success, resp.Error)
+		}
+	}
+
+	// Handlers called without going through HandleRequest have no purpose to check against
+	if resp := k.HandleSignChallengeToken(SignChallengeTokenRequest{ChallengeToken: keygen}); resp.Success || !strings.Contains(resp.Error, ErrPurposeMissing.Error()) {
+		t.Errorf("Expected %v, got success=%v error=%q", ErrPurposeMissing, resp.Success, resp.Error)
+	}
+}
@@ -0,0 +1,94 @@
+package keystore
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxConcurrentRequests bounds how many requests Serve handles at once.
+// Further messages are not read until a request finishes.
+const MaxConcurrentRequests = 16
+
+// Serve answers the requests read from msgr until the extension closes the connection.
+// Once hello negotiated ConcurrentProtocolVersion, requests with an id are handled concurrently
+// and each response is sent as soon as it is ready, so responses may arrive out of order; the
+// extension matches them by request id. Every other request is handled in order, after all
+// requests before it are answered.
+func (k *Keeper) Serve(msgr *Messenger) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, MaxConcurrentRequests)
+	var concurrent atomic.Bool
+
+	respond := func(msg []byte) {
+		resp := k.handleRecovered(msg)
+		if hello, ok := resp.Data.(HelloResponseData); ok {
+			concurrent.Store(hello.Protocol >= ConcurrentProtocolVersion)
+			// Oversized responses are chunked for clients that negotiated it in hello
+			msgr.chunking.Store(hello.Protocol >= ChunkingProtocolVersion)
+		}
+		if err := msgr.SendResponse(resp); err != nil {
+			log.Printf("Failed to send response: %v", err)
+		}
+	}
+
+	for {
+		// Read raw message bytes
+		msg, err := msgr.ReadMessage()
+		if err == io.EOF {
+			log.Println("Chrome extension closed the connection")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read message: %v", err)
+			errorResponse := codeResponse(ErrorCodeInvalidRequest, "Native host read error: "+err.Error())
+			if sendErr := msgr.SendResponse(errorResponse); sendErr != nil {
+				log.Printf("Failed to send error response: %v", sendErr)
+				return
+			}
+			continue
+		}
+
+		if !concurrent.Load() || !hasRequestID(msg) {
+			wg.Wait()
+			respond(msg)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			respond(msg)
+		}()
+	}
+}
+
+// hasRequestID reports whether msg carries an id its response can be matched by
+func hasRequestID(msg []byte) bool {
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+	return json.Unmarshal(msg, &req) == nil && len(req.ID) > 0 && string(req.ID) != "null"
+}
+
+// handleRecovered is HandleRequest, turning a panic into an error response
+// instead of taking down every other request in flight
+func (k *Keeper) handleRecovered(msg []byte) (resp BaseResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Critical Panic Recovered: %v", r)
+			var base BaseRequest
+			_ = json.Unmarshal(msg, &base)
+			resp = codeResponse(ErrorCodeInternal, "internal error")
+			resp.ID = base.ID
+		}
+	}()
+	return k.HandleRequest(msg)
+}
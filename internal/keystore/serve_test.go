@@ -0,0 +1,176 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frame encodes messages the way Chrome sends them to a native host
+func frame(messages ...string) io.Reader {
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(msg)))
+		buf.WriteString(msg)
+	}
+	return &buf
+}
+
+// readResponses decodes every response the keeper wrote
+func readResponses(t *testing.T, out *bytes.Buffer) []BaseResponse {
+	t.Helper()
+
+	var responses []BaseResponse
+	for out.Len() > 0 {
+		var length uint32
+		if err := binary.Read(out, binary.LittleEndian, &length); err != nil {
+			t.Fatalf("Failed to read response length: %v", err)
+		}
+		var resp BaseResponse
+		if err := json.Unmarshal(out.Next(int(length)), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func TestServeEchoesRequestIDs(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	var out bytes.Buffer
+	k.Serve(NewMessenger(frame(
+		`{"id":1,"action":"ping"}`,
+		`{"id":"two","action":"getsessioncode"}`,
+		`{"action":"ping"}`,
+		`{"id":3,"action":"savedevicekey","payload":{"key":"device-secret"}}`,
+	), &out))
+
+	byID := map[string]BaseResponse{}
+	for _, resp := range readResponses(t, &out) {
+		byID[string(resp.ID)] = resp
+	}
+	if len(byID) != 4 {
+		t.Fatalf("Expected 4 responses, got: %+v", byID)
+	}
+	if !byID["1"].Success || !byID[""].Success || !byID["3"].Success {
+		t.Errorf("Expected ping and savedevicekey to succeed, got: %+v", byID)
+	}
+	if resp := byID[`"two"`]; resp.Success || resp.Code != ErrorCodeNotFound {
+		t.Errorf("Expected %s for request two, got: %+v", ErrorCodeNotFound, resp)
+	}
+}
+
+// slowAction delays every request for action
+func slowAction(action string, delay time.Duration) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(k *Keeper, req BaseRequest) BaseResponse {
+			if req.Action == action {
+				time.Sleep(delay)
+			}
+			return next(k, req)
+		}
+	}
+}
+
+func TestServeOrdersRequestsWithoutID(t *testing.T) {
+	k, _ := newTestKeeper(t)
+	k.Use(slowAction(ActionSaveDeviceKey, 100*time.Millisecond))
+
+	var out bytes.Buffer
+	k.Serve(NewMessenger(frame(
+		`{"action":"hello","payload":{"protocol_versions":[1,2,3]}}`,
+		`{"action":"savedevicekey","payload":{"key":"device-secret"}}`,
+		`{"action":"getdevicekey"}`,
+	), &out))
+
+	responses := readResponses(t, &out)
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, got: %+v", responses)
+	}
+	if data, _ := responses[1].Data.(map[string]any); !responses[1].Success || data["key"] != nil {
+		t.Errorf("Expected the savedevicekey response second, got: %+v", responses[1])
+	}
+	if data, _ := responses[2].Data.(map[string]any); !responses[2].Success || data["key"] != "device-secret" {
+		t.Errorf("Expected getdevicekey to run after savedevicekey, got: %+v", responses[2])
+	}
+}
+
+func TestServeAnswersIDsOutOfOrder(t *testing.T) {
+	for _, tt := range []struct {
+		versions  string
+		wantFirst string
+	}{
+		{versions: "[1]", wantFirst: "1"},
+		{versions: "[1,2]", wantFirst: "2"},
+	} {
+		t.Run(tt.versions, func(t *testing.T) {
+			k, _ := newTestKeeper(t)
+			k.Use(slowAction(ActionSaveDeviceKey, 100*time.Millisecond))
+
+			var out bytes.Buffer
+			k.Serve(NewMessenger(frame(
+				`{"id":0,"action":"hello","payload":{"protocol_versions":`+tt.versions+`}}`,
+				`{"id":1,"action":"savedevicekey","payload":{"key":"device-secret"}}`,
+				`{"id":2,"action":"ping"}`,
+			), &out))
+
+			responses := readResponses(t, &out)
+			if len(responses) != 3 || string(responses[1].ID) != tt.wantFirst {
+				t.Errorf("Expected request %s to be answered first, got: %+v", tt.wantFirst, responses)
+			}
+		})
+	}
+}
+
+func TestHandleRequestConcurrently(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := fmt.Sprintf(`{"id":%d,"action":"savedevicekey","payload":{"key":"key-%d"}}`, i, i)
+			if i%2 == 1 {
+				msg = fmt.Sprintf(`{"id":%d,"action":"getdevicekey"}`, i)
+			}
+			resp := k.HandleRequest([]byte(msg))
+			if string(resp.ID) != fmt.Sprint(i) {
+				t.Errorf("Response id mismatch.\nGot: %s\nWant: %d", resp.ID, i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if resp := k.HandleGetDeviceKey(GetDeviceKeyRequest{}); !resp.Success || !strings.HasPrefix(resp.Data.(GetDeviceKeyResponseData).Key, "key-") {
+		t.Errorf("Unexpected device key after concurrent writes: %+v", resp)
+	}
+}
+
+func TestRequestLogLinesCarryID(t *testing.T) {
+	k, _ := newTestKeeper(t)
+
+	var logs bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logs)
+	k.HandleRequest([]byte(`{"id":"req-7","action":"getdevicekey"}`))
+	log.SetOutput(output)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Expected several log lines, got: %q", logs.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `[id="req-7"] `) {
+			t.Errorf("Log line without request id: %q", line)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package keystore
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// Server key rotation grace periods, in seconds
+const (
+	// DefaultServerKeyGracePeriod applies when a key set document does not state one
+	DefaultServerKeyGracePeriod = 7 * 24 * 60 * 60
+	// MaxServerKeyGracePeriod bounds how long a superseded key stays trusted
+	MaxServerKeyGracePeriod = 90 * 24 * 60 * 60
+)
+
+// ServerKey is a trusted server public key
+type ServerKey struct {
+	Kid       string `json:"kid"`
+	PublicKey string `json:"publickey"`
+	// NotAfter ends the grace period of a superseded key (unix seconds). Zero for current keys.
+	NotAfter int64 `json:"not_after,omitempty"`
+}
+
+// ServerKeySetDocument is the payload the server signs to rotate its keys.
+// Keys lists every current key; keys missing from it are retired after the grace period.
+// A single new key is a document with one entry.
+type ServerKeySetDocument struct {
+	Keys []ServerKey `json:"keys"`
+	// Active names the key the server signs with. Optional when Keys has one entry.
+	Active string `json:"active,omitempty"`
+	// IssuedAt must increase with every rotation, so older documents cannot be replayed
+	IssuedAt int64 `json:"issued_at"`
+	// GracePeriod in seconds, DefaultServerKeyGracePeriod if zero
+	GracePeriod int64 `json:"grace_period,omitempty"`
+}
+
+// ServerKeyRotation records an accepted key set document exactly as it was signed
+type ServerKeyRotation struct {
+	KeySet    string `json:"key_set"`
+	Signature string `json:"signature"`
+	Kid       string `json:"kid"`
+	Scheme    string `json:"scheme,omitempty"`
+}
+
+// ServerKeySet is the stored set of trusted server keys
+type ServerKeySet struct {
+	Active    string              `json:"active"`
+	IssuedAt  int64               `json:"issued_at"`
+	Keys      []ServerKey         `json:"keys"`
+	Rotations []ServerKeyRotation `json:"rotations,omitempty"`
+}
+
+// newServerKeySet returns a key set trusting a single key, identified by its fingerprint
+func newServerKeySet(publicKeyPEM string) (*ServerKeySet, error) {
+	if _, err := parseServerPublicKey(publicKeyPEM); err != nil {
+		return nil, err
+	}
+	kid, err := FingerprintPEM(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerKeySet{Active: kid, Keys: []ServerKey{{Kid: kid, PublicKey: publicKeyPEM}}}, nil
+}
+
+// parseServerPublicKey parses a PEM encoded server key. Server keys are RSA.
+func parseServerPublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+	publicKey, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("server key must be RSA, got %T", publicKey)
+	}
+	return rsaKey, nil
+}
+
+// lookup returns the key with the given kid, trusted or not
+func (s *ServerKeySet) lookup(kid string) (*ServerKey, bool) {
+	for i := range s.Keys {
+		if s.Keys[i].Kid == kid {
+			return &s.Keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// key returns the key with the given kid if it is still trusted at now
+func (s *ServerKeySet) key(kid string, now time.Time) (*ServerKey, bool) {
+	key, ok := s.lookup(kid)
+	if !ok || key.expired(now) {
+		return nil, false
+	}
+	return key, true
+}
+
+// trusted returns every key still trusted at now, the active key first
+func (s *ServerKeySet) trusted(now time.Time) []ServerKey {
+	var keys []ServerKey
+	if active, ok := s.key(s.Active, now); ok {
+		keys = append(keys, *active)
+	}
+	for _, key := range s.Keys {
+		if key.Kid != s.Active && !key.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (key ServerKey) expired(now time.Time) bool {
+	return key.NotAfter != 0 && now.Unix() >= key.NotAfter
+}
+
+// loadServerKeySet returns the stored key set. Keepers that only have the
+// single server public key item are treated as trusting that key alone.
+func (k *Keeper) loadServerKeySet() (*ServerKeySet, error) {
+	data, err := k.store.Get(config.DragPassServerKeySet)
+	if errors.Is(err, ErrNotFound) {
+		serverPubKeyPEM, err := k.getServerPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		set, err := newServerKeySet(serverPubKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrServerKeyTampered, err)
+		}
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var set ServerKeySet
+	if err := json.Unmarshal([]byte(data), &set); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse server key set: %v", ErrServerKeyTampered, err)
+	}
+	if _, ok := set.lookup(set.Active); !ok {
+		return nil, fmt.Errorf("%w: server key set has no active key %q", ErrServerKeyTampered, set.Active)
+	}
+	return &set, nil
+}
+
+// saveServerKeySet stores the key set and mirrors its active key into the server public key item
+func (k *Keeper) saveServerKeySet(set *ServerKeySet) error {
+	tx := newTransaction(k.store)
+	if err := stageServerKeySet(tx, set); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func stageServerKeySet(tx *transaction, set *ServerKeySet) error {
+	active, ok := set.lookup(set.Active)
+	if !ok {
+		return fmt.Errorf("server key set has no active key %q", set.Active)
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+
+	tx.Set(config.DragPassServerKeySet, string(data))
+	tx.Set(config.DragPassServerPublicKey, active.PublicKey)
+	return nil
+}
+
+// rotateServerKeys accepts a key set document signed for purpose by the active server key
+// or a pinned one. Keys the document drops stay trusted for its grace period.
+func (k *Keeper) rotateServerKeys(purpose, keySet, signature, kid, scheme string, now time.Time) (*ServerKeySet, error) {
+	current, err := k.loadTrustedServerKeySet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server key set: %w", err)
+	}
+
+	signingKid, err := k.verifyRotationSignature(current, purpose, keySet, signature, scheme, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc ServerKeySetDocument
+	if err := json.Unmarshal([]byte(keySet), &doc); err != nil {
+		return nil, invalidField("key_set", "failed to parse key set: %v", err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, invalidField("key_set", "%v", err)
+	}
+	if doc.IssuedAt <= current.IssuedAt {
+		return nil, invalidField("key_set", "key set issued_at %d is not newer than the current key set (%d)", doc.IssuedAt, current.IssuedAt)
+	}
+
+	gracePeriod := doc.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultServerKeyGracePeriod
+	}
+	notAfter := now.Unix() + gracePeriod
+
+	next := &ServerKeySet{Active: doc.Active, IssuedAt: doc.IssuedAt}
+	for _, key := range doc.Keys {
+		if existing, ok := current.lookup(key.Kid); ok && !samePublicKey(existing.PublicKey, key.PublicKey) {
+			return nil, invalidField("key_set", "kid %s is already used by a different key", key.Kid)
+		}
+		next.Keys = append(next.Keys, ServerKey{Kid: key.Kid, PublicKey: key.PublicKey})
+	}
+	for _, key := range current.Keys {
+		if _, kept := next.lookup(key.Kid); kept || key.expired(now) {
+			continue
+		}
+		if key.NotAfter == 0 || key.NotAfter > notAfter {
+			key.NotAfter = notAfter
+		}
+		next.Keys = append(next.Keys, key)
+	}
+	next.Rotations = append(current.Rotations, ServerKeyRotation{KeySet: keySet, Signature: signature, Kid: signingKid, Scheme: scheme})
+
+	if err := k.saveServerKeySet(next); err != nil {
+		return nil, fmt.Errorf("failed to save server key set: %v", err)
+	}
+	k.audit(AuditServerKeyRotated, fmt.Sprintf("active key %s, signed by %s", next.Active, signingKid))
+	return next, nil
+}
+
+// verifyRotationSignature verifies the signature of a key set document. Keys in their grace period
+// only verify ordinary signatures: a retired key must not be able to install a key of its choosing.
+// It returns the kid of the key that verified.
+func (k *Keeper) verifyRotationSignature(set *ServerKeySet, purpose, keySet, signature, scheme, kid string) (string, error) {
+	if purpose == "" {
+		return "", ErrPurposeMissing
+	}
+	signers, err := k.rotationSigners(set)
+	if err != nil {
+		return "", err
+	}
+	if kid != "" {
+		signers = slices.DeleteFunc(signers, func(key ServerKey) bool { return key.Kid != kid })
+		if len(signers) == 0 {
+			return "", fmt.Errorf("%w: server key %s may not sign a rotation", ErrSignatureInvalid, kid)
+		}
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to decode signature: %v", ErrSignatureInvalid, err)
+	}
+	for _, key := range signers {
+		serverPubKey, err := parseServerPublicKey(key.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse server public key: %v", err)
+		}
+		if err := VerifySignatureWithScheme(serverPubKey, scheme, purposeMessage(purpose, keySet), signatureBytes); err == nil {
+			return key.Kid, nil
+		}
+	}
+	return "", fmt.Errorf("%w: neither the active nor a pinned server key verifies the key set", ErrSignatureInvalid)
+}
+
+// rotationSigners returns the keys that may sign a rotation: the active key, the embedded key and pinned keys
+func (k *Keeper) rotationSigners(set *ServerKeySet) ([]ServerKey, error) {
+	active, _ := set.lookup(set.Active)
+	signers := []ServerKey{*active}
+
+	anchorPEM, err := k.anchorServerKey()
+	if err != nil {
+		return nil, err
+	}
+	anchorKid, err := FingerprintPEM(anchorPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint hardcoded server public key: %v", err)
+	}
+	if anchorKid != set.Active {
+		signers = append(signers, ServerKey{Kid: anchorKid, PublicKey: anchorPEM})
+	}
+
+	for _, key := range set.Keys {
+		if key.Kid == set.Active || key.Kid == anchorKid {
+			continue
+		}
+		if fingerprint, err := FingerprintPEM(key.PublicKey); err == nil && slices.Contains(k.serverKeyPins, fingerprint) {
+			signers = append(signers, key)
+		}
+	}
+	return signers, nil
+}
+
+// samePublicKey compares two PEM encoded public keys by fingerprint
+func samePublicKey(a, b string) bool {
+	fa, errA := FingerprintPEM(a)
+	fb, errB := FingerprintPEM(b)
+	return errA == nil && errB == nil && fa == fb
+}
+
+func (doc *ServerKeySetDocument) validate() error {
+	if len(doc.Keys) == 0 {
+		return errors.New("key set has no keys")
+	}
+	seen := make(map[string]bool, len(doc.Keys))
+	for _, key := range doc.Keys {
+		if key.Kid == "" {
+			return errors.New("key set entry without kid")
+		}
+		if seen[key.Kid] {
+			return fmt.Errorf("duplicate kid in key set: %s", key.Kid)
+		}
+		seen[key.Kid] = true
+		if _, err := parseServerPublicKey(key.PublicKey); err != nil {
+			return fmt.Errorf("invalid key %s: %v", key.Kid, err)
+		}
+	}
+
+	if doc.Active == "" && len(doc.Keys) == 1 {
+		doc.Active = doc.Keys[0].Kid
+	}
+	if !seen[doc.Active] {
+		return fmt.Errorf("active key %q is not in the key set", doc.Active)
+	}
+	if doc.GracePeriod < 0 || doc.GracePeriod > MaxServerKeyGracePeriod {
+		return fmt.Errorf("grace_period must be between 0 and %d seconds", MaxServerKeyGracePeriod)
+	}
+	return nil
+}
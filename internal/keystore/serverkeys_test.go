@@ -0,0 +1,188 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+func newServerKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate server key: %v", err)
+	}
+	pubPEM, err := PublicKeyToPEM(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode server key: %v", err)
+	}
+	return key, pubPEM
+}
+
+func keySetDocument(t *testing.T, doc ServerKeySetDocument) string {
+	t.Helper()
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Failed to marshal key set: %v", err)
+	}
+	return string(data)
+}
+
+func TestRotateServerKeys(t *testing.T) {
+	k, oldKey := newTestKeeper(t)
+	oldPEM, _ := k.getServerPublicKey()
+	oldKid, _ := FingerprintPEM(oldPEM)
+	newKey, newPEM := newServerKey(t)
+	now := time.Unix(1700000000, 0)
+
+	doc := keySetDocument(t, ServerKeySetDocument{
+		Keys:        []ServerKey{{Kid: "2025-01", PublicKey: newPEM}},
+		IssuedAt:    now.Unix(),
+		GracePeriod: 3600,
+	})
+
+	// Only a trusted key may sign a rotation
+	if _, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, newKey, purposeMessage(ActionRotateServerKey, doc)), "", "", now); err == nil {
+		t.Fatal("Expected a key set signed by an untrusted key to be rejected")
+	}
+
+	// The bare document is not enough, the signature must state the purpose
+	if _, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, oldKey, doc), "", "", now); err == nil {
+		t.Fatal("Expected a key set signed without its purpose to be rejected")
+	}
+
+	set, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, oldKey, purposeMessage(ActionRotateServerKey, doc)), "", "", now)
+	if err != nil {
+		t.Fatalf("rotateServerKeys failed: %v", err)
+	}
+	if set.Active != "2025-01" {
+		t.Errorf("Active kid mismatch.\nGot: %s\nWant: %s", set.Active, "2025-01")
+	}
+	if got, _ := k.getServerPublicKey(); got != newPEM {
+		t.Error("Server public key item does not mirror the active key")
+	}
+	if len(set.Rotations) != 1 || set.Rotations[0].Kid != oldKid {
+		t.Errorf("Rotation record mismatch: %+v", set.Rotations)
+	}
+
+	// Both keys verify during the grace period, and kid selects one
+	for _, tc := range []struct {
+		key *rsa.PrivateKey
+		kid string
+	}{{oldKey, ""}, {newKey, ""}, {oldKey, oldKid}, {newKey, "2025-01"}} {
+		if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, tc.key, "challenge"), "", tc.kid, now); err != nil {
+			t.Errorf("Verification with kid %q failed during the grace period: %v", tc.kid, err)
+		}
+	}
+	if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, oldKey, "challenge"), "", "2025-01", now); err == nil {
+		t.Error("Expected a signature to fail under another key's kid")
+	}
+	if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, newKey, "challenge"), "", "unknown", now); err == nil {
+		t.Error("Expected an unknown kid to be rejected")
+	}
+
+	// After the grace period only the new key verifies
+	later := now.Add(time.Hour)
+	if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, oldKey, "challenge"), "", "", later); err == nil {
+		t.Error("Expected the retired key to be rejected after the grace period")
+	}
+	if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, newKey, "challenge"), "", "", later); err != nil {
+		t.Errorf("Verification with the new key failed: %v", err)
+	}
+
+	// The same document cannot be replayed
+	if _, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, newKey, purposeMessage(ActionRotateServerKey, doc)), "", "", later); err == nil {
+		t.Error("Expected a replayed key set to be rejected")
+	}
+}
+
+func TestRotateServerKeysGraceKeyCannotSign(t *testing.T) {
+	k, anchorKey := newTestKeeper(t)
+	keyA, pemA := newServerKey(t)
+	keyB, pemB := newServerKey(t)
+	_, pemC := newServerKey(t)
+	now := time.Unix(1700000000, 0)
+
+	rotate := func(signer *rsa.PrivateKey, kid, publicKey string, issuedAt int64) error {
+		doc := keySetDocument(t, ServerKeySetDocument{Keys: []ServerKey{{Kid: kid, PublicKey: publicKey}}, IssuedAt: issuedAt})
+		_, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, signer, purposeMessage(ActionRotateServerKey, doc)), "", "", now)
+		return err
+	}
+	if err := rotate(anchorKey, "a", pemA, 1); err != nil {
+		t.Fatalf("Rotation signed by the embedded key failed: %v", err)
+	}
+	if err := rotate(keyA, "b", pemB, 2); err != nil {
+		t.Fatalf("Rotation signed by the active key failed: %v", err)
+	}
+
+	// Key a is in its grace period: it still verifies signatures, but may not rotate
+	if _, err := k.verifyServerSignatureAt("challenge", serverSign(t, keyA, "challenge"), "", "a", now); err != nil {
+		t.Fatalf("Expected the grace period key to verify signatures: %v", err)
+	}
+	if err := rotate(keyA, "c", pemC, 3); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("Expected a rotation signed by a grace period key to be rejected, got: %v", err)
+	}
+	if err := rotate(keyB, "c", pemC, 3); err != nil {
+		t.Errorf("Rotation signed by the new active key failed: %v", err)
+	}
+	if err := k.VerifyServerKey(); err != nil {
+		t.Errorf("Expected the rotated key set to pass the integrity check: %v", err)
+	}
+}
+
+func TestRotateServerKeysValidation(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+	_, pemA := newServerKey(t)
+	_, pemB := newServerKey(t)
+	now := time.Unix(1700000000, 0)
+
+	for name, doc := range map[string]ServerKeySetDocument{
+		"no keys":          {IssuedAt: 1},
+		"missing kid":      {Keys: []ServerKey{{PublicKey: pemA}}, IssuedAt: 1},
+		"duplicate kid":    {Keys: []ServerKey{{Kid: "a", PublicKey: pemA}, {Kid: "a", PublicKey: pemB}}, Active: "a", IssuedAt: 1},
+		"ambiguous active": {Keys: []ServerKey{{Kid: "a", PublicKey: pemA}, {Kid: "b", PublicKey: pemB}}, IssuedAt: 1},
+		"not rsa":          {Keys: []ServerKey{{Kid: "a", PublicKey: "not a key"}}, IssuedAt: 1},
+		"grace too long":   {Keys: []ServerKey{{Kid: "a", PublicKey: pemA}}, IssuedAt: 1, GracePeriod: MaxServerKeyGracePeriod + 1},
+	} {
+		data := keySetDocument(t, doc)
+		if _, err := k.rotateServerKeys(ActionRotateServerKey, data, serverSign(t, serverKey, purposeMessage(ActionRotateServerKey, data)), "", "", now); err == nil {
+			t.Errorf("Expected key set with %s to be rejected", name)
+		}
+	}
+}
+
+func TestEnsureServerPublicKey(t *testing.T) {
+	// First run trusts the embedded key
+	k := NewKeeper(NewMemoryStore())
+	if err := k.EnsureServerPublicKey(); err != nil {
+		t.Fatalf("EnsureServerPublicKey failed: %v", err)
+	}
+	set, err := k.loadServerKeySet()
+	if err != nil {
+		t.Fatalf("loadServerKeySet failed: %v", err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kid != set.Active {
+		t.Errorf("Unexpected key set: %+v", set)
+	}
+
+	// A server key stored before rotation existed is kept
+	k, _ = newTestKeeper(t)
+	storedPEM, _ := k.getServerPublicKey()
+	if err := k.EnsureServerPublicKey(); err != nil {
+		t.Fatalf("EnsureServerPublicKey failed: %v", err)
+	}
+	if _, err := k.store.Get(config.DragPassServerKeySet); err != nil {
+		t.Fatalf("Expected a key set to be stored: %v", err)
+	}
+	set, _ = k.loadServerKeySet()
+	if active, _ := set.lookup(set.Active); active.PublicKey != storedPEM {
+		t.Error("Expected the stored server key to stay active")
+	}
+}
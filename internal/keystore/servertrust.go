@@ -0,0 +1,152 @@
+package keystore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// ErrServerKeyTampered reports stored server keys that do not lead back to the
+// embedded or pinned server keys, e.g. because another program rewrote them
+var ErrServerKeyTampered = errors.New("stored server key is not trusted")
+
+// checkServerKeyIntegrity verifies that the stored key set derives from the trust anchors:
+// every rotation must be signed by a pinned key or the key the rotation before made active,
+// every stored key must come from an anchor or a rotation, and the server public key item
+// must mirror the active key. It returns the key set when it can be trusted.
+func (k *Keeper) checkServerKeyIntegrity() (*ServerKeySet, error) {
+	set, err := k.loadServerKeySet()
+	if err != nil {
+		return nil, err
+	}
+
+	anchorPEM, err := k.anchorServerKey()
+	if err != nil {
+		return nil, err
+	}
+	anchorFingerprint, err := FingerprintPEM(anchorPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint hardcoded server public key: %v", err)
+	}
+	pinned := map[string]bool{anchorFingerprint: true}
+	for _, fingerprint := range k.serverKeyPins {
+		pinned[fingerprint] = true
+	}
+	isPinned := func(publicKeyPEM string) bool {
+		fingerprint, err := FingerprintPEM(publicKeyPEM)
+		return err == nil && pinned[fingerprint]
+	}
+
+	// Replay the rotations from the pinned keys
+	introduced := map[string]string{}
+	active := ""
+	var issuedAt int64
+	for i, rotation := range set.Rotations {
+		// Keys in their grace period may not sign rotations, only the active one
+		signerPEM, ok := introduced[rotation.Kid]
+		ok = ok && rotation.Kid == active
+		if !ok {
+			if rotation.Kid == anchorFingerprint {
+				signerPEM, ok = anchorPEM, true
+			} else if key, found := set.lookup(rotation.Kid); found && isPinned(key.PublicKey) {
+				signerPEM, ok = key.PublicKey, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: rotation %d is signed by unknown key %s", ErrServerKeyTampered, i+1, rotation.Kid)
+		}
+
+		signerKey, err := parseServerPublicKey(signerPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rotation %d signer: %v", ErrServerKeyTampered, i+1, err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(rotation.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rotation %d signature: %v", ErrServerKeyTampered, i+1, err)
+		}
+		if err := VerifySignatureWithScheme(signerKey, rotation.Scheme, purposeMessage(ActionRotateServerKey, rotation.KeySet), signature); err != nil {
+			return nil, fmt.Errorf("%w: rotation %d: %v", ErrServerKeyTampered, i+1, err)
+		}
+
+		var doc ServerKeySetDocument
+		if err := json.Unmarshal([]byte(rotation.KeySet), &doc); err != nil {
+			return nil, fmt.Errorf("%w: rotation %d key set: %v", ErrServerKeyTampered, i+1, err)
+		}
+		if err := doc.validate(); err != nil {
+			return nil, fmt.Errorf("%w: rotation %d key set: %v", ErrServerKeyTampered, i+1, err)
+		}
+		if doc.IssuedAt <= issuedAt {
+			return nil, fmt.Errorf("%w: rotation %d is not newer than the one before", ErrServerKeyTampered, i+1)
+		}
+		for _, key := range doc.Keys {
+			if previous, ok := introduced[key.Kid]; ok && !samePublicKey(previous, key.PublicKey) {
+				return nil, fmt.Errorf("%w: rotation %d reuses kid %s", ErrServerKeyTampered, i+1, key.Kid)
+			}
+			introduced[key.Kid] = key.PublicKey
+		}
+		active, issuedAt = doc.Active, doc.IssuedAt
+	}
+
+	if set.IssuedAt != issuedAt {
+		return nil, fmt.Errorf("%w: key set issued_at does not match its rotations", ErrServerKeyTampered)
+	}
+	for _, key := range set.Keys {
+		if introducedPEM, ok := introduced[key.Kid]; ok && samePublicKey(introducedPEM, key.PublicKey) {
+			continue
+		}
+		if !isPinned(key.PublicKey) {
+			return nil, fmt.Errorf("%w: key %s is neither pinned nor introduced by a signed rotation", ErrServerKeyTampered, key.Kid)
+		}
+	}
+
+	activeKey, _ := set.lookup(set.Active)
+	if len(set.Rotations) > 0 && set.Active != active {
+		return nil, fmt.Errorf("%w: active key %s is not the one named by the last rotation", ErrServerKeyTampered, set.Active)
+	}
+	if len(set.Rotations) == 0 && !isPinned(activeKey.PublicKey) {
+		return nil, fmt.Errorf("%w: active key %s is not pinned", ErrServerKeyTampered, set.Active)
+	}
+
+	mirrored, err := k.getServerPublicKey()
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && !samePublicKey(mirrored, activeKey.PublicKey) {
+		return nil, fmt.Errorf("%w: %s does not match the active key", ErrServerKeyTampered, config.DragPassServerPublicKey)
+	}
+
+	return set, nil
+}
+
+// loadTrustedServerKeySet returns the key set after the integrity check,
+// recording an audit event when the check finds tampering
+func (k *Keeper) loadTrustedServerKeySet() (*ServerKeySet, error) {
+	set, err := k.checkServerKeyIntegrity()
+	if errors.Is(err, ErrServerKeyTampered) {
+		k.audit(AuditServerKeyTampered, err.Error())
+	}
+	return set, err
+}
+
+// VerifyServerKey checks the stored server keys against the embedded and pinned keys.
+// Run at startup; tampering is also caught before every server signature verification.
+func (k *Keeper) VerifyServerKey() error {
+	_, err := k.loadTrustedServerKeySet()
+	return err
+}
+
+// restoreServerKey replaces the stored key set with the embedded server key alone
+func (k *Keeper) restoreServerKey(tx *transaction) error {
+	anchorPEM, err := k.anchorServerKey()
+	if err != nil {
+		return err
+	}
+	set, err := newServerKeySet(anchorPEM)
+	if err != nil {
+		return err
+	}
+	return stageServerKeySet(tx, set)
+}
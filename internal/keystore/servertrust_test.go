@@ -0,0 +1,149 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// recordAudit collects the keeper's audit events
+func recordAudit(k *Keeper) *[]AuditEvent {
+	events := &[]AuditEvent{}
+	k.auditSink = func(event AuditEvent) { *events = append(*events, event) }
+	return events
+}
+
+func TestServerKeyTamperingDetected(t *testing.T) {
+	k, serverKey := newTestKeeper(t)
+	if err := k.EnsureServerPublicKey(); err != nil {
+		t.Fatalf("EnsureServerPublicKey failed: %v", err)
+	}
+	if err := k.VerifyServerKey(); err != nil {
+		t.Fatalf("Expected the anchored key to be trusted: %v", err)
+	}
+	events := recordAudit(k)
+
+	// Another program swaps in its own key
+	attackerKey, attackerPEM := newServerKey(t)
+	set, _ := newServerKeySet(attackerPEM)
+	if err := k.saveServerKeySet(set); err != nil {
+		t.Fatalf("Failed to save key set: %v", err)
+	}
+
+	if err := k.VerifyServerKey(); !errors.Is(err, ErrServerKeyTampered) {
+		t.Fatalf("Expected ErrServerKeyTampered, got: %v", err)
+	}
+	resp := k.HandleGenerateKeypair(GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, attackerKey, purposeMessage(ActionGenerateKeypair, "challenge")),
+		purpose:        ActionGenerateKeypair,
+	})
+	if resp.Success || resp.Code != ErrorCodeServerKeyTampered {
+		t.Errorf("Expected %s, got success=%v code=%q error=%q", ErrorCodeServerKeyTampered, resp.Success, resp.Code, resp.Error)
+	}
+	if len(*events) != 2 || (*events)[0].Event != AuditServerKeyTampered {
+		t.Errorf("Expected two %s audit events, got: %+v", AuditServerKeyTampered, *events)
+	}
+
+	report, err := k.CheckState()
+	if err != nil {
+		t.Fatalf("CheckState failed: %v", err)
+	}
+	if report.State != StateCorrupt || len(report.Repairs) != 1 || report.Repairs[0] != RepairRestoreServerKey {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	if err := k.Repair(RepairRestoreServerKey); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if last := (*events)[len(*events)-1]; last.Event != AuditServerKeyRestored {
+		t.Errorf("Expected a %s audit event, got: %+v", AuditServerKeyRestored, last)
+	}
+	resp = k.HandleGenerateKeypair(GenerateKeypairRequest{
+		ChallengeToken: "challenge",
+		Signature:      serverSign(t, serverKey, purposeMessage(ActionGenerateKeypair, "challenge")),
+		purpose:        ActionGenerateKeypair,
+	})
+	if !resp.Success {
+		t.Fatalf("GenerateKeypair failed after restoring the server key: %s", resp.Error)
+	}
+	if err := k.Repair(RepairRestoreServerKey); err == nil {
+		t.Error("Expected restore_server_key to be refused when nothing is tampered")
+	}
+}
+
+func TestServerKeyIntegrity(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	_, otherPEM := newServerKey(t)
+
+	// rotated returns a keeper that went through one signed rotation
+	rotated := func(t *testing.T) *Keeper {
+		k, serverKey := newTestKeeper(t)
+		_, newPEM := newServerKey(t)
+		doc := keySetDocument(t, ServerKeySetDocument{Keys: []ServerKey{{Kid: "next", PublicKey: newPEM}}, IssuedAt: now.Unix()})
+		if _, err := k.rotateServerKeys(ActionRotateServerKey, doc, serverSign(t, serverKey, purposeMessage(ActionRotateServerKey, doc)), "", "", now); err != nil {
+			t.Fatalf("rotateServerKeys failed: %v", err)
+		}
+		if err := k.VerifyServerKey(); err != nil {
+			t.Fatalf("Expected the rotated key set to be trusted: %v", err)
+		}
+		return k
+	}
+	editSet := func(t *testing.T, k *Keeper, edit func(*ServerKeySet)) {
+		set, _ := k.loadServerKeySet()
+		edit(set)
+		data, _ := json.Marshal(set)
+		_ = k.store.Set(config.DragPassServerKeySet, string(data))
+	}
+
+	tests := map[string]func(t *testing.T, k *Keeper){
+		"swapped key": func(t *testing.T, k *Keeper) {
+			editSet(t, k, func(s *ServerKeySet) { s.Keys[0].PublicKey = otherPEM })
+		},
+		"added key": func(t *testing.T, k *Keeper) {
+			editSet(t, k, func(s *ServerKeySet) { s.Keys = append(s.Keys, ServerKey{Kid: "extra", PublicKey: otherPEM}) })
+		},
+		"dropped rotation": func(t *testing.T, k *Keeper) {
+			editSet(t, k, func(s *ServerKeySet) { s.Rotations = nil })
+		},
+		"forged rotation": func(t *testing.T, k *Keeper) {
+			editSet(t, k, func(s *ServerKeySet) { s.Rotations[0].KeySet += " " })
+		},
+		"switched active": func(t *testing.T, k *Keeper) {
+			editSet(t, k, func(s *ServerKeySet) { s.Active = s.Keys[1].Kid })
+		},
+		"mirror": func(t *testing.T, k *Keeper) {
+			_ = k.saveServerPublicKey(otherPEM)
+		},
+		"garbage": func(t *testing.T, k *Keeper) {
+			_ = k.store.Set(config.DragPassServerKeySet, "{")
+		},
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			k := rotated(t)
+			k.auditSink = nil
+			tamper(t, k)
+			if err := k.VerifyServerKey(); !errors.Is(err, ErrServerKeyTampered) {
+				t.Errorf("Expected ErrServerKeyTampered, got: %v", err)
+			}
+		})
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		k, _ := newTestKeeper(t)
+		_ = k.saveServerPublicKey(otherPEM)
+		k.auditSink = nil
+		if err := k.VerifyServerKey(); !errors.Is(err, ErrServerKeyTampered) {
+			t.Fatalf("Expected ErrServerKeyTampered, got: %v", err)
+		}
+		fingerprint, _ := FingerprintPEM(otherPEM)
+		k.serverKeyPins = []string{fingerprint}
+		if err := k.VerifyServerKey(); err != nil {
+			t.Errorf("Expected a pinned key to be trusted: %v", err)
+		}
+	})
+}
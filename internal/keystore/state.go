@@ -0,0 +1,279 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// Overall keystore states reported by checkstate
+const (
+	StateUnregistered  = "unregistered"
+	StatePendingSignup = "pending_signup"
+	// StatePendingSession is a login on another device between generatekeypair and savesessioncode
+	StatePendingSession = "pending_session"
+	StateRegistered     = "registered"
+	StateCorrupt        = "corrupt"
+)
+
+// Repair operations accepted by repairstate
+const (
+	// RepairDiscardPending deletes the pending signup keypair
+	RepairDiscardPending = "discard_pending"
+	// RepairDiscardSession deletes a session code that has no keypair to go with it
+	RepairDiscardSession = "discard_session"
+	// RepairResetKeypair deletes the keypair, pending keypair and session code,
+	// returning the device to the unregistered state
+	RepairResetKeypair = "reset_keypair"
+	// RepairRestoreServerKey replaces the stored server keys with the embedded server key
+	RepairRestoreServerKey = "restore_server_key"
+)
+
+// Issue codes found by the consistency check
+const (
+	IssueKeypairIncomplete     = "keypair_incomplete"
+	IssueKeypairMismatch       = "keypair_mismatch"
+	IssueKeypairUnreadable     = "keypair_unreadable"
+	IssueFingerprintMismatch   = "fingerprint_mismatch"
+	IssueSessionWithoutKeypair = "session_without_keypair"
+	IssuePendingIncomplete     = "pending_incomplete"
+	IssuePendingMismatch       = "pending_mismatch"
+	IssuePendingStale          = "pending_stale"
+	IssueServerKeyTampered     = "server_key_tampered"
+)
+
+type StateIssue struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	// Repair is the operation that resolves the issue
+	Repair string `json:"repair"`
+	// Automatic issues are repaired at startup without asking
+	Automatic bool `json:"automatic"`
+}
+
+type StateReport struct {
+	State   string       `json:"state"`
+	Items   []string     `json:"items"`
+	Issues  []StateIssue `json:"issues"`
+	Repairs []string     `json:"repairs"`
+}
+
+// keystoreSnapshot holds the raw values the consistency check works on
+type keystoreSnapshot struct {
+	privateKey, publicKey, fingerprint                      string
+	pendingPrivateKey, pendingPublicKey, pendingFingerprint string
+	sessionCode                                             string
+}
+
+func (k *Keeper) snapshot() (*keystoreSnapshot, error) {
+	s := &keystoreSnapshot{}
+	targets := map[string]*string{
+		config.DragPassKeeperPrivateKey:        &s.privateKey,
+		config.DragPassKeeperPublicKey:         &s.publicKey,
+		config.PendingDragPassKeeperPrivateKey: &s.pendingPrivateKey,
+		config.PendingDragPassKeeperPublicKey:  &s.pendingPublicKey,
+		config.SessionCode:                     &s.sessionCode,
+
+		config.DragPassKeeperPublicKeyFingerprint:        &s.fingerprint,
+		config.PendingDragPassKeeperPublicKeyFingerprint: &s.pendingFingerprint,
+	}
+	for item, target := range targets {
+		value, err := k.store.Get(item)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", item, err)
+		}
+		*target = value
+	}
+	return s, nil
+}
+
+// CheckState inspects the stored items and classifies the keystore
+func (k *Keeper) CheckState() (*StateReport, error) {
+	s, err := k.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	items, err := k.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items: %w", err)
+	}
+
+	report := &StateReport{Items: items, Issues: []StateIssue{}, Repairs: []string{}}
+	addIssue := func(code, description, repair string, automatic bool) {
+		report.Issues = append(report.Issues, StateIssue{Code: code, Description: description, Repair: repair, Automatic: automatic})
+		for _, r := range report.Repairs {
+			if r == repair {
+				return
+			}
+		}
+		report.Repairs = append(report.Repairs, repair)
+	}
+
+	hasKeypair := s.privateKey != "" && s.publicKey != ""
+	hasPending := s.pendingPrivateKey != "" && s.pendingPublicKey != ""
+	hasSession := s.sessionCode != ""
+	corrupt := false
+
+	switch {
+	case (s.privateKey == "") != (s.publicKey == ""):
+		addIssue(IssueKeypairIncomplete, "only one half of the keeper keypair is stored", RepairResetKeypair, false)
+		corrupt = true
+	case hasKeypair:
+		if err := checkKeypairMatches(s.privateKey, s.publicKey); err != nil {
+			code := IssueKeypairMismatch
+			if !errors.Is(err, errKeypairMismatch) {
+				code = IssueKeypairUnreadable
+			}
+			addIssue(code, err.Error(), RepairResetKeypair, false)
+			corrupt = true
+		} else if !fingerprintMatches(s.publicKey, s.fingerprint) {
+			addIssue(IssueFingerprintMismatch, "stored fingerprint does not match the keeper public key", RepairResetKeypair, false)
+			corrupt = true
+		}
+	}
+
+	switch {
+	case (s.pendingPrivateKey == "") != (s.pendingPublicKey == ""):
+		addIssue(IssuePendingIncomplete, "only one half of the pending keypair is stored", RepairDiscardPending, true)
+	case hasPending && (checkKeypairMatches(s.pendingPrivateKey, s.pendingPublicKey) != nil || !fingerprintMatches(s.pendingPublicKey, s.pendingFingerprint)):
+		addIssue(IssuePendingMismatch, "pending keypair halves do not belong together", RepairDiscardPending, true)
+	case hasPending && hasKeypair && hasSession:
+		addIssue(IssuePendingStale, "pending keypair left over on a registered device", RepairDiscardPending, true)
+	}
+
+	if hasSession && s.privateKey == "" && s.publicKey == "" {
+		addIssue(IssueSessionWithoutKeypair, "session code stored without a keypair", RepairDiscardSession, false)
+		corrupt = true
+	}
+
+	if _, err := k.checkServerKeyIntegrity(); errors.Is(err, ErrServerKeyTampered) {
+		addIssue(IssueServerKeyTampered, err.Error(), RepairRestoreServerKey, false)
+		corrupt = true
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to check server key: %w", err)
+	}
+
+	switch {
+	case corrupt:
+		report.State = StateCorrupt
+	case hasKeypair && hasSession:
+		report.State = StateRegistered
+	case hasKeypair:
+		report.State = StatePendingSession
+	case hasPending:
+		report.State = StatePendingSignup
+	default:
+		report.State = StateUnregistered
+	}
+
+	return report, nil
+}
+
+// fingerprintMatches reports whether fingerprint belongs to the public key.
+// A missing fingerprint is accepted; it is backfilled on first use of the keypair.
+func fingerprintMatches(publicKeyPEM, fingerprint string) bool {
+	if fingerprint == "" {
+		return true
+	}
+	derived, err := FingerprintPEM(publicKeyPEM)
+	return err == nil && derived == fingerprint
+}
+
+// Repair applies one repair operation. Only operations offered by CheckState are accepted.
+// The state is checked again under the transaction lock, so a transaction another process
+// is committing is never mistaken for damage and repaired away.
+func (k *Keeper) Repair(operation string) error {
+	unlock, err := lockTransactions(k.store)
+	if err != nil {
+		return fmt.Errorf("failed to lock keystore transactions: %w", err)
+	}
+	defer unlock()
+
+	report, err := k.CheckState()
+	if err != nil {
+		return err
+	}
+	offered := false
+	for _, r := range report.Repairs {
+		if r == operation {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return invalidField("repair", "repair %q is not applicable in state %s", operation, report.State)
+	}
+
+	tx := newTransaction(k.store)
+	switch operation {
+	case RepairDiscardPending:
+		tx.Delete(config.PendingDragPassKeeperPrivateKey)
+		tx.Delete(config.PendingDragPassKeeperPublicKey)
+		tx.Delete(config.PendingDragPassKeeperPublicKeyFingerprint)
+	case RepairDiscardSession:
+		tx.Delete(config.SessionCode)
+	case RepairResetKeypair:
+		tx.Delete(config.DragPassKeeperPrivateKey)
+		tx.Delete(config.DragPassKeeperPublicKey)
+		tx.Delete(config.DragPassKeeperPublicKeyFingerprint)
+		tx.Delete(config.PendingDragPassKeeperPrivateKey)
+		tx.Delete(config.PendingDragPassKeeperPublicKey)
+		tx.Delete(config.PendingDragPassKeeperPublicKeyFingerprint)
+		tx.Delete(config.SessionCode)
+	case RepairRestoreServerKey:
+		if err := k.restoreServerKey(tx); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown repair %q", operation)
+	}
+	if err := tx.commitLocked(); err != nil {
+		return err
+	}
+
+	if operation == RepairRestoreServerKey {
+		k.audit(AuditServerKeyRestored, "stored server keys replaced with the embedded server key")
+	}
+	return nil
+}
+
+// ReconcileState runs the consistency check at startup and applies the repairs that are
+// always safe. Issues that need a decision are only logged.
+func (k *Keeper) ReconcileState() (*StateReport, error) {
+	report, err := k.CheckState()
+	if err != nil {
+		return nil, err
+	}
+
+	repaired := false
+	for _, issue := range report.Issues {
+		if !issue.Automatic {
+			log.Printf("keystore issue: %s (%s), repair with %q", issue.Code, issue.Description, issue.Repair)
+			continue
+		}
+		var notOffered *FieldError
+		switch err := k.Repair(issue.Repair); {
+		case errors.As(err, &notOffered):
+			// Another keeper finished its transaction or repaired the issue since the check
+			log.Printf("keystore issue resolved meanwhile: %s (%s)", issue.Code, issue.Description)
+		case err != nil:
+			return nil, fmt.Errorf("automatic repair %s failed: %w", issue.Repair, err)
+		default:
+			log.Printf("keystore issue repaired: %s (%s)", issue.Code, issue.Description)
+		}
+		repaired = true
+	}
+
+	if repaired {
+		if report, err = k.CheckState(); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("keystore state: %s", report.State)
+	return report, nil
+}
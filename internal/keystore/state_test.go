@@ -0,0 +1,214 @@
+package keystore
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+func TestCheckState(t *testing.T) {
+	first, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	second, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		items      map[string]string
+		wantState  string
+		wantIssues []string
+	}{
+		{
+			name:      "empty store",
+			items:     map[string]string{},
+			wantState: StateUnregistered,
+		},
+		{
+			name: "pending signup",
+			items: map[string]string{
+				config.PendingDragPassKeeperPrivateKey: first.PrivateKey,
+				config.PendingDragPassKeeperPublicKey:  first.PublicKey,
+			},
+			wantState: StatePendingSignup,
+		},
+		{
+			name: "registered",
+			items: map[string]string{
+				config.DragPassKeeperPrivateKey: first.PrivateKey,
+				config.DragPassKeeperPublicKey:  first.PublicKey,
+				config.SessionCode:              "session",
+			},
+			wantState: StateRegistered,
+		},
+		{
+			name: "mismatched keypair",
+			items: map[string]string{
+				config.DragPassKeeperPrivateKey: first.PrivateKey,
+				config.DragPassKeeperPublicKey:  second.PublicKey,
+				config.SessionCode:              "session",
+			},
+			wantState:  StateCorrupt,
+			wantIssues: []string{IssueKeypairMismatch},
+		},
+		{
+			name: "session without keypair",
+			items: map[string]string{
+				config.SessionCode: "session",
+			},
+			wantState:  StateCorrupt,
+			wantIssues: []string{IssueSessionWithoutKeypair},
+		},
+		{
+			name: "stale pending on registered device",
+			items: map[string]string{
+				config.DragPassKeeperPrivateKey:        first.PrivateKey,
+				config.DragPassKeeperPublicKey:         first.PublicKey,
+				config.SessionCode:                     "session",
+				config.PendingDragPassKeeperPrivateKey: second.PrivateKey,
+				config.PendingDragPassKeeperPublicKey:  second.PublicKey,
+			},
+			wantState:  StateRegistered,
+			wantIssues: []string{IssuePendingStale},
+		},
+		{
+			name: "keypair without session",
+			items: map[string]string{
+				config.DragPassKeeperPrivateKey: first.PrivateKey,
+				config.DragPassKeeperPublicKey:  first.PublicKey,
+			},
+			wantState: StatePendingSession,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			for item, value := range tt.items {
+				_ = store.Set(item, value)
+			}
+
+			report, err := NewKeeper(store).CheckState()
+			if err != nil {
+				t.Fatalf("CheckState failed: %v", err)
+			}
+			if report.State != tt.wantState {
+				t.Errorf("State mismatch.\nGot: %s\nWant: %s", report.State, tt.wantState)
+			}
+			if len(report.Issues) != len(tt.wantIssues) {
+				t.Fatalf("Issues mismatch.\nGot: %+v\nWant: %v", report.Issues, tt.wantIssues)
+			}
+			for i, issue := range report.Issues {
+				if issue.Code != tt.wantIssues[i] {
+					t.Errorf("Issue %d mismatch.\nGot: %s\nWant: %s", i, issue.Code, tt.wantIssues[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileStateRepairsOnlyAutomaticIssues(t *testing.T) {
+	pair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	store := NewMemoryStore()
+	_ = store.Set(config.PendingDragPassKeeperPrivateKey, pair.PrivateKey)
+	_ = store.Set(config.SessionCode, "session")
+	k := NewKeeper(store)
+
+	report, err := k.ReconcileState()
+	if err != nil {
+		t.Fatalf("ReconcileState failed: %v", err)
+	}
+	if _, err := store.Get(config.PendingDragPassKeeperPrivateKey); err == nil {
+		t.Error("Expected incomplete pending keypair to be discarded")
+	}
+	if report.State != StateCorrupt || len(report.Repairs) != 1 || report.Repairs[0] != RepairDiscardSession {
+		t.Fatalf("Expected orphaned session to remain for guided repair, got: %+v", report)
+	}
+
+	if err := k.Repair(RepairResetKeypair); err == nil {
+		t.Error("Expected a repair that is not offered to be refused")
+	}
+	if err := k.Repair(RepairDiscardSession); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report, _ := k.CheckState(); report.State != StateUnregistered {
+		t.Errorf("State after repair mismatch.\nGot: %s\nWant: %s", report.State, StateUnregistered)
+	}
+}
+
+// pausingStore holds up the first write of item until resume is closed, closing paused when it starts
+type pausingStore struct {
+	*lockedStore
+	item           string
+	once           sync.Once
+	paused, resume chan struct{}
+}
+
+func (s *pausingStore) Set(item, value string) error {
+	if item == s.item {
+		s.once.Do(func() {
+			close(s.paused)
+			<-s.resume
+		})
+	}
+	return s.lockedStore.Set(item, value)
+}
+
+func TestRepairWaitsForTransactionInProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keeper.lock")
+	base := NewMemoryStore()
+	keyPair, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	// One keeper is applying its pending keypair: the private half is written, the public half not yet
+	writer := &pausingStore{
+		lockedStore: &lockedStore{SecretStore: base, path: path},
+		item:        config.PendingDragPassKeeperPublicKey,
+		paused:      make(chan struct{}),
+		resume:      make(chan struct{}),
+	}
+	saved := make(chan error, 1)
+	go func() { saved <- NewKeeper(writer).savePendingKeypair(keyPair) }()
+	<-writer.paused
+
+	// Another keeper starting now sees a half written pending keypair
+	k := NewKeeper(&lockedStore{SecretStore: base, path: path})
+	report, err := k.CheckState()
+	if err != nil {
+		t.Fatalf("CheckState failed: %v", err)
+	}
+	if len(report.Repairs) != 1 || report.Repairs[0] != RepairDiscardPending {
+		t.Fatalf("Expected the half written keypair to look damaged, got: %+v", report)
+	}
+	repaired := make(chan error, 1)
+	go func() { repaired <- k.Repair(RepairDiscardPending) }()
+
+	select {
+	case err := <-repaired:
+		t.Fatalf("Repair ran while the transaction was in progress: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(writer.resume)
+	if err := <-saved; err != nil {
+		t.Fatalf("savePendingKeypair failed: %v", err)
+	}
+	if err := <-repaired; err == nil {
+		t.Error("Expected the repair to be refused once the transaction finished")
+	}
+
+	if report, err := k.CheckState(); err != nil || report.State != StatePendingSignup || len(report.Issues) != 0 {
+		t.Errorf("Expected the pending keypair to survive, got %+v: %v", report, err)
+	}
+}
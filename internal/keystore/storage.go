@@ -1,109 +1,185 @@
 package keystore
 
 import (
+	"crypto"
+	"errors"
+	"fmt"
+
 	"github.com/personalconnect/dragpass-keeper/config"
-	"github.com/zalando/go-keyring"
 )
 
 // Keypair related functions
-func savePrivateKey(privateKey string) error {
-	return keyring.Set(config.Service, config.DragPassKeeperPrivateKey, privateKey)
+func (k *Keeper) savePrivateKey(privateKey string) error {
+	return k.store.Set(config.DragPassKeeperPrivateKey, privateKey)
+}
+
+func (k *Keeper) getPrivateKey() (string, error) {
+	return k.store.Get(config.DragPassKeeperPrivateKey)
 }
 
-func getPrivateKey() (string, error) {
-	return keyring.Get(config.Service, config.DragPassKeeperPrivateKey)
+func (k *Keeper) getPublicKey() (string, error) {
+	return k.store.Get(config.DragPassKeeperPublicKey)
 }
 
-func getPublicKey() (string, error) {
-	return keyring.Get(config.Service, config.DragPassKeeperPublicKey)
+func (k *Keeper) savePublicKey(publicKey string) error {
+	return k.store.Set(config.DragPassKeeperPublicKey, publicKey)
 }
 
-func savePublicKey(publicKey string) error {
-	return keyring.Set(config.Service, config.DragPassKeeperPublicKey, publicKey)
+func (k *Keeper) getPublicKeyFingerprint() (string, error) {
+	return k.store.Get(config.DragPassKeeperPublicKeyFingerprint)
 }
 
 // Server public key related functions
-func saveServerPublicKey(serverPublicKey string) error {
-	return keyring.Set(config.Service, config.DragPassServerPublicKey, serverPublicKey)
+func (k *Keeper) saveServerPublicKey(serverPublicKey string) error {
+	return k.store.Set(config.DragPassServerPublicKey, serverPublicKey)
 }
 
-func getServerPublicKey() (string, error) {
-	return keyring.Get(config.Service, config.DragPassServerPublicKey)
+func (k *Keeper) getServerPublicKey() (string, error) {
+	return k.store.Get(config.DragPassServerPublicKey)
 }
 
 // Device key related functions
-func saveDeviceKey(key string) error {
-	return keyring.Set(config.Service, config.DeviceKey, key)
+func (k *Keeper) saveDeviceKey(key string) error {
+	return k.store.Set(config.DeviceKey, key)
 }
 
-func getDeviceKey() (string, error) {
-	secret, err := keyring.Get(config.Service, config.DeviceKey)
-	return secret, err
+func (k *Keeper) getDeviceKey() (string, error) {
+	return k.store.Get(config.DeviceKey)
 }
 
-func deleteDeviceKey() error {
-	return keyring.Delete(config.Service, config.DeviceKey)
+func (k *Keeper) deleteDeviceKey() error {
+	return k.store.Delete(config.DeviceKey)
 }
 
 // Session code related functions
-func saveSessionCode(sessionCode string) error {
-	return keyring.Set(config.Service, config.SessionCode, sessionCode)
+func (k *Keeper) saveSessionCode(sessionCode string) error {
+	return k.store.Set(config.SessionCode, sessionCode)
 }
 
-func getSessionCode() (string, error) {
-	return keyring.Get(config.Service, config.SessionCode)
+func (k *Keeper) getSessionCode() (string, error) {
+	return k.store.Get(config.SessionCode)
 }
 
-func deleteSessionCode() error {
-	return keyring.Delete(config.Service, config.SessionCode)
+func (k *Keeper) deleteSessionCode() error {
+	return k.store.Delete(config.SessionCode)
 }
 
-func savePendingPrivateKey(privateKey string) error {
-	return keyring.Set(config.Service, config.PendingDragPassKeeperPrivateKey, privateKey)
+func (k *Keeper) getPendingPrivateKey() (string, error) {
+	return k.store.Get(config.PendingDragPassKeeperPrivateKey)
 }
 
-func getPendingPrivateKey() (string, error) {
-	return keyring.Get(config.Service, config.PendingDragPassKeeperPrivateKey)
+func (k *Keeper) getPendingPublicKey() (string, error) {
+	return k.store.Get(config.PendingDragPassKeeperPublicKey)
 }
 
-func savePendingPublicKey(publicKey string) error {
-	return keyring.Set(config.Service, config.PendingDragPassKeeperPublicKey, publicKey)
+func (k *Keeper) getPendingPublicKeyFingerprint() (string, error) {
+	return k.store.Get(config.PendingDragPassKeeperPublicKeyFingerprint)
 }
 
-func getPendingPublicKey() (string, error) {
-	return keyring.Get(config.Service, config.PendingDragPassKeeperPublicKey)
+// replaceKeypair atomically installs a new active keypair and drops the session code bound to the old one
+func (k *Keeper) replaceKeypair(keyPair *KeyPair) error {
+	tx := newTransaction(k.store)
+	tx.Set(config.DragPassKeeperPrivateKey, keyPair.PrivateKey)
+	tx.Set(config.DragPassKeeperPublicKey, keyPair.PublicKey)
+	tx.Set(config.DragPassKeeperPublicKeyFingerprint, keyPair.Fingerprint)
+	tx.Delete(config.SessionCode)
+	return tx.Commit()
 }
 
-func deletePendingPrivateKey() error {
-	return keyring.Delete(config.Service, config.PendingDragPassKeeperPrivateKey)
-}
-
-func deletePendingPublicKey() error {
-	return keyring.Delete(config.Service, config.PendingDragPassKeeperPublicKey)
+// savePendingKeypair atomically stores a keypair awaiting signup confirmation
+func (k *Keeper) savePendingKeypair(keyPair *KeyPair) error {
+	tx := newTransaction(k.store)
+	tx.Set(config.PendingDragPassKeeperPrivateKey, keyPair.PrivateKey)
+	tx.Set(config.PendingDragPassKeeperPublicKey, keyPair.PublicKey)
+	tx.Set(config.PendingDragPassKeeperPublicKeyFingerprint, keyPair.Fingerprint)
+	return tx.Commit()
 }
 
 // promotePendingKeypair moves pending keypair to permanent storage
-func promotePendingKeypair() (bool, error) {
-	pendingPrivateKey, privErr := getPendingPrivateKey()
-	pendingPublicKey, pubErr := getPendingPublicKey()
+func (k *Keeper) promotePendingKeypair() (bool, error) {
+	pendingPrivateKey, privErr := k.getPendingPrivateKey()
+	pendingPublicKey, pubErr := k.getPendingPublicKey()
 
 	// No pending keypair exists
 	if privErr != nil || pubErr != nil {
 		return false, nil
 	}
 
-	// Change status pending to active
-	if err := savePrivateKey(pendingPrivateKey); err != nil {
+	// Pending keypairs saved before fingerprints existed get one computed here
+	pendingFingerprint, err := k.getPendingPublicKeyFingerprint()
+	if errors.Is(err, ErrNotFound) {
+		pendingFingerprint, err = FingerprintPEM(pendingPublicKey)
+	}
+	if err != nil {
 		return false, err
 	}
 
-	if err := savePublicKey(pendingPublicKey); err != nil {
+	// Change status pending to active and delete pending keypair in one step
+	tx := newTransaction(k.store)
+	tx.Set(config.DragPassKeeperPrivateKey, pendingPrivateKey)
+	tx.Set(config.DragPassKeeperPublicKey, pendingPublicKey)
+	tx.Set(config.DragPassKeeperPublicKeyFingerprint, pendingFingerprint)
+	tx.Delete(config.PendingDragPassKeeperPrivateKey)
+	tx.Delete(config.PendingDragPassKeeperPublicKey)
+	tx.Delete(config.PendingDragPassKeeperPublicKeyFingerprint)
+	if err := tx.Commit(); err != nil {
 		return false, err
 	}
 
-	// Delete pending keypair
-	_ = deletePendingPrivateKey()
-	_ = deletePendingPublicKey()
-
 	return true, nil
 }
+
+// loadPrivateKey returns the active private key after checking it against the stored fingerprint.
+// A missing private key is reported as ErrNotRegistered.
+func (k *Keeper) loadPrivateKey() (crypto.Signer, error) {
+	privateKey, err := k.loadCheckedPrivateKey(config.DragPassKeeperPrivateKey, config.DragPassKeeperPublicKey, config.DragPassKeeperPublicKeyFingerprint)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: %w", ErrNotRegistered, err)
+	}
+	return privateKey, err
+}
+
+// loadPendingPrivateKey returns the pending private key after checking it against the stored fingerprint
+func (k *Keeper) loadPendingPrivateKey() (crypto.Signer, error) {
+	return k.loadCheckedPrivateKey(config.PendingDragPassKeeperPrivateKey, config.PendingDragPassKeeperPublicKey, config.PendingDragPassKeeperPublicKeyFingerprint)
+}
+
+// loadCheckedPrivateKey refuses a private key whose derived public key does not match the stored fingerprint.
+// Keypairs stored before fingerprints existed get one backfilled, provided the stored public key matches.
+func (k *Keeper) loadCheckedPrivateKey(privateItem, publicItem, fingerprintItem string) (crypto.Signer, error) {
+	privateKeyPEM, err := k.store.Get(privateItem)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ParsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := k.store.Get(fingerprintItem)
+	if errors.Is(err, ErrNotFound) {
+		publicKeyPEM, err := k.store.Get(publicItem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get public key for fingerprint: %w", err)
+		}
+		if fingerprint, err = FingerprintPEM(publicKeyPEM); err != nil {
+			return nil, err
+		}
+		if err := checkPrivateKeyFingerprint(privateKey, fingerprint); err != nil {
+			return nil, err
+		}
+		if err := k.store.Set(fingerprintItem, fingerprint); err != nil {
+			return nil, fmt.Errorf("failed to save public key fingerprint: %w", err)
+		}
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPrivateKeyFingerprint(privateKey, fingerprint); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
@@ -1,24 +1,19 @@
 package keystore
 
 import (
+	"errors"
 	"testing"
-
-	"github.com/zalando/go-keyring"
 )
 
-func TestMain(m *testing.M) {
-	keyring.MockInit()
-	m.Run()
-}
-
 func TestPrivateKeyOperations(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
 	expectedKey := "mock-private-key-12345"
 
-	if err := savePrivateKey(expectedKey); err != nil {
+	if err := k.savePrivateKey(expectedKey); err != nil {
 		t.Fatalf("Failed to save private key: %v", err)
 	}
 
-	got, err := getPrivateKey()
+	got, err := k.getPrivateKey()
 	if err != nil {
 		t.Fatalf("Failed to get private key: %v", err)
 	}
@@ -29,13 +24,14 @@ func TestPrivateKeyOperations(t *testing.T) {
 }
 
 func TestPublicKeyOperations(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
 	expectedKey := "mock-public-key-67890"
 
-	if err := savePublicKey(expectedKey); err != nil {
+	if err := k.savePublicKey(expectedKey); err != nil {
 		t.Fatalf("Failed to save public key: %v", err)
 	}
 
-	got, err := getPublicKey()
+	got, err := k.getPublicKey()
 	if err != nil {
 		t.Fatalf("Failed to get public key: %v", err)
 	}
@@ -46,13 +42,14 @@ func TestPublicKeyOperations(t *testing.T) {
 }
 
 func TestServerPublicKeyOperations(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
 	expectedKey := "mock-server-public-key-abcde"
 
-	if err := saveServerPublicKey(expectedKey); err != nil {
+	if err := k.saveServerPublicKey(expectedKey); err != nil {
 		t.Fatalf("Failed to save server public key: %v", err)
 	}
 
-	got, err := getServerPublicKey()
+	got, err := k.getServerPublicKey()
 	if err != nil {
 		t.Fatalf("Failed to get server public key: %v", err)
 	}
@@ -63,13 +60,14 @@ func TestServerPublicKeyOperations(t *testing.T) {
 }
 
 func TestDeviceKeyOperations(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
 	expectedKey := "mock-device-key-secret"
 
-	if err := saveDeviceKey(expectedKey); err != nil {
+	if err := k.saveDeviceKey(expectedKey); err != nil {
 		t.Fatalf("Failed to save device key: %v", err)
 	}
 
-	got, err := getDeviceKey()
+	got, err := k.getDeviceKey()
 	if err != nil {
 		t.Fatalf("Failed to get device key: %v", err)
 	}
@@ -77,26 +75,27 @@ func TestDeviceKeyOperations(t *testing.T) {
 		t.Errorf("Device key mismatch.\nGot: %s\nWant: %s", got, expectedKey)
 	}
 
-	if err := deleteDeviceKey(); err != nil {
+	if err := k.deleteDeviceKey(); err != nil {
 		t.Fatalf("Failed to delete device key: %v", err)
 	}
 
-	_, err = getDeviceKey()
+	_, err = k.getDeviceKey()
 	if err == nil {
 		t.Error("Expected error after deleting device key, but got nil")
-	} else if err != keyring.ErrNotFound {
-		t.Logf("Correctly received error after deletion: %v", err)
+	} else if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deletion, got: %v", err)
 	}
 }
 
 func TestSessionCodeOperations(t *testing.T) {
+	k := NewKeeper(NewMemoryStore())
 	expectedCode := "mock-session-code-xyz"
 
-	if err := saveSessionCode(expectedCode); err != nil {
+	if err := k.saveSessionCode(expectedCode); err != nil {
 		t.Fatalf("Failed to save session code: %v", err)
 	}
 
-	got, err := getSessionCode()
+	got, err := k.getSessionCode()
 	if err != nil {
 		t.Fatalf("Failed to get session code: %v", err)
 	}
@@ -104,11 +103,11 @@ func TestSessionCodeOperations(t *testing.T) {
 		t.Errorf("Session code mismatch.\nGot: %s\nWant: %s", got, expectedCode)
 	}
 
-	if err := deleteSessionCode(); err != nil {
+	if err := k.deleteSessionCode(); err != nil {
 		t.Fatalf("Failed to delete session code: %v", err)
 	}
 
-	_, err = getSessionCode()
+	_, err = k.getSessionCode()
 	if err == nil {
 		t.Error("Expected error after deleting session code, but got nil")
 	}
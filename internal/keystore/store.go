@@ -0,0 +1,67 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by a SecretStore when the requested item does not exist
+var ErrNotFound = errors.New("secret not found")
+
+// SecretStore is the storage backend for every item the keeper persists.
+// Items are addressed by the names declared in the config package.
+type SecretStore interface {
+	Get(item string) (string, error)
+	Set(item, value string) error
+	Delete(item string) error
+	// List returns the names of the items currently present in the store
+	List() ([]string, error)
+}
+
+// storeBackend names the backend behind store as config.StoreBackendEnv does,
+// for stores that tell. Others are "unknown".
+func storeBackend(store SecretStore) string {
+	if named, ok := store.(interface{ Backend() string }); ok {
+		return named.Backend()
+	}
+	return "unknown"
+}
+
+// availabilityStore marks every backend failure other than a missing item with
+// ErrKeystoreUnavailable, so callers can tell a locked or unreachable keystore from missing data
+type availabilityStore struct {
+	SecretStore
+}
+
+func (s availabilityStore) Get(item string) (string, error) {
+	value, err := s.SecretStore.Get(item)
+	return value, markUnavailable(err)
+}
+
+func (s availabilityStore) Set(item, value string) error {
+	return markUnavailable(s.SecretStore.Set(item, value))
+}
+
+func (s availabilityStore) Delete(item string) error {
+	return markUnavailable(s.SecretStore.Delete(item))
+}
+
+func (s availabilityStore) Backend() string {
+	return storeBackend(s.SecretStore)
+}
+
+func (s availabilityStore) lockTransactions() (func(), error) {
+	return lockTransactions(s.SecretStore)
+}
+
+func (s availabilityStore) List() ([]string, error) {
+	items, err := s.SecretStore.List()
+	return items, markUnavailable(err)
+}
+
+func markUnavailable(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrKeystoreUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrKeystoreUnavailable, err)
+}
@@ -0,0 +1,350 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	vaultVersion = 1
+	vaultKDF     = "scrypt"
+	vaultCipher  = "aes-256-gcm"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// The vault file is not authenticated before the key is derived,
+	// so its scrypt parameters are bounded to keep a tampered file from exhausting memory or CPU
+	scryptMinN = 1 << 14
+	scryptMaxN = 1 << 20
+	scryptMaxR = 16
+	scryptMaxP = 4
+
+	vaultSaltSize = 16
+	vaultKeySize  = 32
+)
+
+// vaultAAD binds the ciphertext to the vault format
+var vaultAAD = []byte("dragpass-keeper-vault-v1")
+
+// vaultFile is the on-disk layout of the file vault
+type vaultFile struct {
+	Version    int            `json:"version"`
+	KDF        vaultKDFParams `json:"kdf"`
+	Cipher     string         `json:"cipher"`
+	Nonce      []byte         `json:"nonce"`
+	Ciphertext []byte         `json:"ciphertext"`
+}
+
+type vaultKDFParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// FileStore keeps items in a single AES-256-GCM encrypted file, keyed with scrypt.
+// It is meant for Linux machines without a Secret Service daemon.
+// Writes hold a lock file next to the vault, so keeper processes sharing it do not lose each other's writes.
+type FileStore struct {
+	mu         sync.Mutex
+	path       string
+	passphrase []byte
+
+	// key is derived once per salt and reused for every write
+	key  []byte
+	salt []byte
+}
+
+func NewFileStore(path string, passphrase []byte) *FileStore {
+	return &FileStore{path: path, passphrase: passphrase}
+}
+
+func (s *FileStore) Backend() string { return config.StoreBackendFile }
+
+func (s *FileStore) lockTransactions() (func(), error) { return lockFile(s.path + ".tx.lock") }
+
+// DefaultVaultPath returns the vault location under the keeper's data directory
+func DefaultVaultPath() (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, config.VaultFile), nil
+}
+
+// DataDir returns the directory holding the keeper's vaults and lock files:
+// dragpass under $XDG_DATA_HOME when set, else under the OS's per-user data directory
+func DataDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		var err error
+		if dataHome, err = userDataDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dataHome, config.VaultDir), nil
+}
+
+// vaultPassphrase returns the configured passphrase, or a machine and user bound secret.
+// The fallback only keeps the vault from being readable once copied to another machine;
+// set config.VaultPassphraseEnv for protection against local attackers.
+func vaultPassphrase(service string) ([]byte, error) {
+	if passphrase := os.Getenv(config.VaultPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	var machineID []byte
+	var err error
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if machineID, err = os.ReadFile(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no vault passphrase set and machine id unavailable: %v", err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve current user: %v", err)
+	}
+
+	return []byte(strings.TrimSpace(string(machineID)) + ":" + u.Uid + ":" + service), nil
+}
+
+func (s *FileStore) Get(item string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	value, ok := items[item]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *FileStore) Set(item, value string) error {
+	return s.update(func(items map[string]string) error {
+		items[item] = value
+		return nil
+	})
+}
+
+func (s *FileStore) Delete(item string) error {
+	return s.update(func(items map[string]string) error {
+		if _, ok := items[item]; !ok {
+			return ErrNotFound
+		}
+		delete(items, item)
+		return nil
+	})
+}
+
+// update applies modify to the vault contents and saves them, holding the vault lock
+// from the read to the write
+func (s *FileStore) update(modify func(items map[string]string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	items, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := modify(items); err != nil {
+		return err
+	}
+	return s.save(items)
+}
+
+func (s *FileStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// load reads and decrypts the vault. A missing file is an empty vault.
+func (s *FileStore) load() (map[string]string, error) {
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault: %v", err)
+	}
+
+	var vf vaultFile
+	if err := json.Unmarshal(raw, &vf); err != nil {
+		return nil, fmt.Errorf("failed to parse vault: %v", err)
+	}
+	if vf.Version != vaultVersion || vf.KDF.Name != vaultKDF || vf.Cipher != vaultCipher {
+		return nil, fmt.Errorf("unsupported vault format: version %d, kdf %s, cipher %s", vf.Version, vf.KDF.Name, vf.Cipher)
+	}
+	if err := checkKDFParams(vf.KDF); err != nil {
+		return nil, err
+	}
+
+	key, err := s.deriveKey(vf.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, vf.Nonce, vf.Ciphertext, vaultAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt vault: wrong passphrase or corrupted file")
+	}
+
+	items := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse vault contents: %v", err)
+	}
+	return items, nil
+}
+
+// save encrypts items with a fresh nonce and atomically replaces the vault
+func (s *FileStore) save(items map[string]string) error {
+	if s.key == nil {
+		salt := make([]byte, vaultSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return fmt.Errorf("failed to generate vault salt: %v", err)
+		}
+		if _, err := s.deriveKey(vaultKDFParams{Name: vaultKDF, Salt: salt, N: scryptN, R: scryptR, P: scryptP}); err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("failed to serialize vault contents: %v", err)
+	}
+
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate vault nonce: %v", err)
+	}
+
+	raw, err := json.Marshal(vaultFile{
+		Version:    vaultVersion,
+		KDF:        vaultKDFParams{Name: vaultKDF, Salt: s.salt, N: scryptN, R: scryptR, P: scryptP},
+		Cipher:     vaultCipher,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, vaultAAD),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize vault: %v", err)
+	}
+
+	return writeFileAtomic(s.path, raw)
+}
+
+// checkKDFParams rejects scrypt parameters outside the range the keeper writes
+func checkKDFParams(params vaultKDFParams) error {
+	n := params.N
+	if n < scryptMinN || n > scryptMaxN || n&(n-1) != 0 {
+		return fmt.Errorf("unsupported vault format: scrypt N %d", n)
+	}
+	if params.R < 1 || params.R > scryptMaxR || params.P < 1 || params.P > scryptMaxP {
+		return fmt.Errorf("unsupported vault format: scrypt r %d, p %d", params.R, params.P)
+	}
+	if len(params.Salt) == 0 {
+		return fmt.Errorf("unsupported vault format: empty salt")
+	}
+	return nil
+}
+
+// deriveKey runs scrypt unless the key for this salt is already cached
+func (s *FileStore) deriveKey(params vaultKDFParams) ([]byte, error) {
+	if s.key != nil && string(s.salt) == string(params.Salt) {
+		return s.key, nil
+	}
+
+	key, err := scrypt.Key(s.passphrase, params.Salt, params.N, params.R, params.P, vaultKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive vault key: %v", err)
+	}
+	s.key, s.salt = key, params.Salt
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileAtomic writes data next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create vault directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary vault file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set vault permissions: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write vault: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to flush vault: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close vault: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,146 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+func TestFileStorePersistsEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), config.VaultDir, config.VaultFile)
+
+	store := NewFileStore(path, []byte("correct horse"))
+	if err := store.Set(config.DeviceKey, "plaintext-device-key"); err != nil {
+		t.Fatalf("Failed to set item: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Vault file not created: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Vault permissions mismatch.\nGot: %o\nWant: %o", perm, 0600)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	if bytes.Contains(raw, []byte("plaintext-device-key")) {
+		t.Error("Vault file contains the secret in plaintext")
+	}
+
+	reopened := NewFileStore(path, []byte("correct horse"))
+	got, err := reopened.Get(config.DeviceKey)
+	if err != nil {
+		t.Fatalf("Failed to read item after reopening: %v", err)
+	}
+	if got != "plaintext-device-key" {
+		t.Errorf("Item mismatch.\nGot: %s\nWant: %s", got, "plaintext-device-key")
+	}
+
+	wrong := NewFileStore(path, []byte("wrong passphrase"))
+	if _, err := wrong.Get(config.DeviceKey); err == nil {
+		t.Error("Expected decryption to fail with the wrong passphrase")
+	}
+}
+
+func TestOpenStoreExplicitBackend(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv(config.VaultPassphraseEnv, "passphrase")
+
+	t.Setenv(config.StoreBackendEnv, config.StoreBackendFile)
+	store, err := OpenStore(config.Service)
+	if err != nil {
+		t.Fatalf("Failed to open file backend: %v", err)
+	}
+	if _, ok := store.(*FileStore); !ok {
+		t.Errorf("Expected *FileStore, got %T", store)
+	}
+
+	t.Setenv(config.StoreBackendEnv, "bogus")
+	if _, err := OpenStore(config.Service); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestFileStoreConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), config.VaultFile)
+
+	// Each store stands in for a separate keeper process sharing the vault
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := NewFileStore(path, []byte("correct horse"))
+			for j := range 3 {
+				if err := store.Set(fmt.Sprintf("item-%d-%d", i, j), "value"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	items, err := NewFileStore(path, []byte("correct horse")).List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(items) != 12 {
+		t.Errorf("Expected every write to survive, got %d items: %v", len(items), items)
+	}
+}
+
+func TestFileStoreRejectsKDFParams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), config.VaultFile)
+	if err := NewFileStore(path, []byte("correct horse")).Set(config.DeviceKey, "value"); err != nil {
+		t.Fatalf("Failed to set item: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(kdf *vaultKDFParams)
+	}{
+		{name: "huge N", modify: func(kdf *vaultKDFParams) { kdf.N = 1 << 30 }},
+		{name: "N not a power of two", modify: func(kdf *vaultKDFParams) { kdf.N = 1<<15 + 1 }},
+		{name: "huge r", modify: func(kdf *vaultKDFParams) { kdf.R = 1 << 20 }},
+		{name: "huge p", modify: func(kdf *vaultKDFParams) { kdf.P = 1 << 20 }},
+		{name: "empty salt", modify: func(kdf *vaultKDFParams) { kdf.Salt = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var vf vaultFile
+			if err := json.Unmarshal(raw, &vf); err != nil {
+				t.Fatalf("Failed to parse vault: %v", err)
+			}
+			tt.modify(&vf.KDF)
+			tampered, _ := json.Marshal(vf)
+			if err := os.WriteFile(path, tampered, 0600); err != nil {
+				t.Fatalf("Failed to write vault: %v", err)
+			}
+
+			_, err := NewFileStore(path, []byte("correct horse")).Get(config.DeviceKey)
+			if err == nil || !strings.Contains(err.Error(), "unsupported vault format") {
+				t.Errorf("Expected the KDF parameters to be rejected, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	keyctlKeyType = "user"
+
+	// Possessor and user get view/read/write/search/link/setattr,
+	// so a later keeper process of the same user can read the items back
+	keyctlPerm uint32 = 0x3f3f0000
+)
+
+// KeyctlStore stores items as "user" keys in the Linux kernel keyring.
+// Each item is a key described as "<service>:<item>".
+type KeyctlStore struct {
+	service  string
+	ringID   int
+	timeouts map[string]time.Duration
+}
+
+// NewKeyctlStore creates a store on the given keyring (e.g. unix.KEY_SPEC_USER_KEYRING).
+// Items with a positive timeout expire that long after each write.
+func NewKeyctlStore(service string, ringID int, timeouts map[string]time.Duration) *KeyctlStore {
+	return &KeyctlStore{service: service, ringID: ringID, timeouts: timeouts}
+}
+
+func (s *KeyctlStore) Backend() string { return config.StoreBackendKeyctl }
+
+func (s *KeyctlStore) lockTransactions() (func(), error) {
+	path, err := serviceLockPath(s.service)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path)
+}
+
+// openKeyctlStore builds a KeyctlStore from the config package environment variables
+func openKeyctlStore(service string) (SecretStore, error) {
+	ringID := unix.KEY_SPEC_USER_KEYRING
+	switch ring := os.Getenv(config.KeyctlKeyringEnv); ring {
+	case "", "user":
+	case "session":
+		ringID = unix.KEY_SPEC_SESSION_KEYRING
+	default:
+		return nil, fmt.Errorf("unknown keyctl keyring %q", ring)
+	}
+
+	timeouts := make(map[string]time.Duration)
+	for _, item := range config.Items {
+		env := config.KeyctlTimeoutEnv + "_" + strings.ToUpper(item)
+		value := os.Getenv(env)
+		if value == "" {
+			env, value = config.KeyctlTimeoutEnv, os.Getenv(config.KeyctlTimeoutEnv)
+		}
+		if value == "" {
+			continue
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", env, err)
+		}
+		// keyctl counts whole seconds and treats 0 as no expiry
+		if timeout > 0 && timeout < time.Second {
+			return nil, fmt.Errorf("invalid %s: %s is shorter than 1s", env, value)
+		}
+		timeouts[item] = timeout
+	}
+
+	return NewKeyctlStore(service, ringID, timeouts), nil
+}
+
+func (s *KeyctlStore) description(item string) string {
+	return s.service + ":" + item
+}
+
+func (s *KeyctlStore) find(item string) (int, error) {
+	id, err := unix.KeyctlSearch(s.ringID, keyctlKeyType, s.description(item), 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("keyctl search failed: %v", err)
+	}
+	return id, nil
+}
+
+func (s *KeyctlStore) Get(item string) (string, error) {
+	id, err := s.find(item)
+	if err != nil {
+		return "", err
+	}
+
+	// A nil buffer returns the payload size
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("keyctl read failed: %v", err)
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return "", fmt.Errorf("keyctl read failed: %v", err)
+	}
+	return string(buf[:n]), nil
+}
+
+func (s *KeyctlStore) Set(item, value string) error {
+	// add_key replaces the payload of an existing key with the same description
+	id, err := unix.AddKey(keyctlKeyType, s.description(item), []byte(value), s.ringID)
+	if err != nil {
+		return fmt.Errorf("keyctl add failed: %v", err)
+	}
+
+	if err := unix.KeyctlSetperm(id, keyctlPerm); err != nil {
+		return fmt.Errorf("keyctl setperm failed: %v", err)
+	}
+
+	if timeout := s.timeouts[item]; timeout > 0 {
+		seconds := int((timeout + time.Second - 1) / time.Second)
+		if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, seconds, 0, 0); err != nil {
+			return fmt.Errorf("keyctl set timeout failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *KeyctlStore) Delete(item string) error {
+	id, err := s.find(item)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, s.ringID, 0, 0); err != nil {
+		return fmt.Errorf("keyctl unlink failed: %v", err)
+	}
+	return nil
+}
+
+// List probes every known item, as keys of other services may share the keyring
+func (s *KeyctlStore) List() ([]string, error) {
+	var items []string
+	for _, item := range config.Items {
+		_, err := s.find(item)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,119 @@
+package keystore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"golang.org/x/sys/unix"
+)
+
+// newTestKeyring creates a private keyring attached to this process
+func newTestKeyring(t *testing.T) int {
+	t.Helper()
+
+	ringID, err := unix.AddKey("keyring", "dragpass-keeper-test", nil, unix.KEY_SPEC_PROCESS_KEYRING)
+	if err != nil {
+		t.Skipf("kernel keyring unavailable: %v", err)
+	}
+	// The process keyring is only installed in the creating thread's credentials, so the
+	// keyring is not possessed once the test goroutine moves to another OS thread.
+	// Grant the owning user the same rights as the possessor.
+	if err := unix.KeyctlSetperm(ringID, keyctlPerm); err != nil {
+		t.Fatalf("Failed to set keyring permissions: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = unix.KeyctlInt(unix.KEYCTL_CLEAR, ringID, 0, 0, 0)
+	})
+	return ringID
+}
+
+func TestKeyctlStoreOperations(t *testing.T) {
+	store := NewKeyctlStore(config.Service, newTestKeyring(t), nil)
+
+	if _, err := store.Get(config.DeviceKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for missing item, got: %v", err)
+	}
+
+	if err := store.Set(config.DeviceKey, "first"); err != nil {
+		t.Fatalf("Failed to set item: %v", err)
+	}
+	if err := store.Set(config.DeviceKey, "second"); err != nil {
+		t.Fatalf("Failed to overwrite item: %v", err)
+	}
+
+	got, err := store.Get(config.DeviceKey)
+	if err != nil {
+		t.Fatalf("Failed to get item: %v", err)
+	}
+	if got != "second" {
+		t.Errorf("Item mismatch.\nGot: %s\nWant: %s", got, "second")
+	}
+
+	items, err := store.List()
+	if err != nil {
+		t.Fatalf("Failed to list items: %v", err)
+	}
+	if len(items) != 1 || items[0] != config.DeviceKey {
+		t.Errorf("List mismatch.\nGot: %v\nWant: [%s]", items, config.DeviceKey)
+	}
+
+	if err := store.Delete(config.DeviceKey); err != nil {
+		t.Fatalf("Failed to delete item: %v", err)
+	}
+	if _, err := store.Get(config.DeviceKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deletion, got: %v", err)
+	}
+}
+
+func TestKeyctlStoreTimeout(t *testing.T) {
+	store := NewKeyctlStore(config.Service, newTestKeyring(t), map[string]time.Duration{
+		config.SessionCode: time.Second,
+	})
+
+	if err := store.Set(config.SessionCode, "short-lived"); err != nil {
+		t.Fatalf("Failed to set item: %v", err)
+	}
+	if _, err := store.Get(config.SessionCode); err != nil {
+		t.Fatalf("Expected item before expiry, got: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	if _, err := store.Get(config.SessionCode); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after expiry, got: %v", err)
+	}
+}
+
+func TestOpenKeyctlStoreTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		fail  bool
+	}{
+		{value: "1s", want: time.Second},
+		{value: "12h", want: 12 * time.Hour},
+		{value: "500ms", fail: true},
+		{value: "999ms", fail: true},
+		{value: "soon", fail: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(config.KeyctlTimeoutEnv, tc.value)
+
+			store, err := openKeyctlStore(config.Service)
+			if tc.fail {
+				if err == nil || !strings.Contains(err.Error(), config.KeyctlTimeoutEnv) {
+					t.Fatalf("Expected %s to be refused, got: %v", tc.value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to open keyctl store: %v", err)
+			}
+			if got := store.(*KeyctlStore).timeouts[config.SessionCode]; got != tc.want {
+				t.Errorf("Expected timeout %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
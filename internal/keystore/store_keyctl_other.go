@@ -0,0 +1,9 @@
+//go:build !linux
+
+package keystore
+
+import "errors"
+
+func openKeyctlStore(service string) (SecretStore, error) {
+	return nil, errors.New("keyctl backend is only available on Linux")
+}
@@ -0,0 +1,64 @@
+package keystore
+
+import (
+	"errors"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/zalando/go-keyring"
+)
+
+// KeyringStore stores items in the OS keyring
+// (macOS Keychain, Secret Service on Linux, Windows Credential Manager)
+type KeyringStore struct {
+	service string
+}
+
+func NewKeyringStore(service string) *KeyringStore {
+	return &KeyringStore{service: service}
+}
+
+func (s *KeyringStore) Backend() string { return config.StoreBackendKeyring }
+
+func (s *KeyringStore) lockTransactions() (func(), error) {
+	path, err := serviceLockPath(s.service)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path)
+}
+
+func (s *KeyringStore) Get(item string) (string, error) {
+	secret, err := keyring.Get(s.service, item)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	return secret, err
+}
+
+func (s *KeyringStore) Set(item, value string) error {
+	return keyring.Set(s.service, item, value)
+}
+
+func (s *KeyringStore) Delete(item string) error {
+	err := keyring.Delete(s.service, item)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// List probes every known item, since go-keyring cannot enumerate a service
+func (s *KeyringStore) List() ([]string, error) {
+	var items []string
+	for _, item := range config.Items {
+		_, err := s.Get(item)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,60 @@
+package keystore
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps items in process memory. Nothing survives a restart.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	items map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]string)}
+}
+
+func (s *MemoryStore) Backend() string { return "memory" }
+
+func (s *MemoryStore) Get(item string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.items[item]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *MemoryStore) Set(item, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[item] = value
+	return nil
+}
+
+func (s *MemoryStore) Delete(item string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[item]; !ok {
+		return ErrNotFound
+	}
+	delete(s.items, item)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	items := make([]string, 0, len(s.items))
+	for item := range s.items {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items, nil
+}
@@ -0,0 +1,52 @@
+package keystore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// OpenStore returns the storage backend chosen by config.StoreBackendEnv.
+// Without an explicit choice the OS keyring is used when reachable, and the file vault otherwise.
+func OpenStore(service string) (SecretStore, error) {
+	switch backend := os.Getenv(config.StoreBackendEnv); backend {
+	case config.StoreBackendKeyring:
+		return NewKeyringStore(service), nil
+
+	case config.StoreBackendFile:
+		return openFileStore(service)
+
+	case config.StoreBackendKeyctl:
+		return openKeyctlStore(service)
+
+	case "":
+		if keyringAvailable() {
+			return NewKeyringStore(service), nil
+		}
+		log.Println("OS keyring service unavailable, using file vault")
+		return openFileStore(service)
+
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+func openFileStore(service string) (SecretStore, error) {
+	path, err := DefaultVaultPath()
+	if err != nil {
+		return nil, err
+	}
+	// Namespaced keystores get a vault file of their own next to the default one
+	if namespace, ok := strings.CutPrefix(service, config.Service+"."); ok {
+		path = filepath.Join(filepath.Dir(path), namespace+"."+config.VaultFile)
+	}
+	passphrase, err := vaultPassphrase(service)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStore(path, passphrase), nil
+}
@@ -0,0 +1,40 @@
+package keystore
+
+import (
+	dbus "github.com/godbus/dbus/v5"
+)
+
+const secretServiceName = "org.freedesktop.secrets"
+
+// keyringAvailable reports whether a Secret Service provider is running or can be activated
+// on the session bus. The bus is never auto-launched, so headless sessions report false.
+func keyringAvailable() bool {
+	conn, err := dbus.SessionBusPrivateNoAutoStartup()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if err := conn.Auth(nil); err != nil {
+		return false
+	}
+	if err := conn.Hello(); err != nil {
+		return false
+	}
+
+	var hasOwner bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, secretServiceName).Store(&hasOwner); err == nil && hasOwner {
+		return true
+	}
+
+	var activatable []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+		return false
+	}
+	for _, name := range activatable {
+		if name == secretServiceName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package keystore
+
+// keyringAvailable is always true outside Linux, where the keyring is part of the OS
+func keyringAvailable() bool {
+	return true
+}
@@ -0,0 +1,60 @@
+package keystore
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/zalando/go-keyring"
+)
+
+func TestSecretStoreImplementations(t *testing.T) {
+	keyring.MockInit()
+
+	stores := map[string]SecretStore{
+		"memory":  NewMemoryStore(),
+		"keyring": NewKeyringStore(config.Service),
+		"file":    NewFileStore(filepath.Join(t.TempDir(), config.VaultFile), []byte("passphrase")),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Get(config.DeviceKey); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Expected ErrNotFound for missing item, got: %v", err)
+			}
+
+			if err := store.Set(config.DeviceKey, "device"); err != nil {
+				t.Fatalf("Failed to set item: %v", err)
+			}
+			if err := store.Set(config.SessionCode, "session"); err != nil {
+				t.Fatalf("Failed to set item: %v", err)
+			}
+
+			got, err := store.Get(config.DeviceKey)
+			if err != nil {
+				t.Fatalf("Failed to get item: %v", err)
+			}
+			if got != "device" {
+				t.Errorf("Item mismatch.\nGot: %s\nWant: %s", got, "device")
+			}
+
+			items, err := store.List()
+			if err != nil {
+				t.Fatalf("Failed to list items: %v", err)
+			}
+			want := []string{config.DeviceKey, config.SessionCode}
+			if !reflect.DeepEqual(items, want) {
+				t.Errorf("List mismatch.\nGot: %v\nWant: %v", items, want)
+			}
+
+			if err := store.Delete(config.DeviceKey); err != nil {
+				t.Fatalf("Failed to delete item: %v", err)
+			}
+			if err := store.Delete(config.DeviceKey); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound deleting a missing item, got: %v", err)
+			}
+		})
+	}
+}
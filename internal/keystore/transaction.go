@@ -0,0 +1,237 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// transaction groups writes so that readers see either all of them or none.
+//
+// Commit protocol:
+//  1. every new value is written under its staged name
+//  2. the journal listing all operations is written (commit point)
+//  3. operations are applied to the real items
+//  4. staged items, then the journal, are deleted
+//
+// A crash before step 2 is rolled back and a crash after it is rolled forward
+// by recoverTransaction on the next startup. Browsers start a keeper per connection,
+// so commits and recovery hold the store's transaction lock (see transactionLocker).
+type transaction struct {
+	store SecretStore
+	ops   []txOp
+}
+
+type txOp struct {
+	Item   string `json:"item"`
+	Delete bool   `json:"delete,omitempty"`
+	value  string
+}
+
+type txJournal struct {
+	Ops []txOp `json:"ops"`
+}
+
+// transactionLocker is implemented by stores several keeper processes may share.
+// The lock keeps their transactions, and the recovery of one, from overlapping.
+type transactionLocker interface {
+	lockTransactions() (unlock func(), err error)
+}
+
+// lockTransactions takes the transaction lock of store, if it has one
+func lockTransactions(store SecretStore) (func(), error) {
+	if locker, ok := store.(transactionLocker); ok {
+		return locker.lockTransactions()
+	}
+	return func() {}, nil
+}
+
+// bufferedStore is implemented by stores that hold writes back and save them all at once,
+// like the batch overlay. Transactions on them write straight through: staged items and
+// the journal would otherwise be saved to the real store as ordinary items.
+type bufferedStore interface {
+	buffersWrites()
+}
+
+func newTransaction(store SecretStore) *transaction {
+	return &transaction{store: store}
+}
+
+func stagedItem(item string) string {
+	return config.StagedItemPrefix + item
+}
+
+func (tx *transaction) Set(item, value string) {
+	tx.ops = append(tx.ops, txOp{Item: item, value: value})
+}
+
+// Delete removes the item on commit. Missing items are not an error.
+func (tx *transaction) Delete(item string) {
+	tx.ops = append(tx.ops, txOp{Item: item, Delete: true})
+}
+
+func (tx *transaction) Commit() error {
+	unlock, err := lockTransactions(tx.store)
+	if err != nil {
+		return fmt.Errorf("failed to lock keystore transactions: %w", err)
+	}
+	defer unlock()
+
+	return tx.commitLocked()
+}
+
+// commitLocked is Commit for callers already holding the transaction lock
+func (tx *transaction) commitLocked() error {
+	if _, ok := tx.store.(bufferedStore); ok {
+		for _, op := range tx.ops {
+			if err := applyOp(tx.store, op.Item, op.Delete, op.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, op := range tx.ops {
+		if op.Delete {
+			continue
+		}
+		if err := tx.store.Set(stagedItem(op.Item), op.value); err != nil {
+			tx.discardStaged()
+			return fmt.Errorf("failed to stage %s: %w", op.Item, err)
+		}
+	}
+
+	journal, err := json.Marshal(txJournal{Ops: tx.ops})
+	if err != nil {
+		tx.discardStaged()
+		return fmt.Errorf("failed to serialize transaction journal: %v", err)
+	}
+	if err := tx.store.Set(config.TransactionJournal, string(journal)); err != nil {
+		tx.discardStaged()
+		return fmt.Errorf("failed to write transaction journal: %w", err)
+	}
+
+	// Committed: from here on the transaction is only ever rolled forward
+	if err := tx.apply(); err != nil {
+		log.Printf("transaction apply failed, retrying from journal: %v", err)
+		if err := recoverTransaction(tx.store); err != nil {
+			return fmt.Errorf("transaction committed but not applied: %w", err)
+		}
+	}
+	return nil
+}
+
+func (tx *transaction) apply() error {
+	for _, op := range tx.ops {
+		if err := applyOp(tx.store, op.Item, op.Delete, op.value); err != nil {
+			return err
+		}
+	}
+	return finishTransaction(tx.store, tx.ops)
+}
+
+func (tx *transaction) discardStaged() {
+	for _, op := range tx.ops {
+		if !op.Delete {
+			_ = tx.store.Delete(stagedItem(op.Item))
+		}
+	}
+}
+
+func applyOp(store SecretStore, item string, del bool, value string) error {
+	if del {
+		if err := store.Delete(item); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to delete %s: %w", item, err)
+		}
+		return nil
+	}
+	if err := store.Set(item, value); err != nil {
+		return fmt.Errorf("failed to write %s: %w", item, err)
+	}
+	return nil
+}
+
+// finishTransaction removes the staged items and then the journal
+func finishTransaction(store SecretStore, ops []txOp) error {
+	for _, op := range ops {
+		if op.Delete {
+			continue
+		}
+		if err := store.Delete(stagedItem(op.Item)); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to remove staged %s: %w", op.Item, err)
+		}
+	}
+	if err := store.Delete(config.TransactionJournal); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to remove transaction journal: %w", err)
+	}
+	return nil
+}
+
+// recoverTransaction completes or undoes a transaction interrupted by a crash
+func recoverTransaction(store SecretStore) error {
+	raw, err := store.Get(config.TransactionJournal)
+	if errors.Is(err, ErrNotFound) {
+		return rollbackStaged(store)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read transaction journal: %w", err)
+	}
+
+	var journal txJournal
+	if err := json.Unmarshal([]byte(raw), &journal); err != nil {
+		return fmt.Errorf("failed to parse transaction journal: %v", err)
+	}
+
+	for _, op := range journal.Ops {
+		value := ""
+		if !op.Delete {
+			value, err = store.Get(stagedItem(op.Item))
+			// Staged items are only removed once every operation has been applied
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read staged %s: %w", op.Item, err)
+			}
+		}
+		if err := applyOp(store, op.Item, op.Delete, value); err != nil {
+			return err
+		}
+	}
+
+	if err := finishTransaction(store, journal.Ops); err != nil {
+		return err
+	}
+	log.Printf("rolled forward interrupted transaction (%d operations)", len(journal.Ops))
+	return nil
+}
+
+// rollbackStaged drops values staged by a transaction that never reached its commit point
+func rollbackStaged(store SecretStore) error {
+	for _, item := range config.Items {
+		err := store.Delete(stagedItem(item))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to roll back staged %s: %w", item, err)
+		}
+		log.Printf("rolled back staged %s from interrupted transaction", item)
+	}
+	return nil
+}
+
+// RecoverTransactions brings the store back to a consistent state after a crash.
+// It must run before any request is served.
+func (k *Keeper) RecoverTransactions() error {
+	unlock, err := lockTransactions(k.store)
+	if err != nil {
+		return fmt.Errorf("failed to lock keystore transactions: %w", err)
+	}
+	defer unlock()
+
+	return recoverTransaction(k.store)
+}
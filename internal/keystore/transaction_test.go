@@ -0,0 +1,152 @@
+package keystore
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// crashingStore simulates a process crash by failing every write after the first limit writes
+type crashingStore struct {
+	SecretStore
+	limit int
+}
+
+var errCrashed = errors.New("simulated crash")
+
+func (s *crashingStore) Set(item, value string) error {
+	if s.limit == 0 {
+		return errCrashed
+	}
+	s.limit--
+	return s.SecretStore.Set(item, value)
+}
+
+func (s *crashingStore) Delete(item string) error {
+	if s.limit == 0 {
+		return errCrashed
+	}
+	s.limit--
+	return s.SecretStore.Delete(item)
+}
+
+func seedKeypair(t *testing.T, store SecretStore) {
+	t.Helper()
+	for item, value := range map[string]string{
+		config.DragPassKeeperPrivateKey: "old-private",
+		config.DragPassKeeperPublicKey:  "old-public",
+		config.SessionCode:              "old-session",
+	} {
+		if err := store.Set(item, value); err != nil {
+			t.Fatalf("Failed to seed %s: %v", item, err)
+		}
+	}
+}
+
+func assertKeypair(t *testing.T, store SecretStore, wantPrivate, wantPublic string) {
+	t.Helper()
+	gotPrivate, _ := store.Get(config.DragPassKeeperPrivateKey)
+	gotPublic, _ := store.Get(config.DragPassKeeperPublicKey)
+	if gotPrivate != wantPrivate || gotPublic != wantPublic {
+		t.Errorf("Keypair mismatch.\nGot: %s / %s\nWant: %s / %s", gotPrivate, gotPublic, wantPrivate, wantPublic)
+	}
+
+	items, _ := store.List()
+	for _, item := range items {
+		if item == config.TransactionJournal || strings.HasPrefix(item, config.StagedItemPrefix) {
+			t.Errorf("Leftover transaction item: %s", item)
+		}
+	}
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	// Writes: 3 staged values, journal, 3 applied values, session delete, cleanup
+	tests := []struct {
+		name        string
+		limit       int
+		wantPrivate string
+		wantPublic  string
+	}{
+		{name: "crash while staging rolls back", limit: 1, wantPrivate: "old-private", wantPublic: "old-public"},
+		{name: "crash before journal rolls back", limit: 3, wantPrivate: "old-private", wantPublic: "old-public"},
+		{name: "crash after journal rolls forward", limit: 4, wantPrivate: "new-private", wantPublic: "new-public"},
+		{name: "crash mid apply rolls forward", limit: 5, wantPrivate: "new-private", wantPublic: "new-public"},
+		{name: "crash during cleanup rolls forward", limit: 9, wantPrivate: "new-private", wantPublic: "new-public"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			seedKeypair(t, store)
+
+			k := NewKeeper(&crashingStore{SecretStore: store, limit: tt.limit})
+			if err := k.replaceKeypair(&KeyPair{PrivateKey: "new-private", PublicKey: "new-public", Fingerprint: "new-fingerprint"}); err == nil {
+				t.Fatal("Expected the simulated crash to surface as an error")
+			}
+
+			// Restart on the surviving store
+			if err := NewKeeper(store).RecoverTransactions(); err != nil {
+				t.Fatalf("Recovery failed: %v", err)
+			}
+			assertKeypair(t, store, tt.wantPrivate, tt.wantPublic)
+		})
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	store := NewMemoryStore()
+	seedKeypair(t, store)
+
+	k := NewKeeper(store)
+	if err := k.replaceKeypair(&KeyPair{PrivateKey: "new-private", PublicKey: "new-public", Fingerprint: "new-fingerprint"}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	assertKeypair(t, store, "new-private", "new-public")
+
+	if _, err := store.Get(config.SessionCode); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected session code to be deleted, got: %v", err)
+	}
+}
+
+// lockedStore shares its transaction lock through a lock file, like the persistent backends
+type lockedStore struct {
+	SecretStore
+	path string
+}
+
+func (s *lockedStore) lockTransactions() (func(), error) { return lockFile(s.path) }
+
+func TestTransactionWaitsForLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keeper.lock")
+	store := NewMemoryStore()
+	seedKeypair(t, store)
+
+	// Another keeper process holds the lock
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to take lock: %v", err)
+	}
+
+	k := NewKeeper(&lockedStore{SecretStore: store, path: path})
+	done := make(chan error, 1)
+	go func() {
+		done <- k.replaceKeypair(&KeyPair{PrivateKey: "new-private", PublicKey: "new-public", Fingerprint: "new-fingerprint"})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Commit finished while the lock was held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assertKeypair(t, store, "old-private", "old-public")
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	assertKeypair(t, store, "new-private", "new-public")
+}
@@ -1,6 +1,9 @@
 package keystore
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+)
 
 type Validator interface {
 	Validate() error
@@ -13,13 +16,21 @@ func process[T any](payload json.RawMessage, handler func(T) BaseResponse) BaseR
 
 	if len(payload) > 0 {
 		if err := json.Unmarshal(payload, &req); err != nil {
-			return BaseResponse{Success: false, Error: "invalid payload format"}
+			resp := codeResponse(ErrorCodeInvalidPayload, "invalid payload format")
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				resp.Field = typeErr.Field
+			}
+			return resp
 		}
 	}
 
 	if v, ok := any(&req).(Validator); ok {
 		if err := v.Validate(); err != nil {
-			return BaseResponse{Success: false, Error: err.Error()}
+			// Validation failures are invalid payloads, whatever the validator returned
+			resp := errorResponse(err.Error(), err)
+			resp.Code = ErrorCodeInvalidPayload
+			return resp
 		}
 	}
 
@@ -0,0 +1,49 @@
+package keystore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// verifyServerSignatureAt verifies a base64 encoded server signature over data
+// using the given scheme (RS256 if empty) and the keys trusted at now. The key is picked
+// by kid; without a kid every trusted key is tried, the active one first, so signatures
+// made with a key in its rotation grace period still verify. It returns the kid of the key that verified.
+func (k *Keeper) verifyServerSignatureAt(data, signature, scheme, kid string, now time.Time) (string, error) {
+	// Get the trusted server keys for signature verification
+	set, err := k.loadTrustedServerKeySet()
+	if err != nil {
+		return "", fmt.Errorf("failed to get server public key: %w", err)
+	}
+
+	keys := set.trusted(now)
+	if kid != "" {
+		key, ok := set.key(kid, now)
+		if !ok {
+			return "", fmt.Errorf("%w: unknown or expired server key id: %s", ErrSignatureInvalid, kid)
+		}
+		keys = []ServerKey{*key}
+	}
+
+	// Decode the signature from base64
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to decode signature: %v", ErrSignatureInvalid, err)
+	}
+
+	// Verify signature using server's public key
+	for _, key := range keys {
+		serverPubKey, err := parseServerPublicKey(key.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse server public key: %v", err)
+		}
+		if err = VerifySignatureWithScheme(serverPubKey, scheme, data, signatureBytes); err == nil {
+			return key.Kid, nil
+		}
+		if len(keys) == 1 {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: no trusted server key (%d tried) verifies the signature", ErrSignatureInvalid, len(keys))
+}
@@ -11,6 +11,19 @@ const (
 	Version = "0.0.6"
 )
 
+// Native messaging protocol versions. Version 1 is the action/payload envelope;
+// version 2 adds request ids, error codes and out of order responses;
+// version 3 adds chunked responses over the 1MB native messaging limit.
+const (
+	ProtocolVersion = 3
+	// MinProtocolVersion is the oldest protocol a client may speak in hello
+	MinProtocolVersion = 1
+	// ConcurrentProtocolVersion is the first protocol in which requests with an id may be answered out of order
+	ConcurrentProtocolVersion = 2
+	// ChunkingProtocolVersion is the first protocol in which the keeper sends chunk frames
+	ChunkingProtocolVersion = 3
+)
+
 var (
 	BinaryHash string
 	BinaryPath string
@@ -0,0 +1,218 @@
+// Package manifest installs the native messaging host manifest that lets browsers launch the keeper
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+)
+
+// Name is the native messaging host name, which is also the manifest file name without .json
+const Name = config.Service
+
+const description = "DragPass Device Key Storage"
+
+// Scope selects whether a manifest is installed for the current user or for every user
+type Scope string
+
+const (
+	ScopeUser   Scope = "user"
+	ScopeSystem Scope = "system"
+)
+
+// Browser identifies a browser with its own manifest location
+type Browser string
+
+const (
+	Chrome   Browser = "chrome"
+	Chromium Browser = "chromium"
+	Brave    Browser = "brave"
+	Edge     Browser = "edge"
+	Vivaldi  Browser = "vivaldi"
+	// Opera reads the manifests installed for Chrome
+	Opera   Browser = "opera"
+	Firefox Browser = "firefox"
+)
+
+// Browsers lists every browser a manifest can be installed for
+var Browsers = []Browser{Chrome, Chromium, Brave, Edge, Vivaldi, Opera, Firefox}
+
+// usesExtensionIDs reports whether the browser lists callers by extension id (allowed_extensions)
+// instead of by origin (allowed_origins)
+func (b Browser) usesExtensionIDs() bool {
+	return b == Firefox
+}
+
+// location is the browser whose manifest location b reads
+func (b Browser) location() Browser {
+	if b == Opera {
+		return Chrome
+	}
+	return b
+}
+
+// ErrUnsupported is returned for a browser and scope without a manifest location on this OS
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// Manifest is the native messaging host manifest. Chromium based browsers read AllowedOrigins,
+// Firefox reads AllowedExtensions; Install writes only the one the browser reads.
+type Manifest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Path is the absolute path of the keeper binary
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// AllowedOrigins are chrome-extension://<id>/ origins
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// AllowedExtensions are Firefox extension ids
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+}
+
+// New returns the manifest of the keeper binary at path, callable by the given
+// Chromium origins and Firefox extension ids
+func New(path string, origins, extensions []string) (Manifest, error) {
+	if !filepath.IsAbs(path) {
+		return Manifest{}, fmt.Errorf("binary path %q is not absolute", path)
+	}
+	if len(origins) == 0 && len(extensions) == 0 {
+		return Manifest{}, errors.New("at least one allowed origin or extension is required")
+	}
+	return Manifest{
+		Name:              Name,
+		Description:       description,
+		Path:              path,
+		Type:              "stdio",
+		AllowedOrigins:    origins,
+		AllowedExtensions: extensions,
+	}, nil
+}
+
+// forBrowser returns m in the format browser reads
+func (m Manifest) forBrowser(browser Browser) (Manifest, error) {
+	if browser.usesExtensionIDs() {
+		if len(m.AllowedExtensions) == 0 {
+			return Manifest{}, fmt.Errorf("%s manifest needs at least one allowed extension id", browser)
+		}
+		m.AllowedOrigins = nil
+		return m, nil
+	}
+
+	if len(m.AllowedOrigins) == 0 {
+		return Manifest{}, fmt.Errorf("%s manifest needs at least one allowed origin", browser)
+	}
+	m.AllowedExtensions = nil
+	return m, nil
+}
+
+// ParseBrowser returns the browser named s
+func ParseBrowser(s string) (Browser, error) {
+	for _, browser := range Browsers {
+		if string(browser) == s {
+			return browser, nil
+		}
+	}
+	return "", fmt.Errorf("unknown browser %q", s)
+}
+
+// ParseScope returns the scope named s
+func ParseScope(s string) (Scope, error) {
+	switch scope := Scope(s); scope {
+	case ScopeUser, ScopeSystem:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("unknown scope %q, expected %s or %s", s, ScopeUser, ScopeSystem)
+	}
+}
+
+// Path returns where the manifest for browser and scope is installed.
+// Browsers sharing a manifest location share the path.
+func Path(browser Browser, scope Scope) (string, error) {
+	dir, err := manifestDir(browser.location(), scope)
+	if err != nil {
+		return "", fmt.Errorf("%s %s manifest: %w", scope, browser, err)
+	}
+	return filepath.Join(dir, Name+".json"), nil
+}
+
+// Install writes m for browser and scope, replacing an existing manifest, and returns its path
+func Install(browser Browser, scope Scope, m Manifest) (string, error) {
+	path, err := Path(browser, scope)
+	if err != nil {
+		return "", err
+	}
+	if m, err = m.forBrowser(browser); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("manifest serialization error: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	// Written next to the target and renamed, so a browser never reads a partial manifest
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := register(browser.location(), scope, path); err != nil {
+		return "", fmt.Errorf("failed to register manifest: %w", err)
+	}
+	return path, nil
+}
+
+// Uninstall removes the manifest for browser and scope and returns its path.
+// removed is false when no manifest was installed.
+func Uninstall(browser Browser, scope Scope) (path string, removed bool, err error) {
+	if path, err = Path(browser, scope); err != nil {
+		return "", false, err
+	}
+
+	if err := unregister(browser.location(), scope); err != nil {
+		return "", false, fmt.Errorf("failed to unregister manifest: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return path, false, nil
+		}
+		return "", false, fmt.Errorf("failed to remove manifest: %w", err)
+	}
+	return path, true, nil
+}
+
+// Find returns the path of the manifest the browser reads for scope. It is Path, except on
+// Windows where the browser follows its registry key; os.ErrNotExist means none is registered.
+func Find(browser Browser, scope Scope) (string, error) {
+	path, err := Path(browser, scope)
+	if err != nil {
+		return "", err
+	}
+	return registered(browser.location(), scope, path)
+}
+
+// Read returns the manifest the browser reads for scope
+func Read(browser Browser, scope Scope) (Manifest, error) {
+	path, err := Find(browser, scope)
+	if err != nil {
+		return Manifest{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	return m, nil
+}
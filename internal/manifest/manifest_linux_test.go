@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestUserManifestLocations(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	for browser, want := range map[Browser]string{
+		Chrome:   filepath.Join(home, ".config", "google-chrome", "NativeMessagingHosts", Name+".json"),
+		Chromium: filepath.Join(home, ".config", "chromium", "NativeMessagingHosts", Name+".json"),
+		Brave:    filepath.Join(home, ".config", "BraveSoftware", "Brave-Browser", "NativeMessagingHosts", Name+".json"),
+		Edge:     filepath.Join(home, ".config", "microsoft-edge", "NativeMessagingHosts", Name+".json"),
+		Vivaldi:  filepath.Join(home, ".config", "vivaldi", "NativeMessagingHosts", Name+".json"),
+		Opera:    filepath.Join(home, ".config", "google-chrome", "NativeMessagingHosts", Name+".json"),
+		Firefox:  filepath.Join(home, ".mozilla", "native-messaging-hosts", Name+".json"),
+	} {
+		if got, err := Path(browser, ScopeUser); err != nil || got != want {
+			t.Errorf("%s user manifest path mismatch.\nGot: %s (%v)\nWant: %s", browser, got, err, want)
+		}
+	}
+
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	want := filepath.Join(config, "google-chrome", "NativeMessagingHosts", Name+".json")
+	if got, _ := Path(Chrome, ScopeUser); got != want {
+		t.Errorf("Expected XDG_CONFIG_HOME to be honored.\nGot: %s\nWant: %s", got, want)
+	}
+
+	if got, _ := Path(Chrome, ScopeSystem); got != "/etc/opt/chrome/native-messaging-hosts/"+Name+".json" {
+		t.Errorf("Unexpected system manifest path: %s", got)
+	}
+	if got, _ := Path(Firefox, ScopeSystem); got != "/usr/lib/mozilla/native-messaging-hosts/"+Name+".json" {
+		t.Errorf("Unexpected Firefox system manifest path: %s", got)
+	}
+	if _, err := Path(Brave, ScopeSystem); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected no system location for Brave, got: %v", err)
+	}
+}
+
+func TestInstallUninstall(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	origins := []string{"chrome-extension://cmgjlocmnppfpknaipdfodjhbplnhimk/"}
+	m, err := New("/opt/dragpass/dragpass-keeper", origins, nil)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	for _, browser := range []Browser{Chrome, Chromium} {
+		path, err := Install(browser, ScopeUser, m)
+		if err != nil {
+			t.Fatalf("Install for %s failed: %v", browser, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Installed manifest missing: %v", err)
+		}
+		if info.Mode().Perm() != 0o644 {
+			t.Errorf("Manifest permissions mismatch.\nGot: %v\nWant: 0644", info.Mode().Perm())
+		}
+
+		got, err := Read(browser, ScopeUser)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if got.Name != Name || got.Path != m.Path || got.Type != "stdio" || !slices.Equal(got.AllowedOrigins, origins) {
+			t.Errorf("Installed manifest mismatch.\nGot: %+v\nWant: %+v", got, m)
+		}
+	}
+
+	// Reinstalling replaces the manifest
+	m.Path = "/usr/local/bin/dragpass-keeper"
+	if _, err := Install(Chrome, ScopeUser, m); err != nil {
+		t.Fatalf("Reinstall failed: %v", err)
+	}
+	if got, _ := Read(Chrome, ScopeUser); got.Path != m.Path {
+		t.Errorf("Expected the manifest to be replaced, got path %s", got.Path)
+	}
+
+	if _, removed, err := Uninstall(Chrome, ScopeUser); err != nil || !removed {
+		t.Fatalf("Uninstall failed: removed=%t err=%v", removed, err)
+	}
+	if _, err := Read(Chrome, ScopeUser); !os.IsNotExist(err) {
+		t.Errorf("Expected the manifest to be gone, got: %v", err)
+	}
+	if _, removed, err := Uninstall(Chrome, ScopeUser); err != nil || removed {
+		t.Errorf("Expected uninstalling twice to be a no-op, got removed=%t err=%v", removed, err)
+	}
+	if _, err := Read(Chromium, ScopeUser); err != nil {
+		t.Errorf("Uninstalling Chrome removed the Chromium manifest: %v", err)
+	}
+}
+
+func TestInstallFirefox(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	m, err := New("/opt/dragpass/dragpass-keeper", []string{"chrome-extension://cmgjlocmnppfpknaipdfodjhbplnhimk/"}, []string{"keeper@dragpass.app"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	path, err := Install(Firefox, ScopeUser, m)
+	if err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+
+	// Firefox rejects manifests with allowed_origins
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Invalid manifest: %v", err)
+	}
+	if _, ok := raw["allowed_origins"]; ok {
+		t.Errorf("Firefox manifest carries allowed_origins: %s", data)
+	}
+	if got, _ := Read(Firefox, ScopeUser); !slices.Equal(got.AllowedExtensions, []string{"keeper@dragpass.app"}) {
+		t.Errorf("Unexpected allowed_extensions: %v", got.AllowedExtensions)
+	}
+
+	chrome, _ := Install(Chrome, ScopeUser, m)
+	if got, _ := Read(Chrome, ScopeUser); got.AllowedExtensions != nil || len(got.AllowedOrigins) != 1 {
+		t.Errorf("Unexpected Chrome manifest at %s: %+v", chrome, got)
+	}
+
+	if _, err := Install(Firefox, ScopeUser, Manifest{Path: m.Path, AllowedOrigins: m.AllowedOrigins}); err == nil {
+		t.Error("Expected a Firefox manifest without extension ids to be rejected")
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	if _, err := New("dragpass-keeper", []string{"chrome-extension://cmgjlocmnppfpknaipdfodjhbplnhimk/"}, nil); err == nil {
+		t.Error("Expected a relative binary path to be rejected")
+	}
+	if _, err := New("/opt/dragpass/dragpass-keeper", nil, nil); err == nil {
+		t.Error("Expected a manifest without origins to be rejected")
+	}
+}
@@ -0,0 +1,44 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// userDirs are relative to ~/Library/Application Support
+var userDirs = map[Browser]string{
+	Chrome:   "Google/Chrome/NativeMessagingHosts",
+	Chromium: "Chromium/NativeMessagingHosts",
+	Brave:    "BraveSoftware/Brave-Browser/NativeMessagingHosts",
+	Edge:     "Microsoft Edge/NativeMessagingHosts",
+	Vivaldi:  "Vivaldi/NativeMessagingHosts",
+	Firefox:  "Mozilla/NativeMessagingHosts",
+}
+
+// systemDirs only lists browsers that document a system-wide location
+var systemDirs = map[Browser]string{
+	Chrome:   "/Library/Google/Chrome/NativeMessagingHosts",
+	Chromium: "/Library/Application Support/Chromium/NativeMessagingHosts",
+	Edge:     "/Library/Microsoft/Edge/NativeMessagingHosts",
+	Firefox:  "/Library/Application Support/Mozilla/NativeMessagingHosts",
+}
+
+func manifestDir(browser Browser, scope Scope) (string, error) {
+	if scope == ScopeSystem {
+		if dir, ok := systemDirs[browser]; ok {
+			return dir, nil
+		}
+		return "", ErrUnsupported
+	}
+
+	dir, ok := userDirs[browser]
+	if !ok {
+		return "", ErrUnsupported
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve home directory: %v", err)
+	}
+	return filepath.Join(home, "Library", "Application Support", dir), nil
+}
@@ -0,0 +1,66 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// userDirs are relative to $XDG_CONFIG_HOME (~/.config)
+var userDirs = map[Browser]string{
+	Chrome:   "google-chrome/NativeMessagingHosts",
+	Chromium: "chromium/NativeMessagingHosts",
+	Brave:    "BraveSoftware/Brave-Browser/NativeMessagingHosts",
+	Edge:     "microsoft-edge/NativeMessagingHosts",
+	Vivaldi:  "vivaldi/NativeMessagingHosts",
+}
+
+// firefoxUserDir is relative to the home directory; Firefox does not follow XDG
+const firefoxUserDir = ".mozilla/native-messaging-hosts"
+
+// systemDirs only lists browsers that document a system-wide location
+var systemDirs = map[Browser]string{
+	Chrome:   "/etc/opt/chrome/native-messaging-hosts",
+	Chromium: "/etc/chromium/native-messaging-hosts",
+	Edge:     "/etc/opt/edge/native-messaging-hosts",
+	Firefox:  "/usr/lib/mozilla/native-messaging-hosts",
+}
+
+func manifestDir(browser Browser, scope Scope) (string, error) {
+	if scope == ScopeSystem {
+		if dir, ok := systemDirs[browser]; ok {
+			return dir, nil
+		}
+		return "", ErrUnsupported
+	}
+
+	if browser == Firefox {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve home directory: %v", err)
+		}
+		return filepath.Join(home, firefoxUserDir), nil
+	}
+
+	dir, ok := userDirs[browser]
+	if !ok {
+		return "", ErrUnsupported
+	}
+	config, err := userConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config, dir), nil
+}
+
+// userConfigDir is $XDG_CONFIG_HOME, falling back to ~/.config, where browsers keep per-user data
+func userConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve home directory: %v", err)
+	}
+	return filepath.Join(home, ".config"), nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !windows
+
+package manifest
+
+func manifestDir(browser Browser, scope Scope) (string, error) {
+	return "", ErrUnsupported
+}
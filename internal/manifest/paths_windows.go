@@ -0,0 +1,104 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// On Windows the manifest may live anywhere; browsers find it through a registry key.
+// User manifests go under %LOCALAPPDATA%, system manifests next to the installed binary.
+func manifestDir(browser Browser, scope Scope) (string, error) {
+	if _, err := registryKey(browser); err != nil {
+		return "", err
+	}
+
+	if scope == ScopeSystem {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve executable path: %v", err)
+		}
+		return filepath.Join(filepath.Dir(exe), "NativeMessagingHosts", string(browser)), nil
+	}
+
+	dir, err := os.UserCacheDir() // %LOCALAPPDATA%
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve local app data directory: %v", err)
+	}
+	return filepath.Join(dir, "DragPass", "NativeMessagingHosts", string(browser)), nil
+}
+
+// registryKeys hold the manifest path of each browser, under HKCU or HKLM
+var registryKeys = map[Browser]string{
+	Chrome:   `Software\Google\Chrome\NativeMessagingHosts`,
+	Chromium: `Software\Chromium\NativeMessagingHosts`,
+	Brave:    `Software\BraveSoftware\Brave-Browser\NativeMessagingHosts`,
+	Edge:     `Software\Microsoft\Edge\NativeMessagingHosts`,
+	Vivaldi:  `Software\Vivaldi\NativeMessagingHosts`,
+	Firefox:  `Software\Mozilla\NativeMessagingHosts`,
+}
+
+func registryKey(browser Browser) (string, error) {
+	key, ok := registryKeys[browser]
+	if !ok {
+		return "", ErrUnsupported
+	}
+	return key + `\` + Name, nil
+}
+
+func registryRoot(scope Scope) registry.Key {
+	if scope == ScopeSystem {
+		return registry.LOCAL_MACHINE
+	}
+	return registry.CURRENT_USER
+}
+
+// register points the browser's registry key at the manifest
+func register(browser Browser, scope Scope, path string) error {
+	name, err := registryKey(browser)
+	if err != nil {
+		return err
+	}
+	key, _, err := registry.CreateKey(registryRoot(scope), name, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	return key.SetStringValue("", path)
+}
+
+func unregister(browser Browser, scope Scope) error {
+	name, err := registryKey(browser)
+	if err != nil {
+		return err
+	}
+	if err := registry.DeleteKey(registryRoot(scope), name); err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// registered returns the manifest path stored in the browser's registry key
+func registered(browser Browser, scope Scope, path string) (string, error) {
+	name, err := registryKey(browser)
+	if err != nil {
+		return "", err
+	}
+	key, err := registry.OpenKey(registryRoot(scope), name, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return "", fmt.Errorf("no registry key %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+
+	value, _, err := key.GetStringValue("")
+	if err != nil {
+		return "", fmt.Errorf("registry key %s: %w", name, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package manifest
+
+// Outside Windows browsers find the manifest by its location alone
+
+func register(browser Browser, scope Scope, path string) error { return nil }
+
+func unregister(browser Browser, scope Scope) error { return nil }
+
+func registered(browser Browser, scope Scope, path string) (string, error) { return path, nil }
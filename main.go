@@ -1,10 +1,14 @@
 package main
 
 import (
-	"io"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"syscall"
 
+	"github.com/personalconnect/dragpass-keeper/internal/agent"
 	"github.com/personalconnect/dragpass-keeper/internal/keystore"
 )
 
@@ -17,12 +21,17 @@ import (
 
 // API Actions:
 // (ping) 헬스 체크
+// (hello) 프로토콜 버전 협상 및 지원 기능 조회
 // (savedevicekey) 디바이스키 저장 요청
 // (deletedevicekey) 디바이스키 삭제 요청
 // (getdevicekey) 디바이스키 조회 요청
 // (generatekeypair) 키페어 생성 요청 [Internal: 세션 코드 삭제, 기존 키페어 삭제, 새 키페어 저장]
 // (getsessioncode) 세션코드 조회 요청
 // (getpublickey) Keeper 공개키 조회 요청
+// (checkstate) 키스토어 상태 점검 요청 [unregistered / pending_signup / pending_session / registered / corrupt]
+// (repairstate) 키스토어 복구 요청 [discard_pending / discard_session / reset_keypair / restore_server_key]
+// (rotateserverkey) 서버 키 교체 요청 [현재 신뢰하는 서버 키로 서명된 키 세트]
+// (batch) 여러 요청을 순서대로 처리 [atomic: 하나라도 실패하면 전체 롤백]
 
 // 회원가입:
 // (signalias) Alias를 전달 -> Alias에 Helper 비공개키로 Signature 생성 -> Signature, Helper 공개키 반환
@@ -37,13 +46,24 @@ import (
 // (getpublickey) Keeper 공개키 조회
 // (savesessioncode) 암호화된 세션 코드 저장
 
-func init() {
-	if err := keystore.EnsureServerPublicKey(); err != nil {
-		log.Fatalf("Critical: Failed to ensure server public key: %v", err)
-	}
-}
+// 명령행:
+// dragpass-keeper install-manifest [-scope user|system] [-browser chrome,chromium,brave,edge,vivaldi,opera,firefox] [-path 바이너리 경로] [-origin chrome-extension://<id>/] [-extension <Firefox 확장 ID>]
+// dragpass-keeper uninstall-manifest [-scope user|system] [-browser chrome,chromium,brave,edge,vivaldi,opera,firefox]
+// dragpass-keeper doctor [-json] [-browser ...] 매니페스트, 키스토어 백엔드, 저장 항목, 키페어, 서버 키 점검
+// dragpass-keeper call [-origin ...] [-exec 바이너리 경로] <action> [payload-json | -] 요청 하나를 보내고 응답 출력
+// dragpass-keeper repl [-origin ...] [-exec 바이너리 경로] 대화형으로 요청 전송 (기록은 메모리에만 보관)
+// dragpass-keeper agent [-socket 경로] [-idle-timeout 15m] 사용자별 상주 keeper, 브라우저가 띄운 keeper는 소켓으로 메시지만 전달
 
 func main() {
+	// install-manifest / uninstall-manifest / doctor / call / repl / agent
+	if handled, err := runCommand(os.Args[1:], os.Stdin, os.Stdout); handled {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dragpass-keeper: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Stdout is sent to the Chrome extension, so we log to Stderr
 	log.SetOutput(os.Stderr)
 
@@ -51,52 +71,55 @@ func main() {
 	// logFile, _ := os.OpenFile("/tmp/keeper.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	// log.SetOutput(logFile)
 
-	if err := keystore.LoadBinaryInfo(); err != nil {
-		log.Printf("Warning: Failed to calculate binary info: %v", err)
+	// The browser passes the calling extension; only extensions on the allow-list are served,
+	// each in the keystore namespace it maps to
+	origin, err := keystore.AuthorizeLaunch(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Critical: Refusing to serve caller: %v", err)
 	}
 
-	if err := keystore.EnsureServerPublicKey(); err != nil {
-		log.Fatalf("Critical: Failed to ensure server public key: %v", err)
+	// With an agent running this process only forwards the extension's messages to it
+	if conn, err := agent.Dial(agent.SocketPath(), origin); err == nil {
+		log.Printf("DragPass extension helper forwarding %s to the agent", origin)
+		if err := agent.Proxy(conn, os.Stdin, os.Stdout); err != nil {
+			log.Printf("Agent connection failed: %v", err)
+		}
+		return
+	} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ECONNREFUSED) {
+		log.Printf("Warning: Agent unavailable, serving in-process: %v", err)
 	}
 
-	log.Println("DragPass extension helper started")
+	keeper, err := openKeeper(origin)
+	if err != nil {
+		log.Fatalf("Critical: %v", err)
+	}
+
+	log.Printf("DragPass extension helper started for %s (keystore %s)", origin, origin.Service())
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Critical Panic Recovered: %v", r)
 		}
 	}()
 
-	msgr := keystore.NewMessenger(os.Stdin, os.Stdout)
-	for {
+	// Requests are handled concurrently; responses carry the request id
+	keeper.Serve(keystore.NewMessenger(os.Stdin, os.Stdout))
+}
 
-		// Read raw message bytes
-		msg, err := msgr.ReadMessage()
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Chrome extension closed the connection")
-				break
-			}
-			log.Printf("Failed to read message: %v", err)
-
-			errorResponse := keystore.BaseResponse{
-				Success: false,
-				Error:   "Native host read error: " + err.Error(),
-			}
-
-			if sendErr := msgr.SendResponse(errorResponse); sendErr != nil {
-				log.Printf("Failed to send error response: %v", sendErr)
-				break
-			}
-			continue
-		}
+// openKeeper opens the keystore of origin and prepares a keeper to serve it
+func openKeeper(origin keystore.Origin) (*keystore.Keeper, error) {
+	if err := keystore.LoadBinaryInfo(); err != nil {
+		log.Printf("Warning: Failed to calculate binary info: %v", err)
+	}
 
-		// Handle the request
-		resp := keystore.HandleRequest(msg)
+	store, err := keystore.OpenStore(origin.Service())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keystore: %w", err)
+	}
+	keeper := keystore.NewKeeper(store)
+	keeper.SetOrigin(origin)
 
-		// Send response
-		if err := msgr.SendResponse(resp); err != nil {
-			log.Printf("Failed to send response: %v", err)
-			break
-		}
+	if err := keeper.Prepare(); err != nil {
+		return nil, err
 	}
+	return keeper, nil
 }
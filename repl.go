@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/agent"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+)
+
+// errRequestFailed makes call exit with a failure status when the keeper answered with an error
+var errRequestFailed = errors.New("request failed")
+
+// caller sends one raw request to a keeper and returns the raw response
+type caller interface {
+	call(msg []byte) ([]byte, error)
+	Close() error
+}
+
+// localCaller dispatches requests in this process through HandleRequest
+type localCaller struct {
+	keeper *keystore.Keeper
+}
+
+func (c localCaller) call(msg []byte) ([]byte, error) {
+	return json.Marshal(c.keeper.HandleRequest(msg))
+}
+
+func (localCaller) Close() error { return nil }
+
+// remoteCaller talks native messaging to a keeper in another process
+type remoteCaller struct {
+	*keystore.Client
+	close func() error
+}
+
+func (c *remoteCaller) call(msg []byte) ([]byte, error) {
+	return c.Call(msg)
+}
+
+func (c *remoteCaller) Close() error {
+	return c.close()
+}
+
+// hello negotiates the newest protocol, so large responses come through as chunks
+func (c *remoteCaller) hello() error {
+	resp, err := c.Hello()
+	if err == nil && !resp.Success {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("keeper did not answer hello: %v", err)
+	}
+	return nil
+}
+
+// keeperFlags select the keeper call and repl send requests to
+type keeperFlags struct {
+	origin  string
+	binary  string
+	verbose bool
+}
+
+func (f *keeperFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.origin, "origin", "chrome-extension://"+config.ExtensionID+"/", "caller origin, selecting the keystore namespace")
+	fs.StringVar(&f.binary, "exec", "", "launch this keeper `binary` and send requests to it over native messaging")
+	fs.BoolVar(&f.verbose, "v", false, "show the keeper's log")
+}
+
+// connect reaches the keeper for the caller origin: the binary named by -exec, else a running agent,
+// else a keeper in this process
+func (f *keeperFlags) connect() (caller, error) {
+	if f.binary != "" {
+		return f.launch()
+	}
+
+	if !f.verbose {
+		log.SetOutput(io.Discard)
+	}
+	// The origin is checked against the allow-list as for a browser launch
+	origin, err := keystore.AuthorizeLaunch([]string{f.origin})
+	if err != nil {
+		return nil, err
+	}
+
+	// A running agent serves the request from its already open keystore
+	if conn, err := agent.Dial(agent.SocketPath(), origin); err == nil {
+		c := &remoteCaller{Client: keystore.NewClient(conn, conn), close: conn.Close}
+		if err := c.hello(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	keeper, err := openKeeper(origin)
+	if err != nil {
+		return nil, err
+	}
+	return localCaller{keeper: keeper}, nil
+}
+
+// launch starts the keeper binary the way a browser does, with the origin as its argument
+func (f *keeperFlags) launch() (caller, error) {
+	cmd := exec.Command(f.binary, f.origin)
+	if f.verbose {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to launch keeper: %v", err)
+	}
+
+	// The keeper exits once its input is closed
+	c := &remoteCaller{Client: keystore.NewClient(stdout, stdin), close: func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newRequest builds a request envelope. payload must be JSON, or empty for none.
+func newRequest(id int, action, payload string) ([]byte, error) {
+	req := keystore.BaseRequest{ID: json.RawMessage(strconv.Itoa(id)), Action: action}
+	if payload = strings.TrimSpace(payload); payload != "" {
+		if !json.Valid([]byte(payload)) {
+			return nil, fmt.Errorf("payload is not valid JSON: %s", payload)
+		}
+		req.Payload = json.RawMessage(payload)
+	}
+	return json.Marshal(req)
+}
+
+// parseLine turns a repl line into a request: a whole envelope is sent as is,
+// anything else is read as <action> [payload-json] and sent with id
+func parseLine(id int, line string) ([]byte, error) {
+	if strings.HasPrefix(line, "{") {
+		return []byte(line), nil
+	}
+	action, payload, _ := strings.Cut(line, " ")
+	return newRequest(id, action, payload)
+}
+
+// expandHistory resolves !! and !<n> to the request they refer to in history.
+// Other lines are returned unchanged.
+func expandHistory(line string, history []string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	n := len(history)
+	if line != "!!" {
+		var err error
+		if n, err = strconv.Atoi(line[1:]); err != nil {
+			return "", fmt.Errorf("unknown history reference %s", line)
+		}
+	}
+	if n < 1 || n > len(history) {
+		return "", fmt.Errorf("no request %s in history", line)
+	}
+	return history[n-1], nil
+}
+
+// printResponse pretty-prints a raw response and reports whether it succeeded
+func printResponse(out io.Writer, raw []byte) bool {
+	var resp keystore.BaseResponse
+	_ = json.Unmarshal(raw, &resp)
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(raw)
+	}
+	fmt.Fprintln(out, pretty.String())
+	return resp.Success
+}
+
+func runCall(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdCall, flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dragpass-keeper %s [flags] <action> [payload-json | -]\n", cmdCall)
+		fs.PrintDefaults()
+	}
+	var target keeperFlags
+	target.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("expected an action and an optional payload")
+	}
+
+	// A payload of "-" is read from stdin, keeping secrets off the command line
+	payload := fs.Arg(1)
+	if payload == "-" {
+		data, err := io.ReadAll(io.LimitReader(in, int64(keystore.MaxMessageSize)))
+		if err != nil {
+			return fmt.Errorf("failed to read payload: %v", err)
+		}
+		payload = string(data)
+	}
+	msg, err := newRequest(1, fs.Arg(0), payload)
+	if err != nil {
+		return err
+	}
+
+	c, err := target.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	raw, err := c.call(msg)
+	if err != nil {
+		return err
+	}
+	if !printResponse(out, raw) {
+		return errRequestFailed
+	}
+	return nil
+}
+
+const replHelp = `Enter a request as:
+  <action> [payload-json]   e.g. getdevicekey, or savedevicekey {"key":"..."}
+  {...}                     a whole request envelope, sent as is
+Commands:
+  history   list this session's requests
+  !!        repeat the last request
+  !<n>      repeat request n from history
+  help      show this help
+  exit      leave (also quit or Ctrl-D)
+Send hello to list the actions the keeper serves.
+`
+
+func runRepl(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdRepl, flag.ContinueOnError)
+	fs.SetOutput(out)
+	var target keeperFlags
+	target.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := target.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Fprintf(out, "dragpass-keeper %s, type help for help\n", keystore.Version)
+
+	// History lives in memory only: payloads carry device keys and session codes
+	var history []string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, int(keystore.MaxMessageSize))
+	for id := 1; ; {
+		fmt.Fprint(out, "keeper> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "!") {
+			if line, err = expandHistory(line, history); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+				continue
+			}
+			fmt.Fprintln(out, line)
+		}
+
+		switch line {
+		case "":
+			continue
+		case "exit", "quit":
+			return nil
+		case "help":
+			fmt.Fprint(out, replHelp)
+			continue
+		case "history":
+			for i, entry := range history {
+				fmt.Fprintf(out, "%4d  %s\n", i+1, entry)
+			}
+			continue
+		}
+
+		msg, err := parseLine(id, line)
+		if err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			continue
+		}
+		history = append(history, line)
+		id++
+
+		raw, err := c.call(msg)
+		if err != nil {
+			return err
+		}
+		printResponse(out, raw)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/personalconnect/dragpass-keeper/config"
+	"github.com/personalconnect/dragpass-keeper/internal/keystore"
+)
+
+// runAsKeeperEnv makes the test binary run main, so -exec can launch it like a keeper binary
+const runAsKeeperEnv = "DRAGPASS_KEEPER_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsKeeperEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// setupKeeper points call and repl at an in-process keeper on an empty file vault, with no agent running
+func setupKeeper(t *testing.T) {
+	t.Helper()
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv(config.StoreBackendEnv, config.StoreBackendFile)
+	t.Setenv(config.VaultPassphraseEnv, "passphrase")
+	t.Setenv(config.AllowedOriginsEnv, "")
+	t.Setenv(config.AgentSocketEnv, filepath.Join(t.TempDir(), "missing", config.AgentSocketFile))
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    keystore.BaseRequest
+		wantErr bool
+	}{
+		{name: "action", line: "getdevicekey", want: keystore.BaseRequest{ID: json.RawMessage("7"), Action: "getdevicekey"}},
+		{
+			name: "action and payload",
+			line: `savedevicekey {"key":"k"}`,
+			want: keystore.BaseRequest{ID: json.RawMessage("7"), Action: "savedevicekey", Payload: json.RawMessage(`{"key":"k"}`)},
+		},
+		{
+			name: "envelope is sent as is",
+			line: `{"id":"mine","action":"ping"}`,
+			want: keystore.BaseRequest{ID: json.RawMessage(`"mine"`), Action: "ping"},
+		},
+		{name: "invalid payload", line: `savedevicekey {"key":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseLine(7, tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got: %s", msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine failed: %v", err)
+			}
+			var got keystore.BaseRequest
+			if err := json.Unmarshal(msg, &got); err != nil {
+				t.Fatalf("Invalid request %s: %v", msg, err)
+			}
+			if string(got.ID) != string(tt.want.ID) || got.Action != tt.want.Action || string(got.Payload) != string(tt.want.Payload) {
+				t.Errorf("Request mismatch.\nGot: %s\nWant: %+v", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandHistory(t *testing.T) {
+	history := []string{"ping", "getdevicekey"}
+
+	tests := []struct {
+		line    string
+		history []string
+		want    string
+		wantErr bool
+	}{
+		{line: "getsessioncode", history: history, want: "getsessioncode"},
+		{line: "!!", history: history, want: "getdevicekey"},
+		{line: "!1", history: history, want: "ping"},
+		{line: "!2", history: history, want: "getdevicekey"},
+		{line: "!0", history: history, wantErr: true},
+		{line: "!999", history: history, wantErr: true},
+		{line: "!-1", history: history, wantErr: true},
+		{line: "!abc", history: history, wantErr: true},
+		{line: "!!", wantErr: true},
+		{line: "!1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := expandHistory(tt.line, tt.history)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s with %d entries: expected an error, got %q", tt.line, len(tt.history), got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q (%v), want %q", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+func TestCallExitStatus(t *testing.T) {
+	setupKeeper(t)
+
+	var out bytes.Buffer
+	handled, err := runCommand([]string{cmdCall, "getdevicekey"}, strings.NewReader(""), &out)
+	if !handled || !errors.Is(err, errRequestFailed) {
+		t.Errorf("Expected a failed response to fail the command, got handled %t: %v", handled, err)
+	}
+	if !strings.Contains(out.String(), keystore.ErrorCodeNotFound) {
+		t.Errorf("Expected the response to be printed, got: %s", out.String())
+	}
+
+	// The payload is read from stdin
+	out.Reset()
+	if _, err := runCommand([]string{cmdCall, "savedevicekey", "-"}, strings.NewReader(`{"key":"device-secret"}`), &out); err != nil {
+		t.Fatalf("savedevicekey failed: %v\n%s", err, out.String())
+	}
+	out.Reset()
+	if _, err := runCommand([]string{cmdCall, "getdevicekey"}, strings.NewReader(""), &out); err != nil || !strings.Contains(out.String(), "device-secret") {
+		t.Errorf("Expected getdevicekey to succeed, got %v: %s", err, out.String())
+	}
+
+	if _, err := runCommand([]string{cmdCall, "savedevicekey", "{"}, strings.NewReader(""), &out); err == nil || errors.Is(err, errRequestFailed) {
+		t.Errorf("Expected an invalid payload to be refused before sending, got: %v", err)
+	}
+}
+
+func TestRepl(t *testing.T) {
+	setupKeeper(t)
+
+	input := strings.Join([]string{
+		`savedevicekey {"key":"device-secret"}`,
+		"!0",
+		"getdevicekey",
+		"!!",
+		"history",
+		"exit",
+	}, "\n")
+	var out bytes.Buffer
+	if _, err := runCommand([]string{cmdRepl}, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("repl failed: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"error: no request !0 in history",
+		`"key": "device-secret"`,
+		"   3  getdevicekey",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in the output:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, `"id": `) != 3 {
+		t.Errorf("Expected three responses:\n%s", got)
+	}
+}
+
+func TestCallExec(t *testing.T) {
+	setupKeeper(t)
+	t.Setenv(runAsKeeperEnv, "1")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to find the test binary: %v", err)
+	}
+
+	// The launched keeper negotiates hello before the request is sent
+	var out bytes.Buffer
+	if _, err := runCommand([]string{cmdCall, "-exec", exe, "savedevicekey", `{"key":"device-secret"}`}, strings.NewReader(""), &out); err != nil {
+		t.Fatalf("call -exec failed: %v\n%s", err, out.String())
+	}
+	out.Reset()
+	if _, err := runCommand([]string{cmdCall, "-exec", exe, "getdevicekey"}, strings.NewReader(""), &out); err != nil || !strings.Contains(out.String(), "device-secret") {
+		t.Errorf("Expected the launched keeper to read the saved key, got %v: %s", err, out.String())
+	}
+}